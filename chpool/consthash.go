@@ -28,6 +28,7 @@ import (
 	"github.com/dchest/siphash"
 	"github.com/byte-mug/zrab2k/kvtp"
 	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/routing"
 )
 
 type RequestRouter struct{
@@ -35,11 +36,36 @@ type RequestRouter struct{
 	Source  <- chan *rpcmux.Request
 	Targets [] chan <- *rpcmux.Request
 	K1,K2 uint64
+	
+	// Optional: Places the keys on Nodes, the names of the Targets.
+	// If nil, the keys are placed by siphash(key) % len(Targets).
+	Placement routing.Placement
+	Nodes     []string
+	
+	index map[string]int
+}
+func (r *RequestRouter) target(key []byte) chan <- *rpcmux.Request {
+	if r.Placement==nil {
+		return r.Targets[siphash.Hash(r.K1,r.K2,key)%uint64(len(r.Targets))]
+	}
+	if r.index==nil {
+		r.index = make(map[string]int,len(r.Nodes))
+		for i,n := range r.Nodes { r.index[n] = i }
+	}
+	node,_ := r.Placement.Node(key)
+	i,ok := r.index[node]
+	if !ok { return nil }
+	return r.Targets[i]
 }
 func (r *RequestRouter) process(req *rpcmux.Request) {
 	kvr := req.Msg.(*kvtp.Request)
-	pos := siphash.Hash(r.K1,r.K2,kvr.Key)%uint64(len(r.Targets))
-	r.Targets[pos] <- req
+	t := r.target(kvr.Key)
+	if t==nil {
+		routing.ReplyError(req,kvtp.ERR_NotOwner,"No node owns the key")
+		req.Release()
+		return
+	}
+	t <- req
 }
 func (r *RequestRouter) Loop() {
 	for {
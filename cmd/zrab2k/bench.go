@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+type benchResult struct{
+	Ops       int64              `json:"ops"`
+	Errors    int64              `json:"errors"`
+	FirstErr  string             `json:"first_error,omitempty"`
+	Seconds   float64            `json:"seconds"`
+	OpsPerSec float64            `json:"ops_per_sec"`
+	Latency   map[string]string  `json:"latency"`
+}
+
+func percentile(lat []time.Duration, p float64) time.Duration {
+	if len(lat)==0 { return 0 }
+	i := int(float64(len(lat)-1)*p)
+	return lat[i]
+}
+
+/*
+Runs n requests on c connections: Gets with the probability reads, Puts otherwise.
+The keys are "bench:0" to "bench:{keys-1}". The connections use the settings of base.
+*/
+func bench(base *client.Client, args []string) error {
+	fs := flag.NewFlagSet("bench",flag.ContinueOnError)
+	n := fs.Int("n",10000,"Number of requests")
+	c := fs.Int("c",16,"Number of concurrent connections")
+	size := fs.Int("size",100,"Size of values")
+	keys := fs.Int("keys",1000,"Number of keys")
+	reads := fs.Float64("reads",0.5,"Fraction of reads")
+	if _,err := parse(fs,args,0,0); err!=nil { return err }
+	if *n<1 || *c<1 || *keys<1 || *size<0 { return usageError("-n, -c and -keys must be positive") }
+	
+	val := make([]byte,*size)
+	rand.Read(val)
+	
+	var next,errs int64
+	var first atomic.Value
+	lat := make([]time.Duration,*n)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0 ; i<*c ; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			cli := dial(*fAddr)
+			cli.Timeout = base.Timeout
+			cli.Namespace = base.Namespace
+			cli.Consistency = base.Consistency
+			defer cli.Close()
+			rnd := rand.New(rand.NewSource(seed))
+			ctx := context.Background()
+			for {
+				j := atomic.AddInt64(&next,1)-1
+				if j>=int64(*n) { return }
+				key := []byte(fmt.Sprint("bench:",rnd.Intn(*keys)))
+				t := time.Now()
+				var err error
+				if rnd.Float64()<*reads {
+					_,err = cli.Get(ctx,key)
+					if err==client.ErrNotFound { err = nil }
+				} else {
+					err = cli.Put(ctx,key,val)
+				}
+				lat[j] = time.Since(t)
+				if err!=nil {
+					if atomic.AddInt64(&errs,1)==1 { first.Store(errName(err)) }
+				}
+			}
+		}(int64(i)+start.UnixNano())
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	sort.Slice(lat,func(i,j int) bool { return lat[i]<lat[j] })
+	
+	r := benchResult{
+		Ops: int64(*n),
+		Errors: errs,
+		Seconds: elapsed.Seconds(),
+		OpsPerSec: float64(*n)/elapsed.Seconds(),
+		Latency: map[string]string{
+			"p50": percentile(lat,0.5).String(),
+			"p90": percentile(lat,0.9).String(),
+			"p99": percentile(lat,0.99).String(),
+			"max": lat[len(lat)-1].String(),
+		},
+	}
+	if s,ok := first.Load().(string); ok { r.FirstErr = s }
+	if *fJSON { return printJSON(r) }
+	fmt.Printf("%d requests in %v, %.0f req/s, %d errors\n",r.Ops,elapsed.Round(time.Millisecond),r.OpsPerSec,r.Errors)
+	if r.FirstErr!="" { fmt.Println("first error:",r.FirstErr) }
+	for _,p := range []string{"p50","p90","p99","max"} {
+		fmt.Printf("%-4s %s\n",p,r.Latency[p])
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+A command-line client for kvtp.
+
+	zrab2k [flags] get KEY            Prints the value.
+	zrab2k [flags] put [-ttl D] KEY [FILE]
+	                                  Stores the content of FILE (or stdin).
+	zrab2k [flags] touch [-ttl D] KEY Reports, whether the key exists, and its TTL.
+	                                  With -ttl, the TTL is set.
+	zrab2k [flags] trace KEY          Prints the hops of a lookup.
+	zrab2k [flags] stat [KEY]         Prints the statistics of the node, that owns KEY.
+	zrab2k [flags] bench [-n N] [-c C] [-size S] [-keys K] [-reads R]
+	                                  Measures throughput and latency.
+
+Flags:
+
+	-addr ADDR     Address of a node or router (host:port, or unix:PATH).
+	-ns NS         Namespace.
+	-cl LEVEL      Consistency level of replicated keys: one, quorum or all.
+	-timeout D     Timeout of a request.
+	-json          Prints JSON instead of text.
+
+Exit status is 1 on errors (including keys, that are not found), 2 on usage errors.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+var (
+	fAddr    = flag.String("addr","localhost:7700","Address of a node or router (host:port, or unix:PATH)")
+	fNs      = flag.String("ns","","Namespace")
+	fCL      = flag.String("cl","","Consistency level: one, quorum or all")
+	fTimeout = flag.Duration("timeout",10*time.Second,"Timeout of a request")
+	fJSON    = flag.Bool("json",false,"Print JSON")
+)
+
+type command struct{
+	name  string
+	usage string
+	run   func(cli *client.Client, args []string) error
+}
+
+var commands = []command{
+	{"get","KEY",get},
+	{"put","[-ttl D] KEY [FILE]",put},
+	{"touch","[-ttl D] KEY",touch},
+	{"trace","KEY",trace},
+	{"stat","[KEY]",stat},
+	{"bench","[-n N] [-c C] [-size S] [-keys K] [-reads R]",bench},
+}
+
+/* A usage error. */
+type usageError string
+func (u usageError) Error() string { return string(u) }
+
+func usage() {
+	fmt.Fprintln(os.Stderr,"usage: zrab2k [flags] COMMAND [args]")
+	fmt.Fprintln(os.Stderr)
+	for _,c := range commands {
+		fmt.Fprintf(os.Stderr,"  %s %s\n",c.name,c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr,"flags:")
+	flag.PrintDefaults()
+}
+
+func dial(addr string) *client.Client {
+	if strings.HasPrefix(addr,"unix:") { return client.Dial("unix",addr[5:]) }
+	return client.Dial("tcp",addr)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg()==0 {
+		usage()
+		os.Exit(2)
+	}
+	levels := map[string]uint8{"":kvtp.CL_NONE,"one":kvtp.CL_ONE,"quorum":kvtp.CL_QUORUM,"all":kvtp.CL_ALL}
+	cl,ok := levels[strings.ToLower(*fCL)]
+	if !ok {
+		fmt.Fprintf(os.Stderr,"zrab2k: unknown consistency level %q\n",*fCL)
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	for _,c := range commands {
+		if c.name!=name { continue }
+		cli := dial(*fAddr)
+		cli.Timeout = *fTimeout
+		cli.Namespace = *fNs
+		cli.Consistency = cl
+		err := c.run(cli,flag.Args()[1:])
+		cli.Close()
+		switch err.(type) {
+		case nil:
+		case usageError:
+			fmt.Fprintf(os.Stderr,"zrab2k: %v\nusage: zrab2k %s %s\n",err,c.name,c.usage)
+			os.Exit(2)
+		default:
+			fmt.Fprintln(os.Stderr,"zrab2k:",err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr,"zrab2k: unknown command",name)
+	usage()
+	os.Exit(2)
+}
+
+/*
+Parses the flags of a command and checks the number of positional arguments.
+*/
+func parse(fs *flag.FlagSet, args []string, min, max int) ([]string,error) {
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err!=nil { return nil,usageError(err.Error()) }
+	if fs.NArg()<min || fs.NArg()>max { return nil,usageError("wrong number of arguments") }
+	return fs.Args(),nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("","  ")
+	return enc.Encode(v)
+}
+
+/*
+Values are printed as string, if they are valid UTF-8, as base64 otherwise.
+*/
+type value struct{
+	Key       string     `json:"key"`
+	Value     *string    `json:"value,omitempty"`
+	Base64    []byte     `json:"value_base64,omitempty"`
+	Version   uint64     `json:"version,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newValue(key []byte, it *client.Item) value {
+	v := value{Key:string(key),Version:it.Version}
+	if utf8.Valid(it.Value) {
+		s := string(it.Value)
+		v.Value = &s
+	} else {
+		v.Base64 = it.Value
+	}
+	if !it.ExpiresAt.IsZero() { v.ExpiresAt = &it.ExpiresAt }
+	return v
+}
+
+func get(cli *client.Client, args []string) error {
+	args,err := parse(flag.NewFlagSet("get",flag.ContinueOnError),args,1,1)
+	if err!=nil { return err }
+	it,err := cli.Get(context.Background(),[]byte(args[0]))
+	if err!=nil { return err }
+	if *fJSON { return printJSON(newValue([]byte(args[0]),it)) }
+	_,err = os.Stdout.Write(it.Value)
+	return err
+}
+
+func put(cli *client.Client, args []string) error {
+	fs := flag.NewFlagSet("put",flag.ContinueOnError)
+	ttl := fs.Duration("ttl",0,"Time to live, 0 -> no expiration")
+	args,err := parse(fs,args,1,2)
+	if err!=nil { return err }
+	var val []byte
+	if len(args)==2 {
+		val,err = ioutil.ReadFile(args[1])
+	} else {
+		val,err = ioutil.ReadAll(os.Stdin)
+	}
+	if err!=nil { return err }
+	err = cli.PutTTL(context.Background(),[]byte(args[0]),val,*ttl)
+	if err!=nil { return err }
+	if *fJSON { return printJSON(map[string]interface{}{"key":args[0],"bytes":len(val)}) }
+	return nil
+}
+
+func touch(cli *client.Client, args []string) error {
+	fs := flag.NewFlagSet("touch",flag.ContinueOnError)
+	ttl := fs.Duration("ttl",0,"Sets the time to live")
+	args,err := parse(fs,args,1,1)
+	if err!=nil { return err }
+	ctx,key := context.Background(),[]byte(args[0])
+	if *ttl>0 {
+		found,err := cli.Expire(ctx,key,*ttl)
+		if err!=nil { return err }
+		if !found { return client.ErrNotFound }
+	}
+	left,err := cli.TTL(ctx,key)
+	if err!=nil { return err }
+	if *fJSON {
+		out := map[string]interface{}{"key":args[0],"exists":true}
+		if left!=client.NoTTL { out["ttl_seconds"] = left.Seconds() }
+		return printJSON(out)
+	}
+	if left==client.NoTTL {
+		fmt.Println("exists, no expiration")
+	} else {
+		fmt.Println("exists, expires in",left.Round(time.Second))
+	}
+	return nil
+}
+
+type hop struct{
+	Node     string `json:"node"`
+	Role     string `json:"role"`
+	Decision string `json:"decision"`
+	Elapsed  string `json:"elapsed"`
+}
+
+func trace(cli *client.Client, args []string) error {
+	args,err := parse(flag.NewFlagSet("trace",flag.ContinueOnError),args,1,1)
+	if err!=nil { return err }
+	hops,err := cli.Trace(context.Background(),[]byte(args[0]))
+	if err!=nil { return err }
+	if *fJSON {
+		out := make([]hop,len(hops))
+		for i,x := range hops {
+			out[i] = hop{x.Node,x.Role,x.Decision,x.Elapsed.String()}
+		}
+		return printJSON(out)
+	}
+	fmt.Printf("%-3s %-20s %-10s %-12s %s\n","#","NODE","ROLE","ELAPSED","DECISION")
+	for i,x := range hops {
+		fmt.Printf("%-3d %-20s %-10s %-12s %s\n",i,x.Node,x.Role,x.Elapsed,x.Decision)
+	}
+	return nil
+}
+
+func stat(cli *client.Client, args []string) error {
+	args,err := parse(flag.NewFlagSet("stat",flag.ContinueOnError),args,0,1)
+	if err!=nil { return err }
+	var key []byte
+	if len(args)==1 { key = []byte(args[0]) }
+	stats,err := cli.Stat(context.Background(),key)
+	if err!=nil { return err }
+	if *fJSON {
+		out := make(map[string]string,len(stats))
+		for _,s := range stats { out[s.Name] = s.Value }
+		return printJSON(out)
+	}
+	for _,s := range stats {
+		fmt.Printf("%-30s %s\n",s.Name,s.Value)
+	}
+	return nil
+}
+
+/* Reports the error code of err, for messages. */
+func errName(err error) string {
+	if code := client.Code(err); code!=kvtp.ERR_None { return kvtp.ErrName(code) }
+	return err.Error()
+}
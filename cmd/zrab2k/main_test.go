@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Opens a storage node in a temporary directory and connects a client to it
+through an rpcmux.Pipe.
+*/
+func openNode(t *testing.T) *client.Client {
+	dir,err := ioutil.TempDir("","zrab2k")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	
+	die := make(chan struct{})
+	db := &lsm2.DB{Name:"test",DB:bdb}
+	db.Die = die
+	db.Source = ss.Serve()
+	db.Resps = resps
+	db.Init(1)
+	t.Cleanup(func() {
+		close(die)
+		db.Wait()
+		shutdown()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return client.Over(cs.Client(),reqs)
+}
+
+/*
+Runs a command with os.Stdout redirected, and returns what it printed.
+*/
+func run(t *testing.T, cli *client.Client, cmd func(*client.Client,[]string) error, args ...string) (string,error) {
+	f,err := ioutil.TempFile("","zrab2k-out")
+	if err!=nil { t.Fatal(err) }
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	err = cmd(cli,args)
+	os.Stdout = stdout
+	out,rerr := ioutil.ReadFile(f.Name())
+	if rerr!=nil { t.Fatal(rerr) }
+	return string(out),err
+}
+
+func tempFile(t *testing.T, data []byte) string {
+	f,err := ioutil.TempFile("","zrab2k-in")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	_,err = f.Write(data)
+	if cerr := f.Close(); err==nil { err = cerr }
+	if err!=nil { t.Fatal(err) }
+	return f.Name()
+}
+
+func setJSON(t *testing.T, on bool) {
+	old := *fJSON
+	*fJSON = on
+	t.Cleanup(func() { *fJSON = old })
+}
+
+func TestPutGet(t *testing.T) {
+	cli := openNode(t)
+	file := tempFile(t,[]byte("hello"))
+	
+	if _,err := run(t,cli,put,"a",file); err!=nil { t.Fatal(err) }
+	if out,err := run(t,cli,get,"a"); out!="hello" || err!=nil { t.Errorf("get: %q %v",out,err) }
+	if _,err := run(t,cli,get,"b"); err!=client.ErrNotFound { t.Errorf("get of a missing key: %v",err) }
+	
+	if _,err := run(t,cli,put,"-ttl","1h","c",file); err!=nil { t.Fatal(err) }
+	out,err := run(t,cli,touch,"c")
+	if err!=nil || !strings.HasPrefix(out,"exists, expires in ") { t.Errorf("touch: %q %v",out,err) }
+	if out,err := run(t,cli,touch,"a"); out!="exists, no expiration\n" || err!=nil { t.Errorf("touch: %q %v",out,err) }
+	if _,err := run(t,cli,touch,"-ttl","1h","b"); err!=client.ErrNotFound { t.Errorf("touch -ttl of a missing key: %v",err) }
+}
+
+func TestJSON(t *testing.T) {
+	cli := openNode(t)
+	setJSON(t,true)
+	file := tempFile(t,[]byte{0xff,0x00})
+	if _,err := run(t,cli,put,"-ttl","1h","a",file); err!=nil { t.Fatal(err) }
+	
+	out,err := run(t,cli,get,"a")
+	if err!=nil { t.Fatal(err) }
+	var v value
+	if err := json.Unmarshal([]byte(out),&v); err!=nil { t.Fatalf("%v: %s",err,out) }
+	if v.Key!="a" || v.Value!=nil || string(v.Base64)!="\xff\x00" || v.Version==0 || v.ExpiresAt==nil || time.Until(*v.ExpiresAt)<time.Minute {
+		t.Errorf("get: %s",out)
+	}
+	
+	out,err = run(t,cli,touch,"a")
+	if err!=nil { t.Fatal(err) }
+	var tv map[string]interface{}
+	if err := json.Unmarshal([]byte(out),&tv); err!=nil { t.Fatalf("%v: %s",err,out) }
+	if tv["exists"]!=true || tv["ttl_seconds"]==nil { t.Errorf("touch: %s",out) }
+	
+	out,err = run(t,cli,stat)
+	if err!=nil { t.Fatal(err) }
+	var sv map[string]string
+	if err := json.Unmarshal([]byte(out),&sv); err!=nil { t.Fatalf("%v: %s",err,out) }
+	if sv["node"]!="test" { t.Errorf("stat: %s",out) }
+}
+
+func TestTrace(t *testing.T) {
+	cli := openNode(t)
+	out,err := run(t,cli,trace,"a")
+	if err!=nil { t.Fatal(err) }
+	lines := strings.Split(strings.TrimSpace(out),"\n")
+	if len(lines)!=2 || !strings.Contains(lines[1],"test") || !strings.Contains(lines[1],"not_found") { t.Errorf("trace: %q",out) }
+	
+	setJSON(t,true)
+	out,err = run(t,cli,trace,"a")
+	if err!=nil { t.Fatal(err) }
+	var hops []hop
+	if err := json.Unmarshal([]byte(out),&hops); err!=nil { t.Fatalf("%v: %s",err,out) }
+	if len(hops)!=1 || hops[0].Node!="test" || hops[0].Role!="node" || hops[0].Decision!="not_found" { t.Errorf("trace: %s",out) }
+}
+
+func TestUsageErrors(t *testing.T) {
+	cli := openNode(t)
+	for _,c := range []struct{
+		cmd  func(*client.Client,[]string) error
+		args []string
+	}{
+		{get,nil},
+		{get,[]string{"a","b"}},
+		{put,[]string{"-ttl","x","a"}},
+		{touch,[]string{"-bogus","a"}},
+		{stat,[]string{"a","b"}},
+		{bench,[]string{"-n","0"}},
+		{bench,[]string{"extra"}},
+	} {
+		if _,err := run(t,cli,c.cmd,c.args...); err==nil {
+			t.Errorf("%q: no error",c.args)
+		} else if _,ok := err.(usageError); !ok {
+			t.Errorf("%q: %v is not a usage error",c.args,err)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	lat := []time.Duration{1,2,3,4,5,6,7,8,9,10}
+	if p := percentile(lat,0.5); p!=5 { t.Errorf("p50: %v",p) }
+	if p := percentile(lat,0.9); p!=9 { t.Errorf("p90: %v",p) }
+	if p := percentile(lat,1); p!=10 { t.Errorf("p100: %v",p) }
+	if p := percentile(nil,0.5); p!=0 { t.Errorf("p50 of nothing: %v",p) }
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+)
+
+const (
+	RoutingNone     = "none"     // Store locally, refuse writes, if the disk is full.
+	RoutingRedirect = "redirect" // Store locally, redirect writes to peers, if the disk is full.
+	RoutingCohash   = "cohash"   // Don't store, route keys to peers by consistent hashing.
+)
+
+/* Roles of the members, see swim.Members.Role. */
+const (
+	RoleStorage = "storage"
+	RoleRouter  = "router" // Routing "cohash".
+)
+
+/* Placements of "cohash", see routing.Placement. */
+const (
+	PlacementRing = "ring"
+	PlacementHRW  = "hrw"
+	PlacementJump = "jump"
+)
+
+/* Consistency levels of "cohash", see kvtp.CL_ONE. */
+var levels = map[string]uint8{
+	"one": kvtp.CL_ONE,
+	"quorum": kvtp.CL_QUORUM,
+	"all": kvtp.CL_ALL,
+}
+
+/*
+A time.Duration, that is written as string in JSON ("10s").
+*/
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b,&s); err!=nil { return err }
+	v,err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+/*
+The configuration of zrab2kd. See zrab2kd.example.json.
+*/
+type Config struct{
+	Name     string   `json:"name"`     // Node-ID, used in CMD_Trace and CMD_Stat. "" -> Listen.
+	Listen   string   `json:"listen"`   // host:port, or unix:PATH.
+	DataDir  string   `json:"data_dir"` // Badger directory. Not used with "cohash".
+	Peers    []string `json:"peers"`    // Addresses of the other nodes.
+	Routing  string   `json:"routing"`  // RoutingNone, RoutingRedirect or RoutingCohash. "" -> "redirect", if there are peers.
+	Readers  int      `json:"readers"`  // Number of reader goroutines. 0 -> 4.
+	
+	// Disk watermarks, see storage2.Watermark.
+	Disk struct{
+		MinFree uint64  `json:"min_free_bytes"`
+		MaxUsed float64 `json:"max_used_ratio"`
+	} `json:"disk"`
+	
+	HashKeys        [2]uint64 `json:"hash_keys"`        // SipHash keys of "cohash". Must be the same on all routers.
+	Placement       string    `json:"placement"`        // Placement of "cohash": "ring" (default), "hrw" or "jump".
+	Replicas        int       `json:"replicas"`         // Replication factor of "cohash". 0 -> 1.
+	Consistency     string    `json:"consistency"`      // Default consistency level of "cohash": "one" (default), "quorum" or "all".
+	HintsDir        string    `json:"hints_dir"`        // Hinted handoff of "cohash": Directory of the hints, "" -> disabled.
+	HintMaxAge      Duration  `json:"hint_max_age"`     // Hints are dropped after this time. 0 -> 3h.
+	HintMaxBytes    int64     `json:"hint_max_bytes"`   // Size of all hints. 0 -> 64 MiB.
+	AntiEntropy     struct{
+		Interval   Duration `json:"interval"`   // Pause between two rounds, 0 -> disabled.
+		Bandwidth  int64    `json:"bandwidth"`  // Bytes per second, 0 -> unlimited.
+		Namespaces []string `json:"namespaces"` // nil -> the default namespace.
+	} `json:"anti_entropy"` // Anti-entropy between the replicas of "cohash".
+	Membership      struct{
+		Enabled        bool     `json:"enabled"`
+		Advertise      string   `json:"advertise"`       // Address of this node, as the peers reach it. "" -> name.
+		ProbeInterval  Duration `json:"probe_interval"`  // 0 -> 1s.
+		SuspectTimeout Duration `json:"suspect_timeout"` // 0 -> 5s.
+	} `json:"membership"` // SWIM membership: The peers are the seeds, storage nodes can join and leave. "cohash" places keys on the alive storage nodes only.
+	FailureDetector struct{
+		HeartbeatInterval Duration `json:"heartbeat_interval"` // 0 -> disabled.
+		Threshold         float64  `json:"threshold"`          // Suspicion (phi), at which a peer is considered failed. 0 -> 8.
+		FlapHalfLife      Duration `json:"flap_half_life"`     // 0 -> 1m.
+	} `json:"failure_detector"` // Phi-accrual failure detector of the peers, see phi.Detector.
+	DialTimeout     Duration  `json:"dial_timeout"`     // Timeout to connect to a peer. 0 -> 5s.
+	ShutdownTimeout Duration  `json:"shutdown_timeout"` // Time to commit pending writes on shutdown. 0 -> 10s.
+}
+
+func LoadConfig(path string) (*Config,error) {
+	data,err := ioutil.ReadFile(path)
+	if err!=nil { return nil,err }
+	cfg := new(Config)
+	if err = json.Unmarshal(data,cfg); err!=nil { return nil,fmt.Errorf("%s: %v",path,err) }
+	if err = cfg.check(); err!=nil { return nil,fmt.Errorf("%s: %v",path,err) }
+	return cfg,nil
+}
+
+/*
+Checks the configuration and fills in the defaults.
+*/
+func (c *Config) check() error {
+	if c.Listen=="" { return errors.New("listen is missing") }
+	if c.Name=="" { c.Name = c.Listen }
+	if c.Readers<=0 { c.Readers = 4 }
+	if c.DialTimeout<=0 { c.DialTimeout = Duration(5*time.Second) }
+	if c.ShutdownTimeout<=0 { c.ShutdownTimeout = Duration(10*time.Second) }
+	if c.Routing=="" {
+		c.Routing = RoutingNone
+		if len(c.Peers)!=0 { c.Routing = RoutingRedirect }
+	}
+	switch c.Routing {
+	case RoutingNone:
+	case RoutingRedirect,RoutingCohash:
+		if len(c.Peers)==0 { return fmt.Errorf("routing %q needs peers",c.Routing) }
+	default: return fmt.Errorf("unknown routing %q",c.Routing)
+	}
+	switch c.Placement {
+	case "": c.Placement = PlacementRing
+	case PlacementRing,PlacementHRW,PlacementJump:
+	default: return fmt.Errorf("unknown placement %q",c.Placement)
+	}
+	if c.Consistency=="" { c.Consistency = "one" }
+	if _,ok := levels[c.Consistency]; !ok { return fmt.Errorf("unknown consistency level %q",c.Consistency) }
+	if c.Replicas>len(c.Peers) && c.Routing==RoutingCohash { return errors.New("replicas exceeds the number of peers") }
+	if c.Routing!=RoutingCohash && c.DataDir=="" { return errors.New("data_dir is missing") }
+	if c.Membership.Enabled {
+		if c.Membership.Advertise=="" { c.Membership.Advertise = c.Name }
+		if strings.HasPrefix(c.Membership.Advertise,":") { return errors.New("membership.advertise must be an address, the peers can reach") }
+		if c.Routing==RoutingCohash && c.Placement==PlacementJump { return errors.New("placement \"jump\" can't follow membership") }
+	}
+	if c.FailureDetector.Threshold<0 { return errors.New("failure_detector.threshold must not be negative") }
+	if c.AntiEntropy.Bandwidth<0 { return errors.New("anti_entropy.bandwidth must not be negative") }
+	if c.Disk.MaxUsed<0 || c.Disk.MaxUsed>1 { return errors.New("disk.max_used_ratio must be between 0 and 1") }
+	return nil
+}
@@ -0,0 +1,324 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+A zrab2k storage node or router, driven by a config file (see zrab2kd.example.json).
+
+	zrab2kd -config /etc/zrab2kd.json
+
+SIGINT and SIGTERM shut the node down gracefully: It stops accepting connections,
+commits pending writes, replies to them and closes the database.
+*/
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/msgptp"
+	"github.com/byte-mug/zrab2k/routing"
+	"github.com/byte-mug/zrab2k/routing/cohash"
+	"github.com/byte-mug/zrab2k/routing/multibe"
+	"github.com/byte-mug/zrab2k/routing/phi"
+	"github.com/byte-mug/zrab2k/routing/swim"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2"
+	"github.com/byte-mug/zrab2k/storage2/hints"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+var fConfig = flag.String("config","/etc/zrab2kd.json","Config file")
+
+/*
+Every peer is considered good, as the health of the peers is not tracked.
+*/
+type anyNode struct{}
+func (anyNode) RequestGoodness(other string) uint64 { return 1 }
+
+/*
+Logs the changes of the membership.
+*/
+type memberLog string
+func (l memberLog) NodeJoined(node string) { log.Printf("%s: %s joined",string(l),node) }
+func (l memberLog) NodeLeft(node string) { log.Printf("%s: %s left",string(l),node) }
+
+func network(addr string) (string,string) {
+	if strings.HasPrefix(addr,"unix:") { return "unix",addr[5:] }
+	return "tcp",addr
+}
+
+type server struct{
+	cfg   *Config
+	reqs  sync.Pool
+	resps sync.Pool
+	src   chan *rpcmux.Request // The requests of all connections.
+	die   chan struct{}
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+/*
+Connects to a peer. Implements multibe.Dialer.
+*/
+func (s *server) dial(node string) (*rpcmux.Stream,error) {
+	nw,addr := network(node)
+	conn,err := net.DialTimeout(nw,addr,time.Duration(s.cfg.DialTimeout))
+	if err!=nil { return nil,err }
+	
+	// Forwarded requests belong to the incoming streams, so they must not be recycled after sending.
+	st := msgptp.NewStream(conn,&s.resps,nil)
+	st.Cancel = kvtp.ReqCancel(&s.reqs)
+	st.IsPartial = kvtp.RespIsPartial
+	return st,nil
+}
+
+func (s *server) track(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns,conn)
+	}
+}
+func (s *server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns { conn.Close() }
+}
+
+func (s *server) serve(l net.Listener) {
+	for {
+		conn,err := l.Accept()
+		if err!=nil {
+			select {
+			case <- s.die: return
+			default:
+			}
+			log.Print(err)
+			time.Sleep(100*time.Millisecond)
+			continue
+		}
+		s.track(conn,true)
+		st := msgptp.NewStream(conn,&s.reqs,&s.resps)
+		st.IsCancel = kvtp.ReqIsCancel
+		st.DefaultResponse = kvtp.RespDefault(&s.resps)
+		go s.feed(conn,st)
+	}
+}
+
+/*
+Passes the requests of a connection on to s.src. On shutdown, the connection stays
+open, until the pending requests have been replied to.
+*/
+func (s *server) feed(conn net.Conn, st *rpcmux.Stream) {
+	reqs := st.Serve()
+	for {
+		select {
+		case <- s.die: return
+		case <- st.Die:
+			conn.Close()
+			s.track(conn,false)
+			return
+		case req := <- reqs:
+			select {
+			case s.src <- req:
+			case <- s.die: return
+			}
+		}
+	}
+}
+
+/*
+Starts the storage node or the router. Returns a function, that waits for it to
+stop, after s.die has been closed.
+*/
+func (s *server) start() (func(),error) {
+	cfg := s.cfg
+	fwd := &multibe.Forwarder{Dial:s.dial,Name:cfg.Name}
+	var wg sync.WaitGroup
+	var health routing.NodeGoodness // The goodness of the peers, nil -> not tracked.
+	if iv := time.Duration(cfg.FailureDetector.HeartbeatInterval); iv>0 {
+		det := &phi.Detector{Threshold:cfg.FailureDetector.Threshold,FirstInterval:iv,FlapHalfLife:time.Duration(cfg.FailureDetector.FlapHalfLife)}
+		fwd.Detector = det
+		health = det
+		for _,p := range cfg.Peers { fwd.NodeJoined(p) }
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fwd.Monitor(iv,s.die)
+		}()
+	}
+	var members *swim.Members
+	var src <-chan *rpcmux.Request = s.src
+	if cfg.Membership.Enabled {
+		members = &swim.Members{Name:cfg.Membership.Advertise,Role:RoleStorage,NC:fwd,Seeds:cfg.Peers}
+		members.ProbeInterval = time.Duration(cfg.Membership.ProbeInterval)
+		members.SuspectTimeout = time.Duration(cfg.Membership.SuspectTimeout)
+		if cfg.Routing==RoutingCohash { members.Role = RoleRouter }
+		members.Subscribe("",fwd)
+		members.Subscribe("",memberLog(cfg.Name))
+		if health==nil { health = members }
+		src = members.Serve(s.src,s.die)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			members.Run(s.die)
+		}()
+	}
+	if cfg.Routing==RoutingCohash {
+		k1,k2 := cfg.HashKeys[0],cfg.HashKeys[1]
+		
+		// With membership, the peers are just seeds. The storage nodes are added, once they are alive.
+		nodes := cfg.Peers
+		if members!=nil { nodes = nil }
+		r := &cohash.Router{RedirectReader:fwd,Name:cfg.Name,Nodes:nodes,K1:k1,K2:k2,NC:fwd,Replicas:cfg.Replicas,Consistency:levels[cfg.Consistency]}
+		switch cfg.Placement {
+		case PlacementHRW:
+			hrw := &routing.HRW{K1:k1,K2:k2}
+			for _,p := range nodes { hrw.Add(p,1) }
+			r.Placement = hrw
+		case PlacementJump:
+			r.Placement = &routing.Jump{K1:k1,K2:k2,Nodes:nodes}
+		}
+		r.Health = health
+		if members!=nil { members.Subscribe(RoleStorage,r) }
+		var hdb *badger.DB
+		if cfg.HintsDir!="" {
+			var err error
+			hdb,err = badger.Open(badger.DefaultOptions(cfg.HintsDir))
+			if err!=nil { return nil,err }
+			store := &hints.Store{DB:hdb,MaxAge:time.Duration(cfg.HintMaxAge),MaxBytes:cfg.HintMaxBytes}
+			r.Hints = store
+			fwd.OnConnect = store.Wake
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				store.Deliver(fwd,s.die)
+			}()
+		}
+		if cfg.AntiEntropy.Interval>0 && cfg.Replicas>1 {
+			ae := &cohash.AntiEntropy{
+				Router:r,
+				Namespaces:cfg.AntiEntropy.Namespaces,
+				Interval:time.Duration(cfg.AntiEntropy.Interval),
+				Bandwidth:cfg.AntiEntropy.Bandwidth,
+				Progress:func(p cohash.Progress) {
+					if p.Err!=nil { log.Printf("anti-entropy round %d: %v",p.Round,p.Err) }
+					if p.Pair<p.Pairs { return }
+					log.Printf("anti-entropy round %d: %d pairs, %d leaves, %d keys differed, %d repaired, %d bytes",p.Round,p.Pairs,p.Leaves,p.Keys,p.Repaired,p.Bytes)
+				},
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ae.Run(s.die)
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <- s.die: return
+				case req := <- src: r.Process(req)
+				}
+			}
+		}()
+		return func() {
+			wg.Wait()
+			
+			// Replication and hinted handoff continue after the reply.
+			r.Wait()
+			if hdb==nil { return }
+			if err := hdb.Close(); err!=nil { log.Print(err) }
+		},nil
+	}
+	
+	bdb,err := badger.Open(badger.DefaultOptions(cfg.DataDir))
+	if err!=nil { return nil,err }
+	db := &lsm2.DB{Name:cfg.Name,DB:bdb,Reqs:&s.reqs}
+	db.DS = &storage2.Watermark{Path:cfg.DataDir,MinFree:cfg.Disk.MinFree,MaxUsed:cfg.Disk.MaxUsed}
+	if cfg.Routing==RoutingRedirect {
+		sel := &multibe.Selector{RedirectReader:fwd,NodeGoodness:anyNode{},Nodes:cfg.Peers}
+		if health!=nil { sel.NodeGoodness = health }
+		if members!=nil { members.Subscribe(RoleStorage,sel) }
+		db.RR,db.RW,db.NC,db.NS = fwd,sel,fwd,sel
+	}
+	db.Die = s.die
+	db.Source = src
+	db.Resps = &s.resps
+	db.Init(cfg.Readers)
+	return func() {
+		db.Wait()
+		wg.Wait()
+		if err := bdb.Close(); err!=nil { log.Print(err) }
+	},nil
+}
+
+func main() {
+	flag.Parse()
+	cfg,err := LoadConfig(*fConfig)
+	if err!=nil { log.Fatal(err) }
+	
+	s := &server{cfg:cfg,src:make(chan *rpcmux.Request),die:make(chan struct{}),conns:make(map[net.Conn]struct{})}
+	s.reqs.New = kvtp.NewRequest
+	s.resps.New = kvtp.NewResponse
+	
+	l,err := net.Listen(network(cfg.Listen))
+	if err!=nil { log.Fatal(err) }
+	wait,err := s.start()
+	if err!=nil { log.Fatal(err) }
+	go s.serve(l)
+	log.Printf("%s: listening on %s, routing %s",cfg.Name,cfg.Listen,cfg.Routing)
+	
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,syscall.SIGINT,syscall.SIGTERM)
+	log.Printf("%s: %v, shutting down",cfg.Name,<- sig)
+	
+	close(s.die)
+	l.Close()
+	stopped := make(chan struct{})
+	go func() {
+		wait()
+		close(stopped)
+	}()
+	select {
+	case <- stopped:
+	case <- time.After(time.Duration(cfg.ShutdownTimeout)):
+		s.closeConns()
+		log.Fatalf("%s: shutdown timed out",cfg.Name)
+	}
+	s.closeConns()
+	log.Printf("%s: stopped",cfg.Name)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A HTTP gateway for kvtp.
+
+	GET    /kv/{key}     Returns the value as body. 404, if not found.
+	HEAD   /kv/{key}     Like GET, without body.
+	PUT    /kv/{key}     Stores the body as value. 204 on success.
+	DELETE /kv/{key}     Deletes the key. 204 on success, 404 if not found.
+	GET    /trace/{key}  Returns the hops of a lookup as JSON array.
+
+The TTL of a value is given in seconds, in the X-TTL header of a PUT request.
+GET responses carry X-TTL (if the value expires) and X-Version.
+
+A PUT with "If-None-Match: *" only succeeds, if the key does not exist, a PUT
+with "If-Match: {version}" only, if the key has the given version. Otherwise
+412 Precondition Failed is returned. On success, X-Version carries the new version.
+*/
+package httpgw
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/rpcmux"
+)
+
+const DefaultMaxValue = 64<<20
+
+type Handler struct{
+	Client *client.Client
+	MaxValue int64 // Maximum size of a value, 0 -> DefaultMaxValue.
+}
+
+/*
+Creates a Handler on top of cli. See client.Over.
+*/
+func New(cli rpcmux.Client, reqs *sync.Pool) *Handler {
+	return &Handler{Client:client.Over(cli,reqs)}
+}
+
+/*
+Maps an error to a HTTP status code.
+*/
+func Status(err error) int {
+	switch err {
+	case client.ErrNotFound: return http.StatusNotFound
+	case client.ErrConflict: return http.StatusPreconditionFailed
+	case context.DeadlineExceeded,context.Canceled: return http.StatusGatewayTimeout
+	}
+	e,ok := err.(*client.Error)
+	if !ok { return http.StatusBadGateway }
+	switch e.Code {
+	case kvtp.ERR_Unsupported: return http.StatusNotImplemented
+	case kvtp.ERR_DiskFull,kvtp.ERR_QuotaExceeded: return http.StatusInsufficientStorage
+	case kvtp.ERR_TxnTooBig: return http.StatusRequestEntityTooLarge
+	case kvtp.ERR_Conflict: return http.StatusConflict
+	case kvtp.ERR_Timeout: return http.StatusGatewayTimeout
+	case kvtp.ERR_RedirectFailed: return http.StatusBadGateway
+	case kvtp.ERR_NotOwner,kvtp.ERR_Unavailable: return http.StatusServiceUnavailable
+	case kvtp.ERR_InvalidKey: return http.StatusBadRequest
+	case kvtp.ERR_NotInteger,kvtp.ERR_Overflow: return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+func fail(w http.ResponseWriter, err error) {
+	http.Error(w,err.Error(),Status(err))
+}
+
+type hop struct{
+	Node     string `json:"node"`
+	Role     string `json:"role"`
+	Decision string `json:"decision"`
+	Elapsed  string `json:"elapsed"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path,"/kv/") {
+		h.kv(w,r,[]byte(r.URL.Path[len("/kv/"):]))
+	} else if strings.HasPrefix(r.URL.Path,"/trace/") {
+		h.trace(w,r,[]byte(r.URL.Path[len("/trace/"):]))
+	} else {
+		http.NotFound(w,r)
+	}
+}
+
+func (h *Handler) kv(w http.ResponseWriter, r *http.Request, key []byte) {
+	if len(key)==0 {
+		http.Error(w,"Empty key",http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case "GET","HEAD":
+		item,err := h.Client.Get(ctx,key)
+		if err!=nil { fail(w,err); return }
+		hd := w.Header()
+		hd.Set("Content-Type","application/octet-stream")
+		hd.Set("Content-Length",strconv.Itoa(len(item.Value)))
+		hd.Set("X-Version",strconv.FormatUint(item.Version,10))
+		if !item.ExpiresAt.IsZero() {
+			ttl := time.Until(item.ExpiresAt)/time.Second
+			if ttl<0 { ttl = 0 }
+			hd.Set("X-TTL",strconv.FormatInt(int64(ttl),10))
+		}
+		if r.Method=="GET" { w.Write(item.Value) }
+	case "PUT":
+		var ttl time.Duration
+		if s := r.Header.Get("X-TTL"); s!="" {
+			n,err := strconv.ParseInt(s,10,64)
+			if err!=nil || n<0 {
+				http.Error(w,"Invalid X-TTL",http.StatusBadRequest)
+				return
+			}
+			ttl = time.Duration(n)*time.Second
+		}
+		max := h.MaxValue
+		if max==0 { max = DefaultMaxValue }
+		val,err := ioutil.ReadAll(http.MaxBytesReader(w,r.Body,max))
+		if err!=nil {
+			http.Error(w,err.Error(),http.StatusRequestEntityTooLarge)
+			return
+		}
+		var version uint64
+		if r.Header.Get("If-None-Match")=="*" {
+			version,err = h.Client.PutIfAbsent(ctx,key,val,ttl)
+		} else if s := r.Header.Get("If-Match"); s!="" {
+			v,perr := strconv.ParseUint(strings.Trim(s,"\""),10,64)
+			if perr!=nil {
+				http.Error(w,"Invalid If-Match",http.StatusBadRequest)
+				return
+			}
+			version,err = h.Client.PutIfVersion(ctx,key,val,ttl,v)
+		} else {
+			err = h.Client.PutTTL(ctx,key,val,ttl)
+		}
+		if err!=nil { fail(w,err); return }
+		if version!=0 { w.Header().Set("X-Version",strconv.FormatUint(version,10)) }
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		found,err := h.Client.Delete(ctx,key)
+		if err!=nil { fail(w,err); return }
+		if !found { fail(w,client.ErrNotFound); return }
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow","GET, HEAD, PUT, DELETE")
+		http.Error(w,"Method not allowed",http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) trace(w http.ResponseWriter, r *http.Request, key []byte) {
+	if r.Method!="GET" {
+		w.Header().Set("Allow","GET")
+		http.Error(w,"Method not allowed",http.StatusMethodNotAllowed)
+		return
+	}
+	hops,err := h.Client.Trace(r.Context(),key)
+	if err!=nil { fail(w,err); return }
+	out := make([]hop,len(hops))
+	for i,x := range hops {
+		out[i] = hop{x.Node,x.Role,x.Decision,x.Elapsed.String()}
+	}
+	w.Header().Set("Content-Type","application/json")
+	json.NewEncoder(w).Encode(out)
+}
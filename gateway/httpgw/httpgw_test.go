@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package httpgw
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Opens a storage node in a temporary directory and returns a Handler for it.
+*/
+func openNode(t *testing.T) *Handler {
+	dir,err := ioutil.TempDir("","httpgw")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	
+	die := make(chan struct{})
+	db := &lsm2.DB{Name:"test",DB:bdb}
+	db.Die = die
+	db.Source = ss.Serve()
+	db.Resps = resps
+	db.Init(1)
+	t.Cleanup(func() {
+		close(die)
+		db.Wait()
+		shutdown()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return New(cs.Client(),reqs)
+}
+
+/*
+A net.Listener, whose connections are the server ends of net.Pipes.
+*/
+type pipeListener struct{
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn,error) {
+	select {
+	case c := <- l.conns: return c,nil
+	case <- l.done: return nil,errors.New("closed")
+	}
+}
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn,error) {
+	cc,sc := net.Pipe()
+	select {
+	case l.conns <- sc: return cc,nil
+	case <- l.done: return nil,errors.New("closed")
+	}
+}
+
+type pipeAddr struct{}
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string { return "pipe" }
+
+/*
+Serves the gateway over net.Pipes and returns a HTTP client for it. setup, if
+not nil, configures the Handler.
+*/
+func serve(t *testing.T, setup func(h *Handler)) *http.Client {
+	h := openNode(t)
+	if setup!=nil { setup(h) }
+	l := &pipeListener{conns:make(chan net.Conn),done:make(chan struct{})}
+	srv := &http.Server{Handler:h}
+	go srv.Serve(l)
+	tr := &http.Transport{DialContext:l.dial}
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		srv.Close()
+	})
+	return &http.Client{Transport:tr}
+}
+
+func do(t *testing.T, c *http.Client, method, path, body string, header ...string) (*http.Response,string) {
+	req,err := http.NewRequest(method,"http://pipe"+path,strings.NewReader(body))
+	if err!=nil { t.Fatal(err) }
+	for i := 0 ; i+1<len(header) ; i += 2 { req.Header.Set(header[i],header[i+1]) }
+	resp,err := c.Do(req)
+	if err!=nil { t.Fatal(err) }
+	defer resp.Body.Close()
+	data,err := ioutil.ReadAll(resp.Body)
+	if err!=nil { t.Fatal(err) }
+	return resp,string(data)
+}
+
+func TestKV(t *testing.T) {
+	c := serve(t,nil)
+	if resp,_ := do(t,c,"PUT","/kv/a","1","X-TTL","60"); resp.StatusCode!=http.StatusNoContent { t.Fatalf("PUT: %s",resp.Status) }
+	resp,body := do(t,c,"GET","/kv/a","")
+	if resp.StatusCode!=http.StatusOK || body!="1" { t.Fatalf("GET: %s %q",resp.Status,body) }
+	if resp.Header.Get("X-Version")=="" { t.Errorf("no X-Version") }
+	if ttl := resp.Header.Get("X-TTL"); ttl!="59" && ttl!="60" { t.Errorf("X-TTL: %q",ttl) }
+	
+	resp,body = do(t,c,"HEAD","/kv/a","")
+	if resp.StatusCode!=http.StatusOK || body!="" || resp.ContentLength!=1 { t.Errorf("HEAD: %s %q %d",resp.Status,body,resp.ContentLength) }
+	if resp,_ := do(t,c,"DELETE","/kv/a",""); resp.StatusCode!=http.StatusNoContent { t.Errorf("DELETE: %s",resp.Status) }
+	if resp,_ := do(t,c,"DELETE","/kv/a",""); resp.StatusCode!=http.StatusNotFound { t.Errorf("second DELETE: %s",resp.Status) }
+	if resp,_ := do(t,c,"GET","/kv/a",""); resp.StatusCode!=http.StatusNotFound { t.Errorf("GET after DELETE: %s",resp.Status) }
+	
+	if resp,_ := do(t,c,"POST","/kv/a",""); resp.StatusCode!=http.StatusMethodNotAllowed { t.Errorf("POST: %s",resp.Status) }
+	if resp,_ := do(t,c,"GET","/kv/",""); resp.StatusCode!=http.StatusBadRequest { t.Errorf("empty key: %s",resp.Status) }
+	if resp,_ := do(t,c,"PUT","/kv/a","1","X-TTL","x"); resp.StatusCode!=http.StatusBadRequest { t.Errorf("invalid X-TTL: %s",resp.Status) }
+	if resp,_ := do(t,c,"GET","/other",""); resp.StatusCode!=http.StatusNotFound { t.Errorf("unknown path: %s",resp.Status) }
+}
+
+func TestConditionalPut(t *testing.T) {
+	c := serve(t,nil)
+	resp,_ := do(t,c,"PUT","/kv/a","1","If-None-Match","*")
+	if resp.StatusCode!=http.StatusNoContent { t.Fatalf("PUT If-None-Match: %s",resp.Status) }
+	v1 := resp.Header.Get("X-Version")
+	if v1=="" { t.Fatal("no X-Version") }
+	if resp,_ := do(t,c,"PUT","/kv/a","2","If-None-Match","*"); resp.StatusCode!=http.StatusPreconditionFailed { t.Errorf("second PUT If-None-Match: %s",resp.Status) }
+	
+	resp,_ = do(t,c,"PUT","/kv/a","2","If-Match",`"`+v1+`"`)
+	if resp.StatusCode!=http.StatusNoContent { t.Fatalf("PUT If-Match: %s",resp.Status) }
+	v2 := resp.Header.Get("X-Version")
+	if resp,_ := do(t,c,"PUT","/kv/a","3","If-Match",v1); resp.StatusCode!=http.StatusPreconditionFailed { t.Errorf("stale PUT If-Match: %s",resp.Status) }
+	resp,body := do(t,c,"GET","/kv/a","")
+	if body!="2" || resp.Header.Get("X-Version")!=v2 { t.Errorf("a: %q, version %s, want 2, %s",body,resp.Header.Get("X-Version"),v2) }
+}
+
+func TestMaxValue(t *testing.T) {
+	c := serve(t,func(h *Handler) { h.MaxValue = 4 })
+	if resp,_ := do(t,c,"PUT","/kv/a","1234"); resp.StatusCode!=http.StatusNoContent { t.Errorf("PUT: %s",resp.Status) }
+	if resp,_ := do(t,c,"PUT","/kv/a","12345"); resp.StatusCode!=http.StatusRequestEntityTooLarge { t.Errorf("PUT of a big value: %s",resp.Status) }
+}
+
+func TestTrace(t *testing.T) {
+	c := serve(t,nil)
+	resp,body := do(t,c,"GET","/trace/a","")
+	if resp.StatusCode!=http.StatusOK || !strings.HasPrefix(body,"[") { t.Errorf("trace: %s %q",resp.Status,body) }
+}
@@ -0,0 +1,278 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A gateway, that speaks the memcached text protocol and translates the commands
+into kvtp requests.
+
+Supported commands: get, gets, set, add, cas, delete, touch, version and quit.
+
+The version of a key serves as cas unique. Client flags are not persisted, they
+are always returned as 0.
+*/
+package memcgw
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+const DefaultMaxValue = 1<<20
+
+/*
+Expiration times above this value are absolute unix timestamps.
+*/
+const relativeLimit = 60*60*24*30
+
+type Server struct{
+	Client *client.Client
+	MaxValue int // Maximum size of a value, 0 -> DefaultMaxValue.
+}
+
+/*
+Accepts connections on l and serves them. Returns, if l.Accept() fails.
+*/
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn,err := l.Accept()
+		if err!=nil { return err }
+		go s.ServeConn(conn)
+	}
+}
+
+/*
+Converts a memcached exptime into a TTL. expired is true, if the item expires immediately.
+*/
+func ttlOf(exptime int64) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime==0: return 0,false
+	case exptime<0: return 0,true
+	case exptime>relativeLimit:
+		ttl = time.Until(time.Unix(exptime,0))
+		if ttl<=0 { return 0,true }
+		return ttl,false
+	}
+	return time.Duration(exptime)*time.Second,false
+}
+
+type conn struct{
+	r *bufio.Reader
+	w *bufio.Writer
+	noreply bool
+}
+
+func (c *conn) reply(s string) {
+	if c.noreply { return }
+	c.w.WriteString(s+"\r\n")
+}
+func (c *conn) fail(err error) {
+	c.reply("SERVER_ERROR "+err.Error())
+}
+
+func (s *Server) ServeConn(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{r:bufio.NewReaderSize(nc,1<<12),w:bufio.NewWriter(nc)}
+	for {
+		l,err := c.r.ReadSlice('\n')
+		if err==bufio.ErrBufferFull {
+			c.w.WriteString("CLIENT_ERROR line too long\r\n")
+			c.w.Flush()
+			return
+		}
+		if err!=nil { return }
+		// Empty lines are skipped.
+		if args := bytes.Fields(l); len(args)!=0 {
+			c.noreply = false
+			if !s.exec(c,args) {
+				c.w.Flush()
+				return
+			}
+		}
+		if c.r.Buffered()==0 {
+			if c.w.Flush()!=nil { return }
+		}
+	}
+}
+
+/*
+Executes a command. Returns false, if the connection should be closed.
+*/
+func (s *Server) exec(c *conn, args [][]byte) bool {
+	ctx := context.Background()
+	cmd := string(args[0])
+	args = args[1:]
+	if n := len(args); n>0 && string(args[n-1])=="noreply" {
+		c.noreply = true
+		args = args[:n-1]
+	}
+	switch cmd {
+	case "get","gets":
+		if len(args)==0 { c.reply("ERROR"); break }
+		for _,key := range args {
+			item,err := s.Client.Get(ctx,key)
+			if err==client.ErrNotFound { continue }
+			if err!=nil { c.fail(err); return true }
+			c.w.WriteString("VALUE ")
+			c.w.Write(key)
+			c.w.WriteString(" 0 "+strconv.Itoa(len(item.Value)))
+			if cmd=="gets" { c.w.WriteString(" "+strconv.FormatUint(item.Version,10)) }
+			c.w.WriteString("\r\n")
+			c.w.Write(item.Value)
+			c.w.WriteString("\r\n")
+		}
+		c.reply("END")
+	case "set","add","cas":
+		return s.store(ctx,c,cmd,args)
+	case "delete":
+		if len(args)!=1 { c.reply("ERROR"); break }
+		found,err := s.Client.Delete(ctx,args[0])
+		switch {
+		case err!=nil: c.fail(err)
+		case found: c.reply("DELETED")
+		default: c.reply("NOT_FOUND")
+		}
+	case "touch":
+		if len(args)!=2 { c.reply("ERROR"); break }
+		exptime,err := strconv.ParseInt(string(args[1]),10,64)
+		if err!=nil { c.reply("CLIENT_ERROR bad command line format"); break }
+		s.touch(ctx,c,args[0],exptime)
+	case "version":
+		c.reply("VERSION zrab2k")
+	case "quit":
+		return false
+	default:
+		c.reply("ERROR")
+	}
+	return true
+}
+
+/*
+set|add <key> <flags> <exptime> <bytes> [noreply]
+cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+*/
+func (s *Server) store(ctx context.Context, c *conn, cmd string, args [][]byte) bool {
+	n := 4
+	if cmd=="cas" { n = 5 }
+	if len(args)!=n {
+		c.reply("ERROR")
+		return true
+	}
+	max := s.MaxValue
+	if max==0 { max = DefaultMaxValue }
+	_,e1 := strconv.ParseUint(string(args[1]),10,32)
+	exptime,e2 := strconv.ParseInt(string(args[2]),10,64)
+	size,e3 := strconv.Atoi(string(args[3]))
+	var unique uint64
+	var e4 error
+	if cmd=="cas" { unique,e4 = strconv.ParseUint(string(args[4]),10,64) }
+	if e1!=nil || e2!=nil || e3!=nil || e4!=nil || size<0 {
+		c.reply("CLIENT_ERROR bad command line format")
+		return true
+	}
+	if size>max {
+		c.reply("SERVER_ERROR object too large for cache")
+		// The data block can't be skipped reliably, give up the connection.
+		return false
+	}
+	key := append([]byte(nil),args[0]...)
+	val := make([]byte,size+2)
+	if _,err := io.ReadFull(c.r,val); err!=nil { return false }
+	if val[size]!='\r' || val[size+1]!='\n' {
+		c.reply("CLIENT_ERROR bad data chunk")
+		return true
+	}
+	val = val[:size]
+	
+	ttl,expired := ttlOf(exptime)
+	var err error
+	switch cmd {
+	case "set":
+		if expired {
+			_,err = s.Client.Delete(ctx,key)
+		} else {
+			err = s.Client.PutTTL(ctx,key,val,ttl)
+		}
+	case "add":
+		_,err = s.Client.PutIfAbsent(ctx,key,val,ttl)
+		if err==nil && expired { _,err = s.Client.Delete(ctx,key) }
+	case "cas":
+		// A version of 0 means "key does not exist" to kvtp, but never matches in memcached.
+		if unique==0 {
+			err = client.ErrConflict
+		} else {
+			_,err = s.Client.PutIfVersion(ctx,key,val,ttl,unique)
+		}
+		if err==nil && expired { _,err = s.Client.Delete(ctx,key) }
+		if err==client.ErrConflict {
+			if _,gerr := s.Client.Get(ctx,key); gerr==client.ErrNotFound { err = client.ErrNotFound }
+		}
+	}
+	switch err {
+	case nil: c.reply("STORED")
+	case client.ErrConflict:
+		if cmd=="cas" { c.reply("EXISTS") } else { c.reply("NOT_STORED") }
+	case client.ErrNotFound: c.reply("NOT_FOUND")
+	default: c.fail(err)
+	}
+	return true
+}
+
+/*
+touch <key> <exptime> [noreply]
+*/
+func (s *Server) touch(ctx context.Context, c *conn, key []byte, exptime int64) {
+	ttl,expired := ttlOf(exptime)
+	var found bool
+	var err error
+	switch {
+	case expired:
+		found,err = s.Client.Delete(ctx,key)
+	case ttl!=0:
+		found,err = s.Client.Expire(ctx,key,ttl)
+	default:
+		/*
+		kvtp can't remove an expiration time with CMD_Touch,
+		so the value is rewritten without one.
+		*/
+		for i := 0; i<3; i++ {
+			var item *client.Item
+			item,err = s.Client.Get(ctx,key)
+			if err!=nil { break }
+			if item.ExpiresAt.IsZero() { break }
+			_,err = s.Client.PutIfVersion(ctx,key,item.Value,0,item.Version)
+			if err!=client.ErrConflict { break }
+		}
+		found = err==nil
+		if err==client.ErrNotFound { err = nil }
+	}
+	switch {
+	case err!=nil: c.fail(err)
+	case found: c.reply("TOUCHED")
+	default: c.reply("NOT_FOUND")
+	}
+}
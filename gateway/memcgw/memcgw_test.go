@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package memcgw
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Opens a storage node in a temporary directory and connects a client to it.
+*/
+func openNode(t *testing.T) *client.Client {
+	dir,err := ioutil.TempDir("","memcgw")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	
+	die := make(chan struct{})
+	db := &lsm2.DB{Name:"test",DB:bdb}
+	db.Die = die
+	db.Source = ss.Serve()
+	db.Resps = resps
+	db.Init(1)
+	t.Cleanup(func() {
+		close(die)
+		db.Wait()
+		shutdown()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return client.Over(cs.Client(),reqs)
+}
+
+/*
+A connection to the gateway.
+*/
+type testConn struct{
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, max int) *testConn {
+	s := &Server{Client:openNode(t),MaxValue:max}
+	cc,sc := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(sc)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cc.Close()
+		<- done
+	})
+	return &testConn{t,cc,bufio.NewReader(cc)}
+}
+
+/*
+Sends raw and returns the reply, up to and including the line end.
+*/
+func (c *testConn) do(raw, end string) string {
+	if _,err := io.WriteString(c.c,raw); err!=nil { c.t.Fatal(err) }
+	var reply string
+	for !strings.HasSuffix(reply,end+"\r\n") {
+		l,err := c.r.ReadString('\n')
+		reply += l
+		if err!=nil { c.t.Fatalf("%q: %q: %v",raw,reply,err) }
+	}
+	return reply
+}
+
+/*
+Returns the cas unique of key.
+*/
+func (c *testConn) unique(key string) string {
+	f := strings.Fields(c.do("gets "+key+"\r\n","END"))
+	if len(f)<5 { c.t.Fatalf("gets %s: %q",key,f) }
+	return f[4]
+}
+
+func TestCommands(t *testing.T) {
+	c := dial(t,0)
+	for _,tc := range []struct{ raw, want string }{
+		{"set a 5 0 1\r\n1\r\n","STORED\r\n"},
+		{"add a 0 0 1\r\n2\r\n","NOT_STORED\r\n"},
+		{"add b 0 60 2\r\n22\r\n","STORED\r\n"},
+		{"get a b c\r\n","VALUE a 0 1\r\n1\r\nVALUE b 0 2\r\n22\r\nEND\r\n"},
+		{"delete a\r\n","DELETED\r\n"},
+		{"delete a\r\n","NOT_FOUND\r\n"},
+		{"touch b 0\r\n","TOUCHED\r\n"},
+		{"touch a 60\r\n","NOT_FOUND\r\n"},
+		{"cas a 0 0 1 1\r\n3\r\n","NOT_FOUND\r\n"},
+		{"set a 0 0 1 noreply\r\n4\r\nget a\r\n","VALUE a 0 1\r\n4\r\nEND\r\n"},
+		{"set a 0 -1 1\r\n5\r\nget a\r\n","STORED\r\nEND\r\n"},
+		{"set a 0 0 1\r\n123\r\n","CLIENT_ERROR bad data chunk\r\n"},
+		{"set a x 0 1\r\n","CLIENT_ERROR bad command line format\r\n"},
+		{"foo\r\n","ERROR\r\n"},
+		{"version\r\n","VERSION zrab2k\r\n"},
+	}{
+		end := tc.want[strings.LastIndex(tc.want[:len(tc.want)-2],"\n")+1:len(tc.want)-2]
+		if got := c.do(tc.raw,end); got!=tc.want { t.Errorf("%q: %q, want %q",tc.raw,got,tc.want) }
+	}
+}
+
+func TestCas(t *testing.T) {
+	c := dial(t,0)
+	c.do("set a 0 0 1\r\n1\r\n","STORED")
+	u := c.unique("a")
+	if got := c.do("cas a 0 0 1 "+u+"\r\n2\r\n","STORED"); got!="STORED\r\n" { t.Errorf("cas: %q",got) }
+	if got := c.do("cas a 0 0 1 "+u+"\r\n3\r\n","EXISTS"); got!="EXISTS\r\n" { t.Errorf("stale cas: %q",got) }
+	if got := c.do("cas a 0 0 1 0\r\n3\r\n","EXISTS"); got!="EXISTS\r\n" { t.Errorf("cas 0: %q",got) }
+	if got := c.do("get a\r\n","END"); got!="VALUE a 0 1\r\n2\r\nEND\r\n" { t.Errorf("get: %q",got) }
+}
+
+func TestTooLarge(t *testing.T) {
+	c := dial(t,4)
+	if got := c.do("set a 0 0 5\r\n","SERVER_ERROR object too large for cache"); got!="SERVER_ERROR object too large for cache\r\n" { t.Errorf("set: %q",got) }
+	// The connection is closed.
+	if _,err := c.r.ReadString('\n'); err!=io.EOF { t.Errorf("after a too large value: %v",err) }
+}
@@ -0,0 +1,273 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A gateway, that speaks the Redis protocol (RESP2) and translates the commands
+into kvtp requests.
+
+Supported commands: GET, SET (EX, PX, NX), EXISTS, DEL, MGET, PING, ECHO, QUIT
+and COMMAND (an empty reply, for redis-cli).
+
+To serve a local lsm2.DB, connect it using rpcmux.Pipe and client.Over. To serve a
+cluster, point client.Over to a routing stage instead.
+*/
+package redisgw
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+const maxBulk = 64<<20
+
+/* Limits of a command: Number of arguments and their total size. */
+const (
+	maxArgs = 1<<20
+	maxCommand = 2*maxBulk
+)
+
+var errProtocol = errors.New("Protocol error")
+
+type Server struct{
+	Client *client.Client
+}
+
+/*
+Accepts connections on l and serves them. Returns, if l.Accept() fails.
+*/
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn,err := l.Accept()
+		if err!=nil { return err }
+		go s.ServeConn(conn)
+	}
+}
+
+type conn struct{
+	r *bufio.Reader
+	w *bufio.Writer
+	args [][]byte
+}
+
+func (c *conn) line() ([]byte,error) {
+	l,err := c.r.ReadSlice('\n')
+	if err==bufio.ErrBufferFull { return nil,errProtocol }
+	if err!=nil { return nil,err }
+	return bytes.TrimRight(l,"\r\n"),nil
+}
+func (c *conn) number(l []byte) (int,error) {
+	n,err := strconv.Atoi(string(l))
+	if err!=nil || n<0 || n>maxBulk { return 0,errProtocol }
+	return n,nil
+}
+
+/*
+Reads a command, either as RESP array of bulk strings or as inline command.
+*/
+func (c *conn) read() error {
+	c.args = c.args[:0]
+	l,err := c.line()
+	if err!=nil { return err }
+	if len(l)==0 || l[0]!='*' {
+		for _,f := range bytes.Fields(l) { c.args = append(c.args,append([]byte(nil),f...)) }
+		return nil
+	}
+	n,err := c.number(l[1:])
+	if err!=nil { return err }
+	if n>maxArgs { return errProtocol }
+	size := 0
+	for i := 0; i<n; i++ {
+		l,err = c.line()
+		if err!=nil { return err }
+		if len(l)==0 || l[0]!='$' { return errProtocol }
+		m,err := c.number(l[1:])
+		if err!=nil { return err }
+		size += m
+		if size>maxCommand { return errProtocol }
+		buf := make([]byte,m+2)
+		if _,err = io.ReadFull(c.r,buf); err!=nil { return err }
+		if buf[m]!='\r' || buf[m+1]!='\n' { return errProtocol }
+		c.args = append(c.args,buf[:m])
+	}
+	return nil
+}
+
+func (c *conn) simple(s string) {
+	c.w.WriteString("+"+s+"\r\n")
+}
+func (c *conn) error(s string) {
+	c.w.WriteString("-"+strings.NewReplacer("\r"," ","\n"," ").Replace(s)+"\r\n")
+}
+func (c *conn) integer(i int) {
+	c.w.WriteString(":"+strconv.Itoa(i)+"\r\n")
+}
+func (c *conn) array(n int) {
+	c.w.WriteString("*"+strconv.Itoa(n)+"\r\n")
+}
+func (c *conn) bulk(b []byte) {
+	if b==nil {
+		c.w.WriteString("$-1\r\n")
+		return
+	}
+	c.w.WriteString("$"+strconv.Itoa(len(b))+"\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (s *Server) ServeConn(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{r:bufio.NewReader(nc),w:bufio.NewWriter(nc)}
+	for {
+		err := c.read()
+		if err==errProtocol {
+			c.error("ERR Protocol error")
+			c.w.Flush()
+			return
+		}
+		if err!=nil { return }
+		// Empty inline commands are skipped.
+		if len(c.args)!=0 && !s.exec(c) {
+			c.w.Flush()
+			return
+		}
+		// Pipelining: flush, once all pending commands are answered.
+		if c.r.Buffered()==0 {
+			if c.w.Flush()!=nil { return }
+		}
+	}
+}
+
+func wrongArgs(c *conn, cmd string) {
+	c.error("ERR wrong number of arguments for '"+cmd+"' command")
+}
+
+/*
+Executes a command. Returns false, if the connection should be closed.
+*/
+func (s *Server) exec(c *conn) bool {
+	ctx := context.Background()
+	cmd := strings.ToLower(string(c.args[0]))
+	args := c.args[1:]
+	switch cmd {
+	case "ping":
+		switch len(args) {
+		case 0: c.simple("PONG")
+		case 1: c.bulk(args[0])
+		default: wrongArgs(c,cmd)
+		}
+	case "echo":
+		if len(args)!=1 { wrongArgs(c,cmd); break }
+		c.bulk(args[0])
+	case "quit":
+		c.simple("OK")
+		return false
+	case "command":
+		c.array(0)
+	case "get":
+		if len(args)!=1 { wrongArgs(c,cmd); break }
+		item,err := s.Client.Get(ctx,args[0])
+		switch err {
+		case nil: c.bulk(item.Value)
+		case client.ErrNotFound: c.bulk(nil)
+		default: c.error("ERR "+err.Error())
+		}
+	case "set":
+		s.set(ctx,c,args)
+	case "exists":
+		if len(args)==0 { wrongArgs(c,cmd); break }
+		n := 0
+		for _,key := range args {
+			ok,err := s.Client.Touch(ctx,key)
+			if err!=nil { c.error("ERR "+err.Error()); return true }
+			if ok { n++ }
+		}
+		c.integer(n)
+	case "del":
+		if len(args)==0 { wrongArgs(c,cmd); break }
+		n := 0
+		for _,key := range args {
+			ok,err := s.Client.Delete(ctx,key)
+			if err!=nil { c.error("ERR "+err.Error()); return true }
+			if ok { n++ }
+		}
+		c.integer(n)
+	case "mget":
+		if len(args)==0 { wrongArgs(c,cmd); break }
+		items,err := s.Client.MultiGet(ctx,args)
+		if err!=nil { c.error("ERR "+err.Error()); break }
+		c.array(len(items))
+		for _,item := range items {
+			if item==nil { c.bulk(nil); continue }
+			c.bulk(item.Value)
+		}
+	default:
+		c.error("ERR unknown command '"+string(c.args[0])+"'")
+	}
+	return true
+}
+
+/*
+SET key value [EX seconds | PX milliseconds] [NX]
+*/
+func (s *Server) set(ctx context.Context, c *conn, args [][]byte) {
+	if len(args)<2 { wrongArgs(c,"set"); return }
+	var ttl time.Duration
+	nx := false
+	for i := 2; i<len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx": nx = true
+		case "ex","px":
+			if i+1>=len(args) || ttl!=0 { c.error("ERR syntax error"); return }
+			n,err := strconv.ParseInt(string(args[i+1]),10,64)
+			if err!=nil || n<=0 { c.error("ERR invalid expire time in 'set' command"); return }
+			if args[i][0]|0x20=='e' {
+				ttl = time.Duration(n)*time.Second
+			} else {
+				// kvtp has a resolution of one second. Round up.
+				ttl = (time.Duration(n)*time.Millisecond+time.Second-1).Truncate(time.Second)
+			}
+			i++
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+	var err error
+	if nx {
+		_,err = s.Client.PutIfAbsent(ctx,args[0],args[1],ttl)
+	} else {
+		err = s.Client.PutTTL(ctx,args[0],args[1],ttl)
+	}
+	switch err {
+	case nil: c.simple("OK")
+	case client.ErrConflict: c.bulk(nil)
+	default: c.error("ERR "+err.Error())
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package redisgw
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Opens a storage node in a temporary directory and connects a client to it.
+*/
+func openNode(t *testing.T) *client.Client {
+	dir,err := ioutil.TempDir("","redisgw")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	
+	die := make(chan struct{})
+	db := &lsm2.DB{Name:"test",DB:bdb}
+	db.Die = die
+	db.Source = ss.Serve()
+	db.Resps = resps
+	db.Init(1)
+	t.Cleanup(func() {
+		close(die)
+		db.Wait()
+		shutdown()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return client.Over(cs.Client(),reqs)
+}
+
+/*
+A connection to the gateway.
+*/
+type testConn struct{
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T) *testConn {
+	s := &Server{Client:openNode(t)}
+	cc,sc := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(sc)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cc.Close()
+		<- done
+	})
+	return &testConn{t,cc,bufio.NewReader(cc)}
+}
+
+/*
+Reads one reply and returns it as it was sent.
+*/
+func (c *testConn) reply() string {
+	l,err := c.r.ReadString('\n')
+	if err!=nil { c.t.Fatal(err) }
+	switch l[0] {
+	case '$':
+		n,_ := strconv.Atoi(strings.TrimSpace(l[1:]))
+		if n<0 { return l }
+		buf := make([]byte,n+2)
+		if _,err := io.ReadFull(c.r,buf); err!=nil { c.t.Fatal(err) }
+		return l+string(buf)
+	case '*':
+		n,_ := strconv.Atoi(strings.TrimSpace(l[1:]))
+		for i := 0 ; i<n ; i++ { l += c.reply() }
+	}
+	return l
+}
+
+/*
+Sends raw and returns the reply.
+*/
+func (c *testConn) raw(raw string) string {
+	if _,err := io.WriteString(c.c,raw); err!=nil { c.t.Fatal(err) }
+	return c.reply()
+}
+
+/*
+Sends a command as RESP array and returns the reply.
+*/
+func (c *testConn) do(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n",len(args))
+	for _,a := range args { s += fmt.Sprintf("$%d\r\n%s\r\n",len(a),a) }
+	return c.raw(s)
+}
+
+func TestCommands(t *testing.T) {
+	c := dial(t)
+	for _,tc := range []struct{ args []string; want string }{
+		{[]string{"PING"},"+PONG\r\n"},
+		{[]string{"SET","a","1"},"+OK\r\n"},
+		{[]string{"SET","a","2","NX"},"$-1\r\n"},
+		{[]string{"SET","b","22","EX","60"},"+OK\r\n"},
+		{[]string{"GET","a"},"$1\r\n1\r\n"},
+		{[]string{"GET","c"},"$-1\r\n"},
+		{[]string{"MGET","a","c","b"},"*3\r\n$1\r\n1\r\n$-1\r\n$2\r\n22\r\n"},
+		{[]string{"EXISTS","a","b","c"},":2\r\n"},
+		{[]string{"DEL","a","c"},":1\r\n"},
+		{[]string{"GET","a"},"$-1\r\n"},
+		{[]string{"SET","a"},"-ERR wrong number of arguments for 'set' command\r\n"},
+		{[]string{"FOO"},"-ERR unknown command 'FOO'\r\n"},
+	}{
+		if got := c.do(tc.args...); got!=tc.want { t.Errorf("%q: %q, want %q",tc.args,got,tc.want) }
+	}
+	if got := c.raw("PING hello\r\n"); got!="$5\r\nhello\r\n" { t.Errorf("inline PING: %q",got) }
+	if got := c.do("QUIT"); got!="+OK\r\n" { t.Errorf("QUIT: %q",got) }
+}
+
+func TestPipelining(t *testing.T) {
+	c := dial(t)
+	if _,err := io.WriteString(c.c,"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"); err!=nil { t.Fatal(err) }
+	if got := c.reply(); got!="+OK\r\n" { t.Errorf("SET: %q",got) }
+	if got := c.reply(); got!="$1\r\nv\r\n" { t.Errorf("GET: %q",got) }
+}
+
+/*
+A reply must be flushed, even if only an empty line follows its command.
+*/
+func TestEmptyLine(t *testing.T) {
+	c := dial(t)
+	if got := c.raw("PING\r\n\r\n"); got!="+PONG\r\n" { t.Errorf("PING: %q",got) }
+}
+
+func TestProtocolErrors(t *testing.T) {
+	for _,raw := range []string{
+		"*1\r\n$4\r\nPINGxx", // No CRLF after the bulk string.
+		"*1\r\n+PING\r\n", // No bulk string.
+		"*2000000\r\n", // Too many arguments.
+		fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n",maxBulk+1), // Bulk string too big.
+	}{
+		c := dial(t)
+		if got := c.raw(raw); got!="-ERR Protocol error\r\n" { t.Errorf("%q: %q",raw,got) }
+	}
+}
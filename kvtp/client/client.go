@@ -0,0 +1,620 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A high-level client for kvtp over msgptp.
+
+The client manages the connection and the memory pools internally and
+reconnects, if the connection dies.
+*/
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/msgptp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+)
+
+var (
+	ErrNotFound = errors.New("kvtp: not found")
+	ErrConflict = errors.New("kvtp: conflict")
+	ErrClosed   = errors.New("kvtp: client closed")
+	ErrProtocol = errors.New("kvtp: unexpected response")
+)
+
+/*
+TTL of keys without expiration.
+*/
+const NoTTL = time.Duration(-1)
+
+/*
+An error, returned by the server (RESP_Error).
+*/
+type Error struct{
+	Code uint8 // kvtp.ERR_*
+	Msg  string
+}
+func (e *Error) Error() string {
+	if e.Msg=="" { return "kvtp: "+kvtp.ErrName(e.Code) }
+	return "kvtp: "+kvtp.ErrName(e.Code)+": "+e.Msg
+}
+
+/*
+Returns the kvtp.ERR_* code of err, or kvtp.ERR_None if err is not an *Error.
+*/
+func Code(err error) uint8 {
+	if e,ok := err.(*Error); ok { return e.Code }
+	return kvtp.ERR_None
+}
+
+/*
+A value, as returned by Get.
+*/
+type Item struct{
+	Value     []byte
+	Version   uint64
+	ExpiresAt time.Time // Zero -> no expiration.
+}
+
+func expiresAt(u uint64) time.Time {
+	if u==0 { return time.Time{} }
+	return time.Unix(int64(u),0)
+}
+func expiresIn(ttl time.Duration) uint64 {
+	if ttl<=0 { return 0 }
+	return uint64(time.Now().Add(ttl).Unix())
+}
+
+type Client struct{
+	// Dials the server.
+	Dial func() (io.ReadWriteCloser,error)
+	
+	// Timeout for requests, whose context has no deadline. 0 -> no timeout.
+	Timeout time.Duration
+	
+	// Namespace of all requests. "" -> default namespace.
+	Namespace string
+	
+	// Consistency level (kvtp.CL_*) of all requests to replicated keys.
+	// CL_NONE -> the default of the router.
+	Consistency uint8
+	
+	reqs   sync.Pool
+	resps  sync.Pool
+	rpool  *sync.Pool
+	lock   sync.Mutex
+	conn   io.ReadWriteCloser
+	stream *rpcmux.Stream
+	cli    rpcmux.Client
+	closed bool
+}
+
+func New(dial func() (io.ReadWriteCloser,error)) *Client {
+	return &Client{Dial:dial}
+}
+
+/*
+Creates a client on top of an existing rpcmux.Client, such as an in-process
+rpcmux.Pipe to a storage node or a router. Requests are taken from reqs, which
+must be the pool, the other end releases received requests into.
+If reqs is nil, requests are allocated on demand. For Watch, the Stream of cli
+must have IsPartial set to kvtp.RespIsPartial.
+
+The client does not reconnect. Close does not close cli.
+*/
+func Over(cli rpcmux.Client, reqs *sync.Pool) *Client {
+	c := &Client{cli:cli,rpool:reqs}
+	if reqs==nil { c.rpool = &sync.Pool{New:kvtp.NewRequest} }
+	return c
+}
+
+/*
+Creates a client, that connects to the given address, once needed.
+*/
+func Dial(network, address string) *Client {
+	return New(func() (io.ReadWriteCloser,error) { return net.Dial(network,address) })
+}
+
+func (c *Client) init() {
+	if c.reqs.New==nil {
+		c.reqs.New = kvtp.NewRequest
+		c.resps.New = kvtp.NewResponse
+		c.rpool = &c.reqs
+	}
+}
+
+func (c *Client) client() (rpcmux.Client,error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed { return nil,ErrClosed }
+	if c.Dial==nil { return c.cli,nil }
+	if c.stream!=nil {
+		select {
+		case <- c.stream.Die:
+			c.conn.Close()
+		default: return c.cli,nil
+		}
+	}
+	c.init()
+	conn,err := c.Dial()
+	if err!=nil { return nil,err }
+	stream := msgptp.NewStream(conn,&c.resps,&c.reqs)
+	stream.Cancel = kvtp.ReqCancel(&c.reqs)
+	stream.IsPartial = kvtp.RespIsPartial
+	c.conn = conn
+	c.stream = stream
+	c.cli = stream.Client()
+	return c.cli,nil
+}
+
+/*
+Closes the connection. The client can't be used afterwards.
+*/
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.conn==nil { return nil }
+	return c.conn.Close()
+}
+
+/*
+Performs a raw request. build fills in the request, handle processes the response.
+
+RESP_Error responses are turned into *Error, handle is not called for them.
+handle must not retain the response or any of its buffers.
+*/
+func (c *Client) Do(ctx context.Context, build func(r *kvtp.Request), handle func(r *kvtp.Response) error) error {
+	cli,err := c.client()
+	if err!=nil { return err }
+	if c.Timeout>0 {
+		if _,ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx,cancel = context.WithTimeout(ctx,c.Timeout)
+			defer cancel()
+		}
+	}
+	msg := c.rpool.Get().(*kvtp.Request)
+	msg.Reset()
+	msg.Namespace = c.Namespace
+	msg.Consistency = c.Consistency
+	build(msg)
+	resp,err := cli.Request(msg,ctx)
+	if err!=nil { return err }
+	defer resp.Release()
+	rmsg,err := resp.Get()
+	if err!=nil { return err }
+	kvr,ok := rmsg.(*kvtp.Response)
+	if !ok { return ErrProtocol }
+	if kvr.Code==kvtp.RESP_Error {
+		return &Error{kvr.Err,string(kvr.Val)}
+	}
+	if handle==nil { return nil }
+	return handle(kvr)
+}
+
+func (c *Client) Get(ctx context.Context, key []byte) (*Item,error) {
+	var item *Item
+	err := c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Get
+		r.Key = append(r.Key,key...)
+	},func(r *kvtp.Response) error {
+		switch r.Code {
+		case kvtp.RESP_Value:
+		case kvtp.RESP_NotFound: return ErrNotFound
+		default: return ErrProtocol
+		}
+		item = &Item{append([]byte(nil),r.Val...),r.Version,expiresAt(r.ExpiresAt)}
+		return nil
+	})
+	return item,err
+}
+
+func (c *Client) put(ctx context.Context, cmd uint8, key, val []byte, ttl time.Duration, version uint64) (newVersion uint64, err error) {
+	err = c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = cmd
+		r.Key = append(r.Key,key...)
+		r.Val = append(r.Val,val...)
+		r.ExpiresAt = expiresIn(ttl)
+		r.Version = version
+	},func(r *kvtp.Response) error {
+		switch r.Code {
+		case kvtp.RESP_None:
+			newVersion = r.Version
+			return nil
+		case kvtp.RESP_Conflict: return ErrConflict
+		}
+		return ErrProtocol
+	})
+	return
+}
+
+func (c *Client) Put(ctx context.Context, key, val []byte) error {
+	_,err := c.put(ctx,kvtp.CMD_Put,key,val,0,0)
+	return err
+}
+
+/*
+Puts a value, that expires after ttl.
+*/
+func (c *Client) PutTTL(ctx context.Context, key, val []byte, ttl time.Duration) error {
+	_,err := c.put(ctx,kvtp.CMD_Put,key,val,ttl,0)
+	return err
+}
+
+/*
+Puts a value, if the key does not exist. Returns ErrConflict otherwise.
+
+Returns the new version of the key, or 0, if it has been overwritten meanwhile.
+*/
+func (c *Client) PutIfAbsent(ctx context.Context, key, val []byte, ttl time.Duration) (uint64,error) {
+	return c.put(ctx,kvtp.CMD_PutIfAbsent,key,val,ttl,0)
+}
+
+/*
+Puts a value, if the current version of the key is version. Returns ErrConflict otherwise.
+
+Returns the new version of the key, like PutIfAbsent.
+*/
+func (c *Client) PutIfVersion(ctx context.Context, key, val []byte, ttl time.Duration, version uint64) (uint64,error) {
+	return c.put(ctx,kvtp.CMD_PutIfVersion,key,val,ttl,version)
+}
+
+func (c *Client) touch(ctx context.Context, key []byte, exp uint64) (found bool, expires uint64, err error) {
+	err = c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Touch
+		r.Key = append(r.Key,key...)
+		r.ExpiresAt = exp
+	},func(r *kvtp.Response) error {
+		found = string(r.Val)=="ok"
+		expires = r.ExpiresAt
+		return nil
+	})
+	return
+}
+
+/*
+Deletes the key. Returns false, if the key didn't exist.
+*/
+func (c *Client) Delete(ctx context.Context, key []byte) (found bool, err error) {
+	err = c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Delete
+		r.Key = append(r.Key,key...)
+	},func(r *kvtp.Response) error {
+		switch r.Code {
+		case kvtp.RESP_None: found = true
+		case kvtp.RESP_NotFound:
+		default: return ErrProtocol
+		}
+		return nil
+	})
+	return
+}
+
+/*
+Gets multiple keys at once. Returns one Item per key, nil if the key was not found.
+
+If some keys failed, the other keys are returned along with the error of the first failed key.
+*/
+func (c *Client) MultiGet(ctx context.Context, keys [][]byte) ([]*Item,error) {
+	items := make([]*Item,len(keys))
+	var ferr error
+	err := c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_MultiGet
+		for _,key := range keys {
+			e := r.AddEntry()
+			e.Key = append(e.Key,key...)
+		}
+	},func(r *kvtp.Response) error {
+		if len(r.Entries)!=len(keys) { return ErrProtocol }
+		for i := range r.Entries {
+			e := &r.Entries[i]
+			switch e.Code {
+			case kvtp.RESP_Value:
+				items[i] = &Item{append([]byte(nil),e.Val...),e.Version,expiresAt(e.ExpiresAt)}
+			case kvtp.RESP_Error:
+				if ferr==nil { ferr = &Error{e.Err,string(e.Val)} }
+			}
+		}
+		return nil
+	})
+	if err!=nil { return nil,err }
+	return items,ferr
+}
+
+/*
+Reports, whether the key exists.
+*/
+func (c *Client) Touch(ctx context.Context, key []byte) (bool,error) {
+	found,_,err := c.touch(ctx,key,0)
+	return found,err
+}
+
+/*
+Returns the remaining time to live of the key, or NoTTL, if it doesn't expire.
+*/
+func (c *Client) TTL(ctx context.Context, key []byte) (time.Duration,error) {
+	found,exp,err := c.touch(ctx,key,0)
+	if err!=nil { return 0,err }
+	if !found { return 0,ErrNotFound }
+	if exp==0 { return NoTTL,nil }
+	return time.Until(expiresAt(exp)),nil
+}
+
+/*
+Sets the time to live of the key. Returns false, if the key doesn't exist.
+*/
+func (c *Client) Expire(ctx context.Context, key []byte, ttl time.Duration) (bool,error) {
+	exp := expiresIn(ttl)
+	if exp==0 { exp = uint64(time.Now().Unix()) }
+	found,_,err := c.touch(ctx,key,exp)
+	return found,err
+}
+
+/*
+Returns the hops, a lookup of key took through the cluster.
+*/
+func (c *Client) Trace(ctx context.Context, key []byte) ([]kvtp.Hop,error) {
+	var hops []kvtp.Hop
+	err := c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Trace
+		r.Key = append(r.Key,key...)
+	},func(r *kvtp.Response) error {
+		hops = append(hops,r.Hops...)
+		return nil
+	})
+	return hops,err
+}
+
+/*
+A change of a watched key.
+*/
+type Event struct{
+	Kind      uint8 // kvtp.EVENT_*
+	Key       []byte
+	Value     []byte // Empty for deletions and expirations.
+	ExpiresAt time.Time
+}
+
+/*
+A stream of changes, see Client.Watch.
+*/
+type Watch struct{
+	c      *Client
+	resp   *rpcmux.Response
+	cancel context.CancelFunc
+}
+
+/*
+Watches key, or all keys with the prefix key, for changes. The watch ends, when
+ctx is done or Close is called.
+*/
+func (c *Client) Watch(ctx context.Context, key []byte, prefix bool) (*Watch,error) {
+	cli,err := c.client()
+	if err!=nil { return nil,err }
+	ctx,cancel := context.WithCancel(ctx)
+	msg := c.rpool.Get().(*kvtp.Request)
+	msg.Reset()
+	msg.Namespace = c.Namespace
+	msg.Cmd = kvtp.CMD_Watch
+	msg.Key = append(msg.Key,key...)
+	if prefix { msg.Flags = kvtp.FLAG_Prefix }
+	resp,err := cli.Request(msg,ctx)
+	if err!=nil {
+		cancel()
+		return nil,err
+	}
+	return &Watch{c,resp,cancel},nil
+}
+
+/*
+Returns the changes of the next committed batch. Returns io.EOF, once the
+server ended the watch.
+*/
+func (w *Watch) Next() ([]Event,error) {
+	m,err := w.resp.Next()
+	if err!=nil { return nil,err }
+	if m==nil {
+		m,err = w.resp.Get()
+		if err!=nil { return nil,err }
+		if kvr,ok := m.(*kvtp.Response); ok && kvr.Code==kvtp.RESP_Error {
+			return nil,&Error{kvr.Err,string(kvr.Val)}
+		}
+		return nil,io.EOF
+	}
+	kvr,ok := m.(*kvtp.Response)
+	if !ok { return nil,ErrProtocol }
+	evs := make([]Event,len(kvr.Entries))
+	for i := range kvr.Entries {
+		e := &kvr.Entries[i]
+		evs[i] = Event{e.Code,append([]byte(nil),e.Key...),append([]byte(nil),e.Val...),expiresAt(e.ExpiresAt)}
+	}
+	return evs,nil
+}
+
+/*
+Ends the watch.
+*/
+func (w *Watch) Close() {
+	w.cancel()
+	w.resp.Release()
+}
+
+/*
+A transaction, see Client.Begin.
+
+Reads are performed immediately, writes are buffered until Commit. Commit fails
+with ErrConflict, if a key, that has been read, changed in the meantime.
+*/
+type Txn struct{
+	c   *Client
+	ops []kvtp.Entry
+}
+
+/*
+Starts a transaction.
+*/
+func (c *Client) Begin() *Txn {
+	return &Txn{c:c}
+}
+
+/*
+Reads the key. The transaction only commits, if the key is unchanged until then.
+*/
+func (t *Txn) Get(ctx context.Context, key []byte) (*Item,error) {
+	item,err := t.c.Get(ctx,key)
+	var version uint64
+	switch err {
+	case nil: version = item.Version
+	case ErrNotFound:
+	default: return nil,err
+	}
+	t.ops = append(t.ops,kvtp.Entry{Code:kvtp.TXN_Check,Key:append([]byte(nil),key...),Version:version})
+	return item,err
+}
+
+/*
+Puts a value at commit. If ttl is not positive, the key does not expire.
+*/
+func (t *Txn) Put(key, val []byte, ttl time.Duration) {
+	t.ops = append(t.ops,kvtp.Entry{Code:kvtp.TXN_Put,Key:append([]byte(nil),key...),Val:append([]byte(nil),val...),ExpiresAt:expiresIn(ttl)})
+}
+
+/*
+Deletes the key at commit.
+*/
+func (t *Txn) Delete(key []byte) {
+	t.ops = append(t.ops,kvtp.Entry{Code:kvtp.TXN_Delete,Key:append([]byte(nil),key...)})
+}
+
+/*
+Commits the transaction. Returns ErrConflict, if a key, that has been read, changed.
+*/
+func (t *Txn) Commit(ctx context.Context) error {
+	return t.c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Txn
+		for i := range t.ops {
+			o,e := &t.ops[i],r.AddEntry()
+			e.Code = o.Code
+			e.Key = append(e.Key,o.Key...)
+			e.Val = append(e.Val,o.Val...)
+			e.ExpiresAt = o.ExpiresAt
+			e.Version = o.Version
+		}
+	},func(r *kvtp.Response) error {
+		switch r.Code {
+		case kvtp.RESP_None: return nil
+		case kvtp.RESP_Conflict: return ErrConflict
+		}
+		return ErrProtocol
+	})
+}
+
+/*
+A lease on a lock, see Client.Lock.
+*/
+type Lease struct{
+	c         *Client
+	Key       []byte
+	Owner     []byte
+	Token     uint64 // Fencing token: Increases with every grant of the lock.
+	ExpiresAt time.Time
+}
+
+func (l *Lease) do(ctx context.Context, cmd uint8, ttl time.Duration) error {
+	return l.c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = cmd
+		r.Key = append(r.Key,l.Key...)
+		r.Val = append(r.Val,l.Owner...)
+		r.Version = l.Token
+		r.ExpiresAt = expiresIn(ttl)
+	},func(r *kvtp.Response) error {
+		switch r.Code {
+		case kvtp.RESP_Value:
+			l.Token = r.Version
+			l.ExpiresAt = expiresAt(r.ExpiresAt)
+		case kvtp.RESP_None:
+		case kvtp.RESP_Conflict: return ErrConflict
+		case kvtp.RESP_NotFound: return ErrNotFound
+		default: return ErrProtocol
+		}
+		return nil
+	})
+}
+
+/*
+Acquires the lock key for owner. The lease ends after ttl, unless it is renewed.
+If ttl is not positive, the lease does not end. If owner already holds the lock,
+the lease is extended. Returns ErrConflict, if the lock is held by another owner.
+*/
+func (c *Client) Lock(ctx context.Context, key, owner []byte, ttl time.Duration) (*Lease,error) {
+	l := &Lease{c:c,Key:append([]byte(nil),key...),Owner:append([]byte(nil),owner...)}
+	if err := l.do(ctx,kvtp.CMD_Lock,ttl); err!=nil { return nil,err }
+	return l,nil
+}
+
+/*
+Extends the lease by ttl. Returns ErrConflict or ErrNotFound, if the lease has been lost.
+*/
+func (l *Lease) Renew(ctx context.Context, ttl time.Duration) error {
+	return l.do(ctx,kvtp.CMD_Renew,ttl)
+}
+
+/*
+Releases the lock. Returns ErrConflict or ErrNotFound, if the lease has been lost.
+*/
+func (l *Lease) Unlock(ctx context.Context) error {
+	return l.do(ctx,kvtp.CMD_Unlock,0)
+}
+
+/*
+A statistic of a node, see Client.Stat.
+*/
+type Stat struct{
+	Name  string
+	Value string
+}
+
+/*
+Returns the statistics of the node, that owns key.
+*/
+func (c *Client) Stat(ctx context.Context, key []byte) ([]Stat,error) {
+	var stats []Stat
+	err := c.Do(ctx,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Stat
+		r.Key = append(r.Key,key...)
+	},func(r *kvtp.Response) error {
+		if r.Code!=kvtp.RESP_Entries { return ErrProtocol }
+		for i := range r.Entries {
+			e := &r.Entries[i]
+			stats = append(stats,Stat{string(e.Key),string(e.Val)})
+		}
+		return nil
+	})
+	return stats,err
+}
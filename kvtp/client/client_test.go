@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package client_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Opens a storage node in a temporary directory and connects a client to it
+through an rpcmux.Pipe.
+*/
+func openNode(t *testing.T) *client.Client {
+	dir,err := ioutil.TempDir("","client")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	
+	die := make(chan struct{})
+	db := &lsm2.DB{Name:"test",DB:bdb}
+	db.Die = die
+	db.Source = ss.Serve()
+	db.Resps = resps
+	db.Init(1)
+	t.Cleanup(func() {
+		close(die)
+		db.Wait()
+		shutdown()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return client.Over(cs.Client(),reqs)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	if err := cli.Put(ctx,[]byte("a"),[]byte("1")); err!=nil { t.Fatal(err) }
+	item,err := cli.Get(ctx,[]byte("a"))
+	if err!=nil { t.Fatal(err) }
+	if string(item.Value)!="1" || item.Version==0 || !item.ExpiresAt.IsZero() { t.Errorf("a: %+v",item) }
+	if _,err := cli.Get(ctx,[]byte("b")); err!=client.ErrNotFound { t.Errorf("Get of a missing key: %v",err) }
+	
+	if found,err := cli.Delete(ctx,[]byte("a")); !found || err!=nil { t.Errorf("Delete: %v %v",found,err) }
+	if found,err := cli.Delete(ctx,[]byte("a")); found || err!=nil { t.Errorf("second Delete: %v %v",found,err) }
+	if _,err := cli.Get(ctx,[]byte("a")); err!=client.ErrNotFound { t.Errorf("Get after Delete: %v",err) }
+}
+
+func TestExpiration(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	if err := cli.PutTTL(ctx,[]byte("a"),[]byte("1"),time.Hour); err!=nil { t.Fatal(err) }
+	if ttl,err := cli.TTL(ctx,[]byte("a")); err!=nil || ttl<time.Hour-time.Minute || ttl>time.Hour { t.Errorf("TTL: %v %v",ttl,err) }
+	if ok,err := cli.Expire(ctx,[]byte("a"),2*time.Hour); !ok || err!=nil { t.Errorf("Expire: %v %v",ok,err) }
+	if ttl,err := cli.TTL(ctx,[]byte("a")); err!=nil || ttl<time.Hour { t.Errorf("TTL after Expire: %v %v",ttl,err) }
+	if ok,err := cli.Touch(ctx,[]byte("a")); !ok || err!=nil { t.Errorf("Touch: %v %v",ok,err) }
+	if ok,err := cli.Touch(ctx,[]byte("b")); ok || err!=nil { t.Errorf("Touch of a missing key: %v %v",ok,err) }
+}
+
+func TestConditionalPuts(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	v1,err := cli.PutIfAbsent(ctx,[]byte("a"),[]byte("1"),0)
+	if err!=nil { t.Fatal(err) }
+	if _,err := cli.PutIfAbsent(ctx,[]byte("a"),[]byte("2"),0); err!=client.ErrConflict { t.Errorf("second PutIfAbsent: %v",err) }
+	v2,err := cli.PutIfVersion(ctx,[]byte("a"),[]byte("2"),0,v1)
+	if err!=nil { t.Fatal(err) }
+	if _,err := cli.PutIfVersion(ctx,[]byte("a"),[]byte("3"),0,v1); err!=client.ErrConflict { t.Errorf("stale PutIfVersion: %v",err) }
+	item,err := cli.Get(ctx,[]byte("a"))
+	if err!=nil { t.Fatal(err) }
+	if string(item.Value)!="2" || item.Version!=v2 { t.Errorf("a: %q, version %d, want 2, %d",item.Value,item.Version,v2) }
+}
+
+func TestMultiGet(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	if err := cli.Put(ctx,[]byte("a"),[]byte("1")); err!=nil { t.Fatal(err) }
+	if err := cli.Put(ctx,[]byte("c"),[]byte("3")); err!=nil { t.Fatal(err) }
+	items,err := cli.MultiGet(ctx,[][]byte{[]byte("a"),[]byte("b"),[]byte("c")})
+	if err!=nil { t.Fatal(err) }
+	if len(items)!=3 || items[0]==nil || string(items[0].Value)!="1" || items[1]!=nil || items[2]==nil || string(items[2].Value)!="3" {
+		t.Errorf("items: %+v",items)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	w,err := cli.Watch(ctx,[]byte("w"),true)
+	if err!=nil { t.Fatal(err) }
+	defer w.Close()
+	if err := cli.Put(ctx,[]byte("x"),[]byte("0")); err!=nil { t.Fatal(err) }
+	if err := cli.Put(ctx,[]byte("w1"),[]byte("1")); err!=nil { t.Fatal(err) }
+	evs,err := w.Next()
+	if err!=nil { t.Fatal(err) }
+	if len(evs)!=1 || evs[0].Kind!=kvtp.EVENT_Put || string(evs[0].Key)!="w1" || string(evs[0].Value)!="1" { t.Errorf("events: %+v",evs) }
+}
+
+func TestTxn(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	if err := cli.Put(ctx,[]byte("a"),[]byte("1")); err!=nil { t.Fatal(err) }
+	tx := cli.Begin()
+	if _,err := tx.Get(ctx,[]byte("a")); err!=nil { t.Fatal(err) }
+	tx.Put([]byte("b"),[]byte("2"),0)
+	tx.Delete([]byte("a"))
+	if err := tx.Commit(ctx); err!=nil { t.Fatal(err) }
+	if _,err := cli.Get(ctx,[]byte("a")); err!=client.ErrNotFound { t.Errorf("a: %v",err) }
+	
+	tx = cli.Begin()
+	if _,err := tx.Get(ctx,[]byte("b")); err!=nil { t.Fatal(err) }
+	tx.Put([]byte("b"),[]byte("3"),0)
+	if err := cli.Put(ctx,[]byte("b"),[]byte("4")); err!=nil { t.Fatal(err) }
+	if err := tx.Commit(ctx); err!=client.ErrConflict { t.Errorf("conflicting Commit: %v",err) }
+}
+
+func TestLock(t *testing.T) {
+	cli := openNode(t)
+	ctx := context.Background()
+	l,err := cli.Lock(ctx,[]byte("l"),[]byte("me"),time.Minute)
+	if err!=nil { t.Fatal(err) }
+	if l.Token==0 || l.ExpiresAt.IsZero() { t.Errorf("lease: %+v",l) }
+	if _,err := cli.Lock(ctx,[]byte("l"),[]byte("other"),time.Minute); err!=client.ErrConflict { t.Errorf("Lock by another owner: %v",err) }
+	if err := l.Renew(ctx,time.Hour); err!=nil { t.Errorf("Renew: %v",err) }
+	if err := l.Unlock(ctx); err!=nil { t.Errorf("Unlock: %v",err) }
+	if _,err := cli.Lock(ctx,[]byte("l"),[]byte("other"),time.Minute); err!=nil { t.Errorf("Lock after Unlock: %v",err) }
+}
+
+func TestServerError(t *testing.T) {
+	cli := openNode(t)
+	err := cli.Put(context.Background(),[]byte{0xFF,'x'},nil)
+	if client.Code(err)!=kvtp.ERR_InvalidKey { t.Errorf("Put of a reserved key: %v",err) }
+}
@@ -28,6 +28,8 @@ Just be warned. Unstable! API and protocol will change without notice.
 package kvtp
 
 import "sync"
+import "time"
+import "fmt"
 import "github.com/byte-mug/zrab2k/rpcmux"
 import "github.com/vmihailenco/msgpack"
 
@@ -42,15 +44,281 @@ const (
 	CMD_PutNoRedirect
 	
 	/*
-	Returns a Log of hops.
+	Returns a Log of hops in Response.Hops. Every node, router and forwarder, that
+	handles the request, appends a Hop to Request.Hops.
 	*/
 	CMD_Trace
 	
 	/*
 	Returns "ok" if the key is available, "not_found" otherwise.
+	
+	If ExpiresAt is not 0, the expiration time of the key is updated.
 	*/
 	CMD_Touch
 	
+	/*
+	Returns all entries from Key (inclusive) to End (exclusive) in Response.Entries.
+	
+	If FLAG_Prefix is set, Key is a prefix and End is ignored. Limit caps the number
+	of entries (0 -> no limit).
+	
+	Entries, that spilled to another node and could not be fetched from there,
+	are returned with RESP_Error and ERR_RedirectFailed, so the result is never
+	silently incomplete.
+	*/
+	CMD_Scan
+	
+	/*
+	Put, if the current version of the key equals Version (0 -> the key does not exist).
+	
+	Returns RESP_None and the new version, or RESP_Conflict and the current version
+	otherwise. The new version is 0, if the key has been overwritten meanwhile.
+	*/
+	CMD_PutIfVersion
+	
+	/*
+	Put, if the key does not exist.
+	
+	Returns RESP_None and the new version, or RESP_Conflict and the current version
+	otherwise. The new version is 0, if the key has been overwritten meanwhile.
+	*/
+	CMD_PutIfAbsent
+	
+	/*
+	Gets all keys in Request.Entries. Returns one Entry per key, in the same order,
+	with its own result code (RESP_Value, RESP_NotFound or RESP_Error and error code).
+	*/
+	CMD_MultiGet
+	
+	/*
+	Puts all entries in Request.Entries. Returns one Entry per key, in the same order,
+	with its own result code (RESP_None or RESP_Error and error code).
+	*/
+	CMD_MultiPut
+	
+	/*
+	Adds Delta to the decimal integer stored at Key and returns the new value in Val.
+	
+	If the key does not exist, it is created with the value Initial.
+	*/
+	CMD_Incr
+	
+	/*
+	Appends Val to the value stored at Key. If the key does not exist, it is created.
+	*/
+	CMD_Append
+	
+	/*
+	Deletes the key. Returns RESP_None, if the key existed, RESP_NotFound otherwise.
+	*/
+	CMD_Delete
+	
+	/*
+	Watches Key (or all keys with the prefix Key, if FLAG_Prefix is set) for changes.
+	
+	The changes are streamed as RESP_Event replies, until the request is canceled.
+	Each RESP_Event carries the changes of one committed batch in Entries, where
+	Entry.Code is the kind of event (EVENT_*). The batches are streamed in the order,
+	they were written. Keys, that have been redirected to another node, and locks
+	(CMD_Lock) cause no events. Requires a Stream with IsPartial set to RespIsPartial.
+	*/
+	CMD_Watch
+	
+	/*
+	Executes the operations in Request.Entries atomically. Entry.Code is the
+	operation (TXN_*). Either all operations succeed, or none.
+	
+	Returns RESP_None on success. Otherwise, the transaction is aborted and one Entry
+	per operation is returned: RESP_Conflict (with the current version), if a check
+	failed, RESP_Error and an error code, if the operation can't be performed, or
+	RESP_None. The response code is RESP_Conflict, if a check failed, RESP_Error
+	with the error of the first failed operation otherwise.
+	*/
+	CMD_Txn
+	
+	/*
+	First phase of a two-phase commit. Val is the transaction id.
+	
+	Checks the operations like CMD_Txn and locks their keys, until the transaction is
+	committed or aborted (or times out). Locked keys can't be written by others.
+	*/
+	CMD_TxnPrepare
+	
+	/*
+	Second phase of a two-phase commit: Applies a prepared transaction. Val is the
+	transaction id. Returns RESP_NotFound, if the transaction is unknown.
+	*/
+	CMD_TxnCommit
+	
+	/*
+	Second phase of a two-phase commit: Discards a prepared transaction. Val is the
+	transaction id.
+	*/
+	CMD_TxnAbort
+	
+	/*
+	Acquires the lock Key for the owner Val, until ExpiresAt (0 -> no expiration).
+	If the owner already holds the lock, the lease is extended.
+	
+	Returns RESP_Value with the fencing token in Version and the end of the lease
+	in ExpiresAt. The fencing token increases with every grant. It is taken from
+	the clock of the node (time.UnixNano), so it also increases, if the lock moves
+	to another node, as long as their clocks differ by less than the time between
+	the grants. Returns RESP_Conflict with the owner in Val and the end of its
+	lease in ExpiresAt, if the lock is held by another owner. A lock is not
+	redirected, if the disk of the node is full, ERR_DiskFull is returned instead.
+	*/
+	CMD_Lock
+	
+	/*
+	Extends the lease of the lock Key until ExpiresAt. Val is the owner and Version
+	the fencing token of the lease.
+	
+	Returns RESP_Value like CMD_Lock, RESP_NotFound, if the lock is not held, or
+	RESP_Conflict, if the lease has been lost to another owner.
+	*/
+	CMD_Renew
+	
+	/*
+	Releases the lock Key. Val is the owner and Version the fencing token of the lease.
+	
+	Returns RESP_None, RESP_NotFound, if the lock is not held, or RESP_Conflict, if
+	the lease has been lost to another owner.
+	*/
+	CMD_Unlock
+	
+	/*
+	Returns statistics of the node, that owns Key, as RESP_Entries. Key of an Entry
+	is the name of a statistic, Val its value as text.
+	*/
+	CMD_Stat
+	
+	/*
+	Sent by a coordinator to a stale replica: Writes Val with ExpiresAt (or
+	deletes the key, if FLAG_Tombstone is set), unless the stored value is
+	newer than Timestamp. Never redirected.
+	*/
+	CMD_ReadRepair
+	
+	/*
+	Sent by a coordinator, that stored a write as hint, while this node was
+	unavailable (hinted handoff). Performed like CMD_ReadRepair.
+	*/
+	CMD_HintedHandoff
+	
+	/*
+	Returns nodes of a Merkle tree over the keys of Namespace, that have a
+	timestamp, for anti-entropy between replicas.
+	
+	Keys are placed in the tree by their SipHash, whose keys are in Val (two
+	8-byte big-endian numbers). Only keys, whose hash lies in one of the ranges
+	(Entry.Key, Entry.Val] in Entries are included (8-byte big-endian numbers,
+	wrapping around, if start>=end). No Entries -> all keys.
+	
+	Every inner node has 1<<MERKLE_Bits children. A node at level l (0 is the
+	root, MERKLE_Depth the leaves) covers the hashes, whose top l*MERKLE_Bits
+	bits are its index. Limit is the level, End lists the indices of the
+	requested nodes (4-byte big-endian numbers). Returns RESP_Entries with one
+	Entry per node: Version is the index, Val the 8-byte hash.
+	
+	With FLAG_KeysOnly, the keys in the requested leaves are returned instead:
+	Entry.Key is the key and Entry.Version its timestamp. Entry.Code is
+	RESP_Value, or RESP_NotFound, if the key has been deleted.
+	*/
+	CMD_Merkle
+	
+	/*
+	Probes a node for cluster membership (SWIM). Key is the name of the sender.
+	Entries carry membership updates: Entry.Key is the name of a member, Code its
+	state (MEMBER_*), Version its incarnation and Val its role. The first Entry
+	is the sender itself. Never redirected.
+	
+	Returns RESP_Entries with the updates of the receiver, the first Entry is the
+	receiver itself.
+	
+	Also sent as heartbeat (see multibe.Forwarder.Monitor), with an empty Key and
+	no Entries. Any response counts as heartbeat then.
+	*/
+	CMD_Ping
+	
+	/*
+	Probes the node Val on behalf of the sender (indirect probe), with CMD_Ping.
+	Key and Entries like CMD_Ping.
+	
+	Returns RESP_Entries like CMD_Ping, if the node answered, or ERR_Unavailable.
+	*/
+	CMD_PingReq
+	
+)
+
+/*
+Consistency levels, see Request.Consistency.
+*/
+const (
+	CL_NONE = iota /* The default of the coordinator. */
+	CL_ONE /* One replica must answer. */
+	CL_QUORUM /* A majority of the replicas must answer. */
+	CL_ALL /* All replicas must answer. */
+)
+
+/*
+Member states, see CMD_Ping.
+*/
+const (
+	MEMBER_Alive = iota+1
+	MEMBER_Suspect /* The member did not answer a probe. */
+	MEMBER_Dead
+)
+
+/*
+Shape of the Merkle tree, see CMD_Merkle.
+*/
+const (
+	MERKLE_Bits  = 4
+	MERKLE_Depth = 3
+)
+
+/*
+Transaction operations, see CMD_Txn.
+*/
+const (
+	TXN_Check = iota+1 /* The version of Key must be Version (0 -> the key does not exist). */
+	TXN_Put /* Puts Val with ExpiresAt. */
+	TXN_Delete /* Deletes Key. */
+)
+
+/*
+Request flags.
+*/
+const (
+	/*
+	CMD_Scan: Return only the keys, not the values.
+	CMD_Merkle: Return the keys of the leaves.
+	*/
+	FLAG_KeysOnly = 1<<iota
+	
+	/*
+	CMD_Scan: Treat Key as prefix.
+	*/
+	FLAG_Prefix
+	
+	/*
+	Do not redirect the request to another node. Set on requests, that have been
+	redirected already.
+	*/
+	FLAG_NoRedirect
+	
+	/*
+	CMD_ReadRepair, CMD_HintedHandoff: The key has been deleted.
+	*/
+	FLAG_Tombstone
+	
+	/*
+	CMD_PutIfVersion, CMD_PutIfAbsent: Versions are timestamps (Response.Timestamp)
+	instead. Set by routers, that replicate: The timestamp of a value is the same
+	on all replicas, its version is local to a node.
+	*/
+	FLAG_Timestamp
 )
 
 /*
@@ -61,37 +329,328 @@ const (
 	RESP_Error
 	RESP_Value
 	RESP_NotFound
+	RESP_Entries
+	RESP_Conflict
+	RESP_Event /* A partial reply, more replies follow. */
+)
+
+/*
+Event kinds, see CMD_Watch.
+*/
+const (
+	EVENT_Put = iota+1 /* The key has been written. */
+	EVENT_Delete
+	EVENT_Expire
 )
 
+/*
+Error codes. Set in Response.Err and Entry.Err, if the code is RESP_Error.
+The Val field may contain a human readable message.
+*/
+const (
+	ERR_None = iota
+	ERR_Internal
+	ERR_Unsupported
+	ERR_DiskFull
+	ERR_TxnTooBig
+	ERR_Conflict
+	ERR_Timeout
+	ERR_RedirectFailed
+	ERR_NotOwner
+	ERR_NotInteger
+	ERR_Overflow
+	ERR_InvalidKey
+	ERR_QuotaExceeded
+	ERR_Lagging /* The receiver of a stream could not keep up. */
+	ERR_InDoubt /* The transaction may have been committed partially. */
+	ERR_Unavailable /* Too few replicas answered to meet the consistency level. Writes may have been applied partially. */
+)
+
+var errNames = [...]string{
+	ERR_None: "None",
+	ERR_Internal: "Internal",
+	ERR_Unsupported: "Unsupported",
+	ERR_DiskFull: "DiskFull",
+	ERR_TxnTooBig: "TxnTooBig",
+	ERR_Conflict: "Conflict",
+	ERR_Timeout: "Timeout",
+	ERR_RedirectFailed: "RedirectFailed",
+	ERR_NotOwner: "NotOwner",
+	ERR_NotInteger: "NotInteger",
+	ERR_Overflow: "Overflow",
+	ERR_InvalidKey: "InvalidKey",
+	ERR_QuotaExceeded: "QuotaExceeded",
+	ERR_Lagging: "Lagging",
+	ERR_InDoubt: "InDoubt",
+	ERR_Unavailable: "Unavailable",
+}
+
+/*
+Returns the name of an error code.
+*/
+func ErrName(code uint8) string {
+	if int(code)<len(errNames) { return errNames[code] }
+	return fmt.Sprint("Error#",code)
+}
+
+type Entry struct{
+	Code uint8 /* Result code in responses, TXN_* in CMD_Txn requests, EVENT_* in RESP_Event. */
+	Err uint8 /* Error code, if Code is RESP_Error. */
+	Key []byte
+	Val []byte
+	ExpiresAt uint64 /* time.Unix(), 0 -> no expiration. */
+	Version uint64
+}
+func (e *Entry) DecodeMsgpack(m *msgpack.Decoder) error {
+	return m.DecodeMulti(&e.Code,&e.Err,&e.Key,&e.Val,&e.ExpiresAt,&e.Version)
+}
+func (e *Entry) EncodeMsgpack(m *msgpack.Encoder) error {
+	return m.EncodeMulti(&e.Code,&e.Err,&e.Key,&e.Val,&e.ExpiresAt,&e.Version)
+}
+
+/*
+Sets Code to RESP_Error, Err to code and Val to msg.
+*/
+func (e *Entry) SetError(code uint8, msg string) {
+	e.Code = RESP_Error
+	e.Err = code
+	e.Val = append(e.Val[:0],msg...)
+}
+
+/*
+A station, a CMD_Trace request passed through.
+*/
+type Hop struct{
+	Node string
+	Role string /* "node", "router", "forwarder", ... */
+	Decision string
+	Elapsed time.Duration /* Time spent on this hop, before the decision was made. */
+}
+func (h *Hop) DecodeMsgpack(m *msgpack.Decoder) error {
+	return m.DecodeMulti(&h.Node,&h.Role,&h.Decision,&h.Elapsed)
+}
+func (h *Hop) EncodeMsgpack(m *msgpack.Encoder) error {
+	return m.EncodeMulti(&h.Node,&h.Role,&h.Decision,&h.Elapsed)
+}
+func (h *Hop) String() string {
+	return fmt.Sprintf("%s %s %s %v",h.Node,h.Role,h.Decision,h.Elapsed)
+}
+
 type Request struct{
 	seq uint64
 	Cmd uint8
 	ExpiresAt uint64 /* time.Unix(), 0 -> no expiration. */
 	Key []byte
 	Val []byte
+	End []byte
+	Limit uint32
+	Flags uint8
+	Version uint64
+	Entries []Entry
+	Delta int64
+	Initial int64
+	Hops []Hop
+	
+	/*
+	The namespace of Key (and Entries). Namespaces are isolated from each other.
+	"" is the default namespace. Keys starting with 0xFF are reserved in the
+	default namespace.
+	*/
+	Namespace string
+	
+	/*
+	The number of replicas, that must answer, if the key is replicated (CL_*).
+	*/
+	Consistency uint8
+	
+	/*
+	Time of a write in time.UnixNano(), set by the coordinator of a replicated
+	write. Of two writes to a key, the one with the newer timestamp wins,
+	regardless of the order they arrive in. 0 -> no timestamp.
+	*/
+	Timestamp uint64
 }
 func (r *Request) Seq() uint64 { return r.seq }
 func (r *Request) SetSeq(u uint64) { r.seq = u }
 func (r *Request) DecodeMsgpack(m *msgpack.Decoder) error {
-	return m.DecodeMulti(&r.seq,&r.Cmd,&r.ExpiresAt,&r.Key,&r.Val)
+	return m.DecodeMulti(&r.seq,&r.Cmd,&r.ExpiresAt,&r.Key,&r.Val,&r.End,&r.Limit,&r.Flags,&r.Version,&r.Entries,&r.Delta,&r.Initial,&r.Hops,&r.Namespace,&r.Consistency,&r.Timestamp)
 }
 func (r *Request) EncodeMsgpack(m *msgpack.Encoder) error {
-	return m.EncodeMulti(&r.seq,&r.Cmd,&r.ExpiresAt,&r.Key,&r.Val)
+	return m.EncodeMulti(&r.seq,&r.Cmd,&r.ExpiresAt,&r.Key,&r.Val,&r.End,&r.Limit,&r.Flags,&r.Version,&r.Entries,&r.Delta,&r.Initial,&r.Hops,&r.Namespace,&r.Consistency,&r.Timestamp)
+}
+
+/*
+Resets the Request, so it can be reused.
+*/
+func (r *Request) Reset() {
+	r.Cmd = 0
+	r.ExpiresAt = 0
+	r.Key = r.Key[:0]
+	r.Val = r.Val[:0]
+	r.End = r.End[:0]
+	r.Limit = 0
+	r.Flags = 0
+	r.Version = 0
+	r.Entries = r.Entries[:0]
+	r.Delta = 0
+	r.Initial = 0
+	r.Hops = r.Hops[:0]
+	r.Namespace = ""
+	r.Consistency = 0
+	r.Timestamp = 0
+}
+
+/*
+Copies o into r. The buffers of r are reused.
+*/
+func (r *Request) CopyFrom(o *Request) {
+	r.Cmd = o.Cmd
+	r.ExpiresAt = o.ExpiresAt
+	r.Key = append(r.Key[:0],o.Key...)
+	r.Val = append(r.Val[:0],o.Val...)
+	r.End = append(r.End[:0],o.End...)
+	r.Limit = o.Limit
+	r.Flags = o.Flags
+	r.Version = o.Version
+	copyEntries(&r.Entries,o.Entries)
+	r.Delta = o.Delta
+	r.Initial = o.Initial
+	r.Hops = append(r.Hops[:0],o.Hops...)
+	r.Namespace = o.Namespace
+	r.Consistency = o.Consistency
+	r.Timestamp = o.Timestamp
+}
+
+/*
+Records a Hop, if r is a CMD_Trace request. Start is the time, the hop received the request.
+*/
+func (r *Request) AddHop(node, role, decision string, start time.Time) {
+	if r.Cmd!=CMD_Trace { return }
+	r.Hops = append(r.Hops,Hop{node,role,decision,time.Since(start)})
+}
+
+/*
+Appends an Entry to r.Entries and returns it. The buffers of previously used Entries are recycled.
+*/
+func (r *Request) AddEntry() *Entry {
+	return addEntry(&r.Entries)
 }
 
 type Response struct{
 	seq uint64
 	Code uint8
+	Err uint8 /* Error code, if Code is RESP_Error. */
 	ExpiresAt uint64 /* time.Unix(), 0 -> no expiration. */
 	Val []byte
+	Version uint64 /* Version of the key. */
+	Entries []Entry
+	Hops []Hop
+	Timestamp uint64 /* Request.Timestamp of the value or deletion, 0 -> unknown. */
 }
 func (r *Response) Seq() uint64 { return r.seq }
 func (r *Response) SetSeq(u uint64) { r.seq = u }
 func (r *Response) DecodeMsgpack(m *msgpack.Decoder) error {
-	return m.DecodeMulti(&r.seq,&r.Code,&r.ExpiresAt,&r.Val)
+	return m.DecodeMulti(&r.seq,&r.Code,&r.Err,&r.ExpiresAt,&r.Val,&r.Version,&r.Entries,&r.Hops,&r.Timestamp)
 }
 func (r *Response) EncodeMsgpack(m *msgpack.Encoder) error {
-	return m.EncodeMulti(&r.seq,&r.Code,&r.ExpiresAt,&r.Val)
+	return m.EncodeMulti(&r.seq,&r.Code,&r.Err,&r.ExpiresAt,&r.Val,&r.Version,&r.Entries,&r.Hops,&r.Timestamp)
+}
+
+/*
+Resets the Response, so it can be reused.
+*/
+func (r *Response) Reset() {
+	r.Code = 0
+	r.Err = 0
+	r.ExpiresAt = 0
+	r.Val = r.Val[:0]
+	r.Version = 0
+	r.Entries = r.Entries[:0]
+	r.Hops = r.Hops[:0]
+	r.Timestamp = 0
+}
+
+/*
+Copies o into r. The buffers of r are reused.
+*/
+func (r *Response) CopyFrom(o *Response) {
+	r.Code = o.Code
+	r.Err = o.Err
+	r.ExpiresAt = o.ExpiresAt
+	r.Val = append(r.Val[:0],o.Val...)
+	r.Version = o.Version
+	copyEntries(&r.Entries,o.Entries)
+	r.Hops = append(r.Hops[:0],o.Hops...)
+	r.Timestamp = o.Timestamp
+}
+
+func copyEntries(p *[]Entry, src []Entry) {
+	*p = (*p)[:0]
+	for i := range src {
+		e,s := addEntry(p),&src[i]
+		e.Code = s.Code
+		e.Err = s.Err
+		e.Key = append(e.Key,s.Key...)
+		e.Val = append(e.Val,s.Val...)
+		e.ExpiresAt = s.ExpiresAt
+		e.Version = s.Version
+	}
+}
+
+/*
+Sets Code to RESP_Error, Err to code and Val to msg.
+*/
+func (r *Response) SetError(code uint8, msg string) {
+	r.Code = RESP_Error
+	r.Err = code
+	r.Val = append(r.Val[:0],msg...)
+}
+
+/*
+Sets Code of an aborted transaction's response, according to its Entries (see CMD_Txn):
+RESP_Conflict, if a check failed, the error of the first failed operation otherwise.
+*/
+func (r *Response) SetTxnFailed() {
+	var first *Entry
+	for i := range r.Entries {
+		e := &r.Entries[i]
+		switch e.Code {
+		case RESP_Conflict:
+			r.Code = RESP_Conflict
+			return
+		case RESP_Error:
+			if first==nil { first = e }
+		}
+	}
+	if first!=nil {
+		r.SetError(first.Err,string(first.Val))
+	} else {
+		r.SetError(ERR_Internal,"Transaction failed")
+	}
+}
+
+/*
+Appends an Entry to r.Entries and returns it. The buffers of previously used Entries are recycled.
+*/
+func (r *Response) AddEntry() *Entry {
+	return addEntry(&r.Entries)
+}
+
+func addEntry(p *[]Entry) *Entry {
+	n := len(*p)
+	if n<cap(*p) {
+		*p = (*p)[:n+1]
+	} else {
+		*p = append(*p,Entry{})
+	}
+	e := &(*p)[n]
+	e.Code = 0
+	e.Err = 0
+	e.Key = e.Key[:0]
+	e.Val = e.Val[:0]
+	e.ExpiresAt = 0
+	e.Version = 0
+	return e
 }
 
 var _ rpcmux.Message = (*Request)(nil)
@@ -105,22 +664,25 @@ func ReqIsCancel(m rpcmux.Message) bool {
 	return r.Cmd==0
 }
 
+/*
+Detects partial replies (RESP_Event). Suitable for rpcmux.Stream.IsPartial.
+*/
+func RespIsPartial(m rpcmux.Message) bool {
+	r,ok := m.(*Response)
+	return ok && r.Code==RESP_Event
+}
+
 func ReqCancel(p *sync.Pool) func() rpcmux.Message {
 	return func() rpcmux.Message {
 		r := p.Get().(*Request)
-		r.Cmd = 0
-		r.ExpiresAt = 0
-		r.Key = r.Key[:0]
-		r.Val = r.Val[:0]
+		r.Reset()
 		return r
 	}
 }
 func RespDefault(p *sync.Pool) func() rpcmux.Message {
 	return func() rpcmux.Message {
 		r := p.Get().(*Response)
-		r.Code = 0
-		r.ExpiresAt = 0
-		r.Val = r.Val[:0]
+		r.Reset()
 		return r
 	}
 }
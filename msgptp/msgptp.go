@@ -62,6 +62,7 @@ func (c *conn) init(conn io.ReadWriteCloser) {
 	c.out  = msgpack.NewEncoder(c.buf)
 	c.in   = msgpack.NewDecoder(bufio.NewReader(conn))
 	c.InRelease = c.releaseIn
+	c.Close = c.close
 }
 
 func NewStream(cc io.ReadWriteCloser, pin, pout *sync.Pool) (*rpcmux.Stream) {
@@ -82,6 +83,10 @@ func (c *conn) die() {
 	defer func(){ recover() }()
 	close(c.cdie)
 }
+func (c *conn) close() {
+	c.conn.Close()
+	c.die()
+}
 func (c *conn) recvLoop() {
 	defer c.die()
 	for {
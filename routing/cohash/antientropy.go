@@ -0,0 +1,398 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+)
+
+/* Pause between two rounds of anti-entropy, if AntiEntropy.Interval is 0. */
+const DefaultAntiEntropyInterval = 10*time.Minute
+
+var errMerkle = errors.New("Invalid Merkle response")
+
+/*
+The progress of a round of anti-entropy. The counts are totals of the round.
+*/
+type Progress struct{
+	Round    int
+	Pair     int // Pairs of nodes, that have been compared.
+	Pairs    int
+	A,B      string // The last pair of nodes.
+	Leaves   int // Leaves of the Merkle trees, that differed.
+	Keys     int // Keys, that differed.
+	Repaired int
+	Bytes    int64 // Bytes of trees, keys and values received and sent.
+	Err      error // Error of the last pair.
+}
+
+/*
+Anti-entropy between replicas: Repairs keys, that differ between the replicas,
+even if they are never read.
+
+Every pair of nodes, that replicate common ranges of the ring, compares the
+Merkle trees (see kvtp.CMD_Merkle) of these ranges. Only the subtrees, that
+differ, are descended into, and only the keys of the leaves, that differ, are
+transferred. Keys are repaired like in read repair: The newer version is written
+to the other node with CMD_ReadRepair. Keys without timestamp are not repaired.
+
+If the placement of the Router is not a Ring, every pair of Router.Nodes
+compares all keys, and only the keys, that both nodes replicate, are repaired.
+*/
+type AntiEntropy struct{
+	Router     *Router
+	Namespaces []string // nil -> the default namespace.
+	Interval   time.Duration // Pause between two rounds. 0 -> DefaultAntiEntropyInterval.
+	Bandwidth  int64 // Bytes per second. 0 -> unlimited.
+	Progress   func(p Progress) // Optional: Called, after a pair of nodes has been compared.
+	
+	mu   sync.Mutex
+	last Progress
+	lim  limiter
+}
+
+/*
+Returns the progress of the current (or last) round.
+*/
+func (ae *AntiEntropy) Status() Progress {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	return ae.last
+}
+
+func (ae *AntiEntropy) report(p *Progress) {
+	ae.mu.Lock()
+	ae.last = *p
+	ae.mu.Unlock()
+	if ae.Progress!=nil { ae.Progress(*p) }
+}
+
+/*
+Runs a round of anti-entropy every Interval, until die is closed.
+*/
+func (ae *AntiEntropy) Run(die <-chan struct{}) {
+	iv := ae.Interval
+	if iv<=0 { iv = DefaultAntiEntropyInterval }
+	for {
+		ae.Round(die)
+		select {
+		case <- die: return
+		case <- time.After(iv):
+		}
+	}
+}
+
+/*
+Limits the average rate of bytes.
+*/
+type limiter struct{
+	next time.Time
+}
+func (l *limiter) wait(rate int64, n int, die <-chan struct{}) bool {
+	if rate<=0 { return true }
+	now := time.Now()
+	if l.next.Before(now) { l.next = now }
+	l.next = l.next.Add(time.Duration(int64(n)*int64(time.Second)/rate))
+	d := time.Until(l.next)
+	if d<=0 { return true }
+	select {
+	case <- die: return false
+	case <- time.After(d): return true
+	}
+}
+
+type replicaPair struct{
+	a,b    string
+	ranges []Range // nil -> all keys.
+}
+
+/*
+Returns the pairs of nodes, that replicate common ranges.
+*/
+func (r *Router) replicaPairs() (pairs []replicaPair, k1, k2 uint64) {
+	if r.Replicas<=1 { return }
+	ring,ok := r.placement().(*Ring)
+	if !ok {
+		nodes := r.nodes()
+		sort.Strings(nodes)
+		for i := range nodes {
+			for _,b := range nodes[i+1:] { pairs = append(pairs,replicaPair{a:nodes[i],b:b}) }
+		}
+		return pairs,r.K1,r.K2
+	}
+	ranges,sets := ring.Ranges(r.Replicas)
+	index := make(map[[2]string]int)
+	for i,set := range sets {
+		for x := range set {
+			for _,b := range set[x+1:] {
+				a := set[x]
+				if b<a { a,b = b,a }
+				j,ok := index[[2]string{a,b}]
+				if !ok {
+					j = len(pairs)
+					index[[2]string{a,b}] = j
+					pairs = append(pairs,replicaPair{a:a,b:b})
+				}
+				pairs[j].ranges = append(pairs[j].ranges,ranges[i])
+			}
+		}
+	}
+	sort.Slice(pairs,func(i,j int) bool {
+		if pairs[i].a!=pairs[j].a { return pairs[i].a<pairs[j].a }
+		return pairs[i].b<pairs[j].b
+	})
+	return pairs,ring.K1,ring.K2
+}
+
+/*
+Performs one round of anti-entropy. Returns the progress, when the round is
+done, or die has been closed.
+*/
+func (ae *AntiEntropy) Round(die <-chan struct{}) Progress {
+	r := ae.Router
+	ctx,cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <- die: cancel()
+		case <- ctx.Done():
+		}
+	}()
+	
+	pairs,k1,k2 := r.replicaPairs()
+	namespaces := ae.Namespaces
+	if namespaces==nil { namespaces = []string{""} }
+	
+	ae.mu.Lock()
+	p := Progress{Round:ae.last.Round+1,Pairs:len(pairs)}
+	ae.mu.Unlock()
+	for _,pair := range pairs {
+		p.A,p.B,p.Err = pair.a,pair.b,nil
+		for _,ns := range namespaces {
+			s := &aeScope{ae:ae,ctx:ctx,die:die,p:&p,pair:pair,ns:ns,k1:k1,k2:k2}
+			if err := s.compare(); err!=nil { p.Err = err }
+		}
+		p.Pair++
+		ae.report(&p)
+		if ctx.Err()!=nil { break }
+	}
+	atomic.AddUint64(&r.stats.AntiEntropyRounds,1)
+	return p
+}
+
+/*
+The comparison of a pair of nodes in one namespace.
+*/
+type aeScope struct{
+	ae    *AntiEntropy
+	ctx   context.Context
+	die   <-chan struct{}
+	p     *Progress
+	pair  replicaPair
+	ns    string
+	k1,k2 uint64
+}
+
+/*
+Accounts for n bytes transferred and waits, if the bandwidth is exceeded.
+*/
+func (s *aeScope) transferred(n int) bool {
+	s.p.Bytes += int64(n)
+	return s.ae.lim.wait(s.ae.Bandwidth,n,s.die)
+}
+
+func (s *aeScope) request(level int, idx []uint32) *kvtp.Request {
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_Merkle
+	msg.Namespace = s.ns
+	msg.Val = append(msg.Val,make([]byte,16)...)
+	binary.BigEndian.PutUint64(msg.Val,s.k1)
+	binary.BigEndian.PutUint64(msg.Val[8:],s.k2)
+	for _,rg := range s.pair.ranges {
+		e := msg.AddEntry()
+		e.Key = append(e.Key,make([]byte,8)...)
+		e.Val = append(e.Val,make([]byte,8)...)
+		binary.BigEndian.PutUint64(e.Key,rg.Start)
+		binary.BigEndian.PutUint64(e.Val,rg.End)
+	}
+	msg.Limit = uint32(level)
+	for _,i := range idx { msg.End = append(msg.End,byte(i>>24),byte(i>>16),byte(i>>8),byte(i)) }
+	return msg
+}
+
+func (s *aeScope) call(node string, msg *kvtp.Request) (o outcome, err error) {
+	ctx,cancel := context.WithTimeout(s.ctx,ReplicaTimeout)
+	defer cancel()
+	o = s.ae.Router.send(node,msg,ctx)
+	if !o.ok() {
+		err = errors.New(node+": "+o.decision())
+		o.done()
+	}
+	return
+}
+
+/*
+Returns the hashes of the nodes idx at level of the Merkle tree of node.
+*/
+func (s *aeScope) hashes(node string, level int, idx []uint32) ([]uint64,error) {
+	o,err := s.call(node,s.request(level,idx))
+	if err!=nil { return nil,err }
+	defer o.done()
+	if len(o.resp.Entries)!=len(idx) { return nil,errMerkle }
+	h := make([]uint64,len(idx))
+	for i := range h {
+		e := &o.resp.Entries[i]
+		if e.Code!=kvtp.RESP_Value || len(e.Val)!=8 || e.Version!=uint64(idx[i]) { return nil,errMerkle }
+		h[i] = binary.BigEndian.Uint64(e.Val)
+	}
+	s.transferred(8*len(h))
+	return h,nil
+}
+
+type keyState struct{
+	ts      uint64
+	deleted bool
+}
+
+/*
+Returns the keys in the leaves of the Merkle tree of node.
+*/
+func (s *aeScope) keys(node string, leaves []uint32) (map[string]keyState,error) {
+	msg := s.request(kvtp.MERKLE_Depth,leaves)
+	msg.Flags = kvtp.FLAG_KeysOnly
+	o,err := s.call(node,msg)
+	if err!=nil { return nil,err }
+	defer o.done()
+	keys := make(map[string]keyState,len(o.resp.Entries))
+	n := 0
+	for i := range o.resp.Entries {
+		e := &o.resp.Entries[i]
+		keys[string(e.Key)] = keyState{e.Version,e.Code==kvtp.RESP_NotFound}
+		n += len(e.Key)+8
+	}
+	s.transferred(n)
+	return keys,nil
+}
+
+/*
+Compares the Merkle trees of the pair and repairs the keys, that differ.
+*/
+func (s *aeScope) compare() error {
+	a,b := s.pair.a,s.pair.b
+	idx := []uint32{0}
+	for level := 0; ; level++ {
+		ha,err := s.hashes(a,level,idx)
+		if err!=nil { return err }
+		hb,err := s.hashes(b,level,idx)
+		if err!=nil { return err }
+		var diff []uint32
+		for i := range idx {
+			if ha[i]!=hb[i] { diff = append(diff,idx[i]) }
+		}
+		if len(diff)==0 { return nil }
+		if level==kvtp.MERKLE_Depth {
+			idx = diff
+			break
+		}
+		idx = idx[:0]
+		for _,d := range diff {
+			for c := uint32(0); c<1<<kvtp.MERKLE_Bits; c++ { idx = append(idx,d<<kvtp.MERKLE_Bits|c) }
+		}
+	}
+	s.p.Leaves += len(idx)
+	
+	ka,err := s.keys(a,idx)
+	if err!=nil { return err }
+	kb,err := s.keys(b,idx)
+	if err!=nil { return err }
+	for key,sa := range ka {
+		sb,ok := kb[key]
+		if ok && sb.ts>=sa.ts { continue }
+		if err = s.repair(key,a,b,sa); err!=nil { return err }
+	}
+	for key,sb := range kb {
+		sa,ok := ka[key]
+		if ok && sa.ts>=sb.ts { continue }
+		if err = s.repair(key,b,a,sb); err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Writes the version st of key from node from to node to.
+*/
+func (s *aeScope) repair(key string, from, to string, st keyState) error {
+	if st.ts==0 { return nil }
+	r := s.ae.Router
+	if s.pair.ranges==nil {
+		in := 0
+		for _,n := range r.replicas([]byte(key)) {
+			if n==from || n==to { in++ }
+		}
+		if in<2 { return nil }
+	}
+	s.p.Keys++
+	
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_ReadRepair
+	msg.Namespace = s.ns
+	msg.Key = append(msg.Key,key...)
+	msg.Timestamp = st.ts
+	if st.deleted {
+		msg.Flags = kvtp.FLAG_Tombstone
+	} else {
+		get := kvtp.NewRequest().(*kvtp.Request)
+		get.Cmd = kvtp.CMD_GetNoRedirect
+		get.Namespace = s.ns
+		get.Key = append(get.Key,key...)
+		o,err := s.call(from,get)
+		if err!=nil { return err }
+		if o.resp.Code!=kvtp.RESP_Value {
+			// Gone meanwhile. The next round takes care of it.
+			o.done()
+			return nil
+		}
+		msg.Val = append(msg.Val,o.resp.Val...)
+		msg.ExpiresAt = o.resp.ExpiresAt
+		msg.Timestamp = o.resp.Timestamp
+		o.done()
+		if !s.transferred(len(msg.Val)) { return s.ctx.Err() }
+	}
+	o,err := s.call(to,msg)
+	if err!=nil { return err }
+	o.done()
+	if !s.transferred(len(key)+len(msg.Val)) { return s.ctx.Err() }
+	s.p.Repaired++
+	atomic.AddUint64(&r.stats.AntiEntropyRepairs,1)
+	return nil
+}
@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/routing"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/lsm2"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Connects the client end of a pipe, whose server end is passed to serve.
+*/
+func pipe(t *testing.T, serve func(src <-chan *rpcmux.Request)) rpcmux.Client {
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	serve(ss.Serve())
+	t.Cleanup(shutdown)
+	return cs.Client()
+}
+
+/*
+Opens a storage node in a temporary directory.
+*/
+func openNode(t *testing.T, name string) rpcmux.Client {
+	dir,err := ioutil.TempDir("","cohash")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	die := make(chan struct{})
+	db := &lsm2.DB{Name:name,DB:bdb}
+	db.Die = die
+	db.Resps = &sync.Pool{New:kvtp.NewResponse}
+	t.Cleanup(func() {
+		close(die)
+		db.Wait()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return pipe(t,func(src <-chan *rpcmux.Request) {
+		db.Source = src
+		db.Init(1)
+	})
+}
+
+/*
+Storage nodes by name. Implements routing.NodeClients and routing.RedirectReader.
+*/
+type nodes map[string]rpcmux.Client
+
+func (n nodes) NodeClient(node string) (rpcmux.Client,bool) {
+	cli,ok := n[node]
+	return cli,ok
+}
+func (n nodes) RedirectRead(node string, req *rpcmux.Request) bool {
+	cli,ok := n[node]
+	return ok && routing.Forward(req,cli)==nil
+}
+
+/*
+Starts a router in front of count storage nodes. setup, if not nil, configures it.
+*/
+func openRouter(t *testing.T, count int, setup func(r *Router)) (*Router,nodes,*client.Client) {
+	ns := make(nodes)
+	r := &Router{Name:"router",RedirectReader:ns,NC:ns}
+	for i := 0 ; i<count ; i++ {
+		name := fmt.Sprint("node",i)
+		ns[name] = openNode(t,name)
+		r.Nodes = append(r.Nodes,name)
+	}
+	if setup!=nil { setup(r) }
+	// Runs after the pipe has been shut down, but before the nodes are closed.
+	t.Cleanup(r.Wait)
+	cli := pipe(t,func(src <-chan *rpcmux.Request) {
+		go func() {
+			for req := range src { r.Process(req) }
+		}()
+	})
+	return r,ns,client.Over(cli,nil)
+}
+
+/*
+Performs a request and returns a copy of the response.
+*/
+func do(t *testing.T, cli *client.Client, build func(r *kvtp.Request)) (*kvtp.Response,error) {
+	var resp *kvtp.Response
+	err := cli.Do(context.Background(),build,func(r *kvtp.Response) error {
+		resp = new(kvtp.Response)
+		resp.CopyFrom(r)
+		return nil
+	})
+	return resp,err
+}
+
+/*
+Returns the value of key on node, "" if not found.
+*/
+func stored(t *testing.T, ns nodes, node, key string) string {
+	item,err := client.Over(ns[node],nil).Get(context.Background(),[]byte(key))
+	if err==client.ErrNotFound { return "" }
+	if err!=nil { t.Fatalf("%s %s: %v",node,key,err) }
+	return string(item.Value)
+}
+
+func TestMultiSplit(t *testing.T) {
+	r,ns,cli := openRouter(t,3,nil)
+	ctx := context.Background()
+	put := &kvtp.Request{}
+	var keys [][]byte
+	for i := 0 ; i<30 ; i++ {
+		k := fmt.Sprintf("k%02d",i)
+		keys = append(keys,[]byte(k))
+		e := put.AddEntry()
+		e.Key = []byte(k)
+		e.Val = []byte("v"+k)
+	}
+	resp,err := do(t,cli,func(m *kvtp.Request) {
+		m.Cmd = kvtp.CMD_MultiPut
+		m.Entries = append(m.Entries,put.Entries...)
+	})
+	if err!=nil { t.Fatal(err) }
+	for i,e := range resp.Entries {
+		if e.Code!=kvtp.RESP_None { t.Fatalf("entry %d: code %d %s",i,e.Code,e.Val) }
+	}
+	owners := make(map[string]bool)
+	for _,k := range keys {
+		owner := r.node(k)
+		owners[owner] = true
+		if v := stored(t,ns,owner,string(k)); v!="v"+string(k) { t.Errorf("%s on %s: %q",k,owner,v) }
+	}
+	if len(owners)<2 { t.Fatalf("keys have %d owners",len(owners)) }
+	
+	items,err := cli.MultiGet(ctx,keys)
+	if err!=nil { t.Fatal(err) }
+	for i,item := range items {
+		if item==nil || string(item.Value)!="v"+string(keys[i]) { t.Errorf("%s: %v",keys[i],item) }
+	}
+	
+	resp,err = do(t,cli,func(m *kvtp.Request) {
+		m.Cmd = kvtp.CMD_Scan
+		m.Key = append(m.Key,"k"...)
+		m.Flags = kvtp.FLAG_Prefix
+		m.Limit = 25
+	})
+	if err!=nil { t.Fatal(err) }
+	if len(resp.Entries)!=25 { t.Fatalf("scan returned %d entries",len(resp.Entries)) }
+	for i,e := range resp.Entries {
+		if string(e.Key)!=string(keys[i]) { t.Errorf("scan entry %d: %s, want %s",i,e.Key,keys[i]) }
+	}
+}
+
+func TestReplicatedModify(t *testing.T) {
+	_,ns,cli := openRouter(t,3,func(r *Router) { r.Replicas = 3 })
+	cli.Consistency = kvtp.CL_ALL
+	ctx := context.Background()
+	for i := 0 ; i<5 ; i++ {
+		_,err := do(t,cli,func(m *kvtp.Request) {
+			m.Cmd = kvtp.CMD_Incr
+			m.Key = append(m.Key,"n"...)
+			m.Delta = 1
+			m.Initial = 1
+		})
+		if err!=nil { t.Fatal(err) }
+	}
+	if _,err := cli.PutIfAbsent(ctx,[]byte("a"),[]byte("x"),0); err!=nil { t.Fatal(err) }
+	if _,err := cli.PutIfAbsent(ctx,[]byte("a"),[]byte("y"),0); err!=client.ErrConflict { t.Fatalf("second PutIfAbsent: %v",err) }
+	
+	for node := range ns {
+		if v := stored(t,ns,node,"n"); v!="5" { t.Errorf("n on %s: %q",node,v) }
+		if v := stored(t,ns,node,"a"); v!="x" { t.Errorf("a on %s: %q",node,v) }
+	}
+	
+	_,err := cli.Lock(ctx,[]byte("l"),[]byte("me"),time.Minute)
+	if e,ok := err.(*client.Error); !ok || e.Code!=kvtp.ERR_Unsupported { t.Errorf("Lock: %v",err) }
+	_,err = cli.MultiGet(ctx,[][]byte{[]byte("n")})
+	if e,ok := err.(*client.Error); !ok || e.Code!=kvtp.ERR_Unsupported { t.Errorf("MultiGet: %v",err) }
+}
+
+/*
+Reports one node as unhealthy.
+*/
+type downNode struct{
+	mu   sync.Mutex
+	node string
+}
+func (d *downNode) set(node string) {
+	d.mu.Lock()
+	d.node = node
+	d.mu.Unlock()
+}
+func (d *downNode) RequestGoodness(node string) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if node==d.node { return 0 }
+	return 1
+}
+
+/*
+The versions of a replicated value must not depend on the replica, that answers.
+*/
+func TestReplicatedPutIfVersion(t *testing.T) {
+	health := new(downNode)
+	r,ns,cli := openRouter(t,3,func(r *Router) {
+		r.Replicas = 3
+		r.Health = health
+	})
+	ctx := context.Background()
+	
+	// Let the versions of the nodes diverge.
+	for i,node := range r.Nodes {
+		for j := 0 ; j<=i ; j++ {
+			if err := client.Over(ns[node],nil).Put(ctx,[]byte("x"),nil); err!=nil { t.Fatal(err) }
+		}
+	}
+	
+	cli.Consistency = kvtp.CL_ALL
+	v1,err := cli.PutIfAbsent(ctx,[]byte("a"),[]byte("1"),0)
+	if err!=nil { t.Fatal(err) }
+	
+	// Read from another replica, than the primary.
+	cli.Consistency = kvtp.CL_ONE
+	primary := r.replicas([]byte("a"))[0]
+	health.set(primary)
+	item,err := cli.Get(ctx,[]byte("a"))
+	if err!=nil { t.Fatal(err) }
+	if item.Version!=v1 { t.Fatalf("version %d, want %d",item.Version,v1) }
+	health.set("")
+	
+	v2,err := cli.PutIfVersion(ctx,[]byte("a"),[]byte("2"),0,item.Version)
+	if err!=nil { t.Fatal(err) }
+	if _,err := cli.PutIfVersion(ctx,[]byte("a"),[]byte("3"),0,v1); err!=client.ErrConflict { t.Fatalf("stale version: %v",err) }
+	item,err = cli.Get(ctx,[]byte("a"))
+	if err!=nil { t.Fatal(err) }
+	if string(item.Value)!="2" || item.Version!=v2 { t.Errorf("a: %q, version %d, want 2, %d",item.Value,item.Version,v2) }
+}
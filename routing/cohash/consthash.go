@@ -25,23 +25,196 @@ SOFTWARE.
 package cohash
 
 import (
-	"github.com/dchest/siphash"
+	"strings"
+	"sync"
 	"github.com/byte-mug/zrab2k/kvtp"
 	"github.com/byte-mug/zrab2k/rpcmux"
 	"github.com/byte-mug/zrab2k/routing"
 )
 
+/*
+Routes requests to the node, that owns their key according to Placement.
+
+If Placement is nil, a Ring is built from Nodes (with weight 1), K1 and K2 on first use.
+
+With Replicas>1 and NC, every key is stored on a replica set of nodes, see
+replicate. Locks, transactions and commands with several keys (CMD_MultiGet,
+CMD_MultiPut, CMD_Scan) are not supported then and get ERR_Unsupported. Other
+commands, that are not replicated (like CMD_Watch), are sent to the first healthy
+replica. With NC, CMD_Stat also returns the counters of the router (see Stats).
+
+Commands with several keys are split by owner, see multi.
+
+Router implements routing.MemberListener: Nodes, that join or leave, are added
+to or removed from Nodes and the Placement, if it is a Ring or routing.HRW. A
+routing.Jump is left unchanged, as removing a node from the middle of its Nodes
+would move most keys.
+*/
 type Router struct {
+	stats Stats // First, as the counters are updated atomically (64-bit alignment).
 	routing.RedirectReader
+	Name  string // Router-ID, used in CMD_Trace.
 	Nodes []string
 	K1,K2 uint64
+	Placement routing.Placement // Optional: A Ring, routing.HRW, routing.Jump, ...
+	NC    routing.NodeClients // Optional: Enables transactions across nodes and replication.
+	
+	Replicas int // Replication factor. 0 or 1 -> Every key is stored on one node.
+	Health   routing.NodeGoodness // Optional: Nodes with goodness 0 are unhealthy.
+	Consistency uint8 // Consistency level (kvtp.CL_*) of requests without one. CL_NONE -> CL_ONE.
+	Hints routing.HintStore // Optional: Enables hinted handoff.
+	
+	once sync.Once
+	mu   sync.Mutex // Guards Nodes against NodeJoined and NodeLeft.
+	wg   sync.WaitGroup // Goroutines started by Process.
+}
+
+/*
+Runs f in a goroutine, that Wait waits for.
+*/
+func (r *Router) spawn(f func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+/*
+Waits for the requests, Process has started, and their background work (like
+read repairs and hints). Process must not be called anymore. Afterwards, the
+Hints can be closed.
+*/
+func (r *Router) Wait() {
+	r.wg.Wait()
+}
+
+/*
+Returns a copy of Nodes.
+*/
+func (r *Router) nodes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil),r.Nodes...)
+}
+
+func (r *Router) NodeJoined(node string) {
+	p := r.placement()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _,n := range r.Nodes {
+		if n==node { return }
+	}
+	r.Nodes = append(r.Nodes[:len(r.Nodes):len(r.Nodes)],node)
+	switch p := p.(type) {
+	case *Ring: p.Add(node,1)
+	case *routing.HRW: p.Add(node,1)
+	}
+}
+
+func (r *Router) NodeLeft(node string) {
+	p := r.placement()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nodes := make([]string,0,len(r.Nodes))
+	for _,n := range r.Nodes {
+		if n!=node { nodes = append(nodes,n) }
+	}
+	if len(nodes)==len(r.Nodes) { return }
+	r.Nodes = nodes
+	switch p := p.(type) {
+	case *Ring: p.Remove(node)
+	case *routing.HRW: p.Remove(node)
+	}
+}
+
+func (r *Router) placement() routing.Placement {
+	r.once.Do(func() {
+		if r.Placement!=nil { return }
+		ring := &Ring{K1:r.K1,K2:r.K2,weights:make(map[string]int)}
+		for _,n := range r.nodes() { ring.weights[n] = 1 }
+		ring.rebuild()
+		r.Placement = ring
+	})
+	return r.Placement
+}
+
+/* Returns the owner of key, or "", if there are no nodes. */
+func (r *Router) node(key []byte) string {
+	node,_ := r.placement().Node(key)
+	return node
+}
+
+/*
+Routes a transaction to the node, that owns all its keys, or performs a
+two-phase commit across the owners.
+*/
+func (r *Router) txn(req *rpcmux.Request, kvr *kvtp.Request) {
+	owners := make([]string,len(kvr.Entries))
+	node := r.node(kvr.Key)
+	for i := range kvr.Entries {
+		owners[i] = r.node(kvr.Entries[i].Key)
+		if i==0 { node = owners[0] }
+		if owners[i]!=node { node = "" }
+	}
+	if node!="" {
+		kvr.AddHop(r.Name,"router","route "+node,req.Received())
+		if !r.RedirectRead(node,req) {
+			routing.ReplyError(req,kvtp.ERR_RedirectFailed,"Redirection failed")
+			req.Release()
+		}
+		return
+	}
+	if r.NC==nil {
+		kvr.AddHop(r.Name,"router","no two-phase commit",req.Received())
+		routing.ReplyError(req,kvtp.ERR_Unsupported,"Transaction spans multiple nodes")
+		req.Release()
+		return
+	}
+	kvr.AddHop(r.Name,"router","two-phase commit",req.Received())
+	r.spawn(func() { routing.TwoPhaseCommit(req,r.NC,owners) })
 }
 
 func (r *Router) Process(req *rpcmux.Request) {
 	kvr := req.Msg.(*kvtp.Request)
-	pos := siphash.Hash(r.K1,r.K2,kvr.Key)%uint64(len(r.Nodes))
-	if !r.RedirectRead(r.Nodes[pos],req) {
-		req.ReplyDefault()
+	node := r.node(kvr.Key)
+	if node=="" {
+		kvr.AddHop(r.Name,"router","no nodes",req.Received())
+		routing.ReplyError(req,kvtp.ERR_NotOwner,"No node owns the key")
+		req.Release()
+		return
+	}
+	if r.Replicas>1 && r.NC!=nil && kind(kvr)==kindUnsupported {
+		kvr.AddHop(r.Name,"router","not replicated",req.Received())
+		routing.ReplyError(req,kvtp.ERR_Unsupported,"Command is not supported with replication")
+		req.Release()
+		return
+	}
+	switch kvr.Cmd {
+	case kvtp.CMD_Txn:
+		r.txn(req,kvr)
+		return
+	case kvtp.CMD_MultiGet,kvtp.CMD_MultiPut,kvtp.CMD_Scan:
+		r.multi(req,kvr)
+		return
+	}
+	if r.Replicas>1 && r.NC!=nil {
+		nodes := r.replicas(kvr.Key)
+		if kind(kvr)!=kindOther && len(nodes)>1 {
+			kvr.AddHop(r.Name,"router","replicate "+strings.Join(nodes,","),req.Received())
+			r.spawn(func() { r.replicate(req,kvr,nodes) })
+			return
+		}
+		node = r.byHealth(nodes)[0]
+	}
+	if kvr.Cmd==kvtp.CMD_Stat && r.NC!=nil {
+		kvr.AddHop(r.Name,"router","stat "+node,req.Received())
+		r.spawn(func() { r.stat(req,kvr,node) })
+		return
+	}
+	kvr.AddHop(r.Name,"router","route "+node,req.Received())
+	if !r.RedirectRead(node,req) {
+		routing.ReplyError(req,kvtp.ERR_RedirectFailed,"Redirection failed")
 		req.Release()
 	}
 }
@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"sync/atomic"
+	"github.com/byte-mug/zrab2k/kvtp"
+)
+
+/*
+Returns the CMD_HintedHandoff request, that replays the write kvr, or nil, if
+kvr can't be replayed.
+*/
+func handoff(kvr *kvtp.Request) *kvtp.Request {
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	switch kvr.Cmd {
+	case kvtp.CMD_Put,kvtp.CMD_PutNoRedirect:
+		msg.Val = append(msg.Val,kvr.Val...)
+		msg.ExpiresAt = kvr.ExpiresAt
+	case kvtp.CMD_Delete:
+		msg.Flags = kvtp.FLAG_Tombstone
+	default: return nil
+	}
+	msg.Cmd = kvtp.CMD_HintedHandoff
+	msg.Namespace = kvr.Namespace
+	msg.Key = append(msg.Key,kvr.Key...)
+	msg.Timestamp = kvr.Timestamp
+	return msg
+}
+
+/*
+Reports, whether the replica of o is down or full, so it should get a hint.
+*/
+func (o *outcome) unavailable() bool {
+	if o.err!=nil { return o.err!=errUnknownNode }
+	return o.resp.Code==kvtp.RESP_Error && o.resp.Err==kvtp.ERR_DiskFull
+}
+
+/*
+Hinted handoff: Stores msg as hint for the replicas in f, that are down or full.
+*/
+func (r *Router) hint(msg *kvtp.Request, f *fan) {
+	for _,o := range f.out {
+		if !o.unavailable() { continue }
+		if r.Hints.Hint(o.node,msg)==nil {
+			atomic.AddUint64(&r.stats.HintsStored,1)
+		} else {
+			atomic.AddUint64(&r.stats.HintsDropped,1)
+		}
+	}
+}
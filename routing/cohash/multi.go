@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/routing"
+)
+
+/*
+Routes CMD_MultiGet, CMD_MultiPut and CMD_Scan.
+
+The entries of CMD_MultiGet and CMD_MultiPut are grouped by their owner. If they
+all have the same owner, the request is forwarded to it, otherwise it is split,
+see Router.split. CMD_Scan is sent to all Nodes, see Router.scatter. Splitting and
+scattering require NC.
+*/
+func (r *Router) multi(req *rpcmux.Request, kvr *kvtp.Request) {
+	var owners []string
+	node := ""
+	if kvr.Cmd==kvtp.CMD_Scan {
+		owners = r.nodes()
+		if len(owners)==1 { node = owners[0] }
+	} else {
+		owners = make([]string,len(kvr.Entries))
+		node = r.node(kvr.Key)
+		for i := range kvr.Entries {
+			owners[i] = r.node(kvr.Entries[i].Key)
+			if i==0 { node = owners[0] }
+			if owners[i]!=node { node = "" }
+		}
+	}
+	if node!="" {
+		kvr.AddHop(r.Name,"router","route "+node,req.Received())
+		if !r.RedirectRead(node,req) {
+			routing.ReplyError(req,kvtp.ERR_RedirectFailed,"Redirection failed")
+			req.Release()
+		}
+		return
+	}
+	if r.NC==nil {
+		kvr.AddHop(r.Name,"router","no split",req.Received())
+		routing.ReplyError(req,kvtp.ERR_Unsupported,"Request spans multiple nodes")
+		req.Release()
+		return
+	}
+	if kvr.Cmd==kvtp.CMD_Scan {
+		kvr.AddHop(r.Name,"router","scatter",req.Received())
+		r.spawn(func() { r.scatter(req,kvr,owners) })
+		return
+	}
+	kvr.AddHop(r.Name,"router","split",req.Received())
+	r.spawn(func() { r.split(req,kvr,owners) })
+}
+
+/*
+Sends the entries of kvr to their owners, one request per owner, and merges the
+results in the order of the entries. The entries of an owner, that failed, get
+its error. Blocks until done and releases req.
+*/
+func (r *Router) split(req *rpcmux.Request, kvr *kvtp.Request, owners []string) {
+	defer req.Release()
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	resp.Code = kvtp.RESP_Entries
+	groups := make(map[string][]int)
+	for i,node := range owners {
+		groups[node] = append(groups[node],i)
+		e := resp.AddEntry()
+		e.Key = append(e.Key,kvr.Entries[i].Key...)
+	}
+	
+	ctx := req.Context()
+	var wg sync.WaitGroup
+	for node,idx := range groups {
+		msg := kvtp.NewRequest().(*kvtp.Request)
+		msg.Cmd = kvr.Cmd
+		msg.Flags = kvr.Flags
+		msg.Namespace = kvr.Namespace
+		msg.Timestamp = kvr.Timestamp
+		for _,i := range idx {
+			e,me := &kvr.Entries[i],msg.AddEntry()
+			me.Key = append(me.Key,e.Key...)
+			me.Val = append(me.Val,e.Val...)
+			me.ExpiresAt = e.ExpiresAt
+		}
+		wg.Add(1)
+		go func(node string, idx []int, msg *kvtp.Request) {
+			defer wg.Done()
+			o := r.send(node,msg,ctx)
+			defer o.done()
+			fail := func(code uint8, s string) {
+				for _,i := range idx { resp.Entries[i].SetError(code,s) }
+			}
+			switch {
+			case o.err!=nil: fail(routing.ErrCode(o.err),o.err.Error())
+			case o.resp.Code==kvtp.RESP_Error: fail(o.resp.Err,string(o.resp.Val))
+			case o.resp.Code!=kvtp.RESP_Entries || len(o.resp.Entries)!=len(idx):
+				fail(kvtp.ERR_Internal,"Unexpected response")
+			default:
+				for j,i := range idx {
+					e,oe := &resp.Entries[i],&o.resp.Entries[j]
+					e.Code = oe.Code
+					e.Err = oe.Err
+					e.Val = append(e.Val[:0],oe.Val...)
+					e.ExpiresAt = oe.ExpiresAt
+					e.Version = oe.Version
+				}
+			}
+		}(node,idx,msg)
+	}
+	wg.Wait()
+	req.Reply(resp)
+}
+
+/*
+Sends a CMD_Scan to all nodes and merges the results in key order, up to the
+Limit. A key, that has been redirected, may be returned by two nodes, it is only
+returned once. If any node fails, its error is replied. Blocks until done and
+releases req.
+*/
+func (r *Router) scatter(req *rpcmux.Request, kvr *kvtp.Request, nodes []string) {
+	defer req.Release()
+	out := r.sendAll(nodes,kvr,req.Context())
+	defer func() {
+		for i := range out { out[i].done() }
+	}()
+	var ents []*kvtp.Entry
+	for i := range out {
+		o := &out[i]
+		if !o.ok() {
+			o.reply(req)
+			return
+		}
+		for j := range o.resp.Entries { ents = append(ents,&o.resp.Entries[j]) }
+	}
+	sort.SliceStable(ents,func(i,j int) bool { return bytes.Compare(ents[i].Key,ents[j].Key)<0 })
+	
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	resp.Code = kvtp.RESP_Entries
+	var last []byte
+	for _,oe := range ents {
+		if kvr.Limit!=0 && len(resp.Entries)>=int(kvr.Limit) { break }
+		if len(resp.Entries)!=0 && bytes.Equal(oe.Key,last) { continue }
+		e := resp.AddEntry()
+		e.Code = oe.Code
+		e.Err = oe.Err
+		e.Key = append(e.Key,oe.Key...)
+		e.Val = append(e.Val,oe.Val...)
+		e.ExpiresAt = oe.ExpiresAt
+		e.Version = oe.Version
+		last = oe.Key
+	}
+	req.Reply(resp)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+)
+
+/*
+Counters of a Router.
+*/
+type Stats struct{
+	ReadRepairs        uint64 // Reads, that found stale replicas.
+	RepairWrites       uint64 // CMD_ReadRepair sent to stale replicas.
+	RepairFailures     uint64 // CMD_ReadRepair, that failed.
+	HintsStored        uint64 // Writes, that have been stored as hint.
+	HintsDropped       uint64 // Hints, that could not be stored.
+	AntiEntropyRounds  uint64
+	AntiEntropyRepairs uint64 // Keys, that have been repaired by anti-entropy.
+}
+
+/*
+Returns the counters of the router.
+*/
+func (r *Router) Stats() (s Stats) {
+	s.ReadRepairs = atomic.LoadUint64(&r.stats.ReadRepairs)
+	s.RepairWrites = atomic.LoadUint64(&r.stats.RepairWrites)
+	s.RepairFailures = atomic.LoadUint64(&r.stats.RepairFailures)
+	s.HintsStored = atomic.LoadUint64(&r.stats.HintsStored)
+	s.HintsDropped = atomic.LoadUint64(&r.stats.HintsDropped)
+	s.AntiEntropyRounds = atomic.LoadUint64(&r.stats.AntiEntropyRounds)
+	s.AntiEntropyRepairs = atomic.LoadUint64(&r.stats.AntiEntropyRepairs)
+	return
+}
+
+/*
+Read repair: Writes the newest value (or deletion) of the outcomes in f back to
+the replicas, that returned an older one or none. Replicas, that failed, are
+not repaired. Values without timestamp are not repaired, as they can't be ordered.
+*/
+func (r *Router) repair(kvr *kvtp.Request, f *fan) {
+	newest := f.best(true)
+	if !newest.ok() || newest.resp.Timestamp==0 { return }
+	var stale []string
+	for _,o := range f.out {
+		if o.ok() && o.resp.Timestamp<newest.resp.Timestamp { stale = append(stale,o.node) }
+	}
+	if len(stale)==0 { return }
+	atomic.AddUint64(&r.stats.ReadRepairs,1)
+	
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_ReadRepair
+	msg.Namespace = kvr.Namespace
+	msg.Key = append(msg.Key,kvr.Key...)
+	msg.Timestamp = newest.resp.Timestamp
+	if newest.resp.Code==kvtp.RESP_Value {
+		msg.Val = append(msg.Val,newest.resp.Val...)
+		msg.ExpiresAt = newest.resp.ExpiresAt
+	} else {
+		msg.Flags = kvtp.FLAG_Tombstone
+	}
+	
+	ctx,cancel := context.WithTimeout(context.Background(),ReplicaTimeout)
+	rf := r.fanOut(stale,msg,ctx,cancel)
+	rf.rest()
+	atomic.AddUint64(&r.stats.RepairWrites,uint64(rf.acks))
+	atomic.AddUint64(&r.stats.RepairFailures,uint64(rf.n-rf.acks))
+	rf.done()
+}
+
+/*
+Performs CMD_Stat: Returns the statistics of node, followed by the counters of the router.
+*/
+func (r *Router) stat(req *rpcmux.Request, kvr *kvtp.Request, node string) {
+	defer req.Release()
+	o := r.send(node,copyRequest(kvr),req.Context())
+	defer o.done()
+	if !o.ok() {
+		o.reply(req)
+		return
+	}
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	resp.CopyFrom(o.resp)
+	add := func(name string, val []byte) {
+		e := resp.AddEntry()
+		e.Key = append(e.Key,name...)
+		e.Val = append(e.Val,val...)
+	}
+	num := func(name string, n uint64) { add(name,strconv.AppendUint(nil,n,10)) }
+	
+	s := r.Stats()
+	add("router",[]byte(r.Name))
+	num("router.read_repairs",s.ReadRepairs)
+	num("router.read_repair_writes",s.RepairWrites)
+	num("router.read_repair_failures",s.RepairFailures)
+	num("router.hints_stored",s.HintsStored)
+	num("router.hints_dropped",s.HintsDropped)
+	num("router.anti_entropy_rounds",s.AntiEntropyRounds)
+	num("router.anti_entropy_repairs",s.AntiEntropyRepairs)
+	req.Reply(resp)
+}
@@ -0,0 +1,449 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/routing"
+)
+
+var errUnknownNode = errors.New("Unknown node")
+
+/*
+Requests to replicas, that are not waited for, are given up after this time.
+*/
+const ReplicaTimeout = 5*time.Second
+
+/*
+How a request is performed on a replica set.
+*/
+const (
+	kindOther = iota // Sent to the first healthy replica only.
+	kindRead
+	kindWrite
+	kindTrace
+	kindPrimary // Performed by the first healthy replica, that is copied to the others.
+	kindUnsupported // Can't be performed on a replica set.
+)
+
+func kind(kvr *kvtp.Request) int {
+	switch kvr.Cmd {
+	case kvtp.CMD_Get,kvtp.CMD_GetNoRedirect: return kindRead
+	case kvtp.CMD_Put,kvtp.CMD_PutNoRedirect,kvtp.CMD_Delete: return kindWrite
+	case kvtp.CMD_Touch:
+		if kvr.ExpiresAt==0 { return kindRead }
+		return kindWrite
+	case kvtp.CMD_Trace: return kindTrace
+	case kvtp.CMD_Incr,kvtp.CMD_Append,kvtp.CMD_PutIfAbsent,kvtp.CMD_PutIfVersion: return kindPrimary
+	case kvtp.CMD_Lock,kvtp.CMD_Renew,kvtp.CMD_Unlock,kvtp.CMD_Txn,
+		kvtp.CMD_MultiGet,kvtp.CMD_MultiPut,kvtp.CMD_Scan: return kindUnsupported
+	}
+	return kindOther
+}
+
+/*
+The result of a request to one replica.
+*/
+type outcome struct{
+	node    string
+	resp    *kvtp.Response
+	release func()
+	err     error
+}
+func (o *outcome) ok() bool {
+	return o.err==nil && o.resp.Code!=kvtp.RESP_Error
+}
+func (o *outcome) decision() string {
+	switch {
+	case o.err!=nil: return "error "+o.err.Error()
+	case o.resp.Code==kvtp.RESP_Error: return "error "+kvtp.ErrName(o.resp.Err)
+	case o.resp.Code==kvtp.RESP_NotFound: return "not_found"
+	}
+	return "ok"
+}
+func (o *outcome) done() {
+	if o.release!=nil { o.release() }
+	o.release = nil
+}
+
+/*
+Replaces the version of the value by its timestamp, see kvtp.FLAG_Timestamp.
+*/
+func (o *outcome) byTimestamp() *outcome {
+	if o.err==nil && o.resp.Code==kvtp.RESP_Value { o.resp.Version = o.resp.Timestamp }
+	return o
+}
+
+/*
+Replies with the response of o.
+*/
+func (o *outcome) reply(req *rpcmux.Request) {
+	if o.err!=nil {
+		routing.ReplyError(req,routing.ErrCode(o.err),o.err.Error())
+		return
+	}
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	resp.CopyFrom(o.resp)
+	req.Reply(resp)
+}
+
+/*
+Returns the replica set of key: Up to Replicas distinct nodes, the owner first.
+*/
+func (r *Router) replicas(key []byte) []string {
+	p := r.placement()
+	if rp,ok := p.(routing.ReplicaPlacement); ok && r.Replicas>1 { return rp.Replicas(key,r.Replicas) }
+	node,ok := p.Node(key)
+	if !ok { return nil }
+	return []string{node}
+}
+
+/*
+Orders nodes by health: The healthy ones first, in their order.
+*/
+func (r *Router) byHealth(nodes []string) []string {
+	if r.Health==nil { return nodes }
+	sorted := make([]string,0,len(nodes))
+	for _,n := range nodes {
+		if r.Health.RequestGoodness(n)!=0 { sorted = append(sorted,n) }
+	}
+	for _,n := range nodes {
+		if r.Health.RequestGoodness(n)==0 { sorted = append(sorted,n) }
+	}
+	return sorted
+}
+
+func copyRequest(kvr *kvtp.Request) *kvtp.Request {
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.CopyFrom(kvr)
+	return msg
+}
+
+/*
+Sends msg to node and waits for the response.
+*/
+func (r *Router) send(node string, msg *kvtp.Request, ctx context.Context) (o outcome) {
+	o.node = node
+	cli,ok := r.NC.NodeClient(node)
+	if !ok {
+		o.err = errUnknownNode
+		return
+	}
+	o.resp,o.release,o.err = routing.Call(cli,msg,ctx)
+	return
+}
+
+/*
+Sends kvr to all nodes in parallel and waits for the responses.
+*/
+func (r *Router) sendAll(nodes []string, kvr *kvtp.Request, ctx context.Context) []outcome {
+	out := make([]outcome,len(nodes))
+	var wg sync.WaitGroup
+	for i,node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			out[i] = r.send(node,copyRequest(kvr),ctx)
+		}(i,node)
+	}
+	wg.Wait()
+	return out
+}
+
+/*
+Returns the number of replicas out of n, that must answer for consistency level cl.
+*/
+func (r *Router) need(cl uint8, n int) int {
+	if cl==kvtp.CL_NONE { cl = r.Consistency }
+	switch cl {
+	case kvtp.CL_QUORUM: return n/2+1
+	case kvtp.CL_ALL: return n
+	}
+	return 1
+}
+
+/*
+The outcomes of a request, that has been sent to several replicas, see fanOut.
+*/
+type fan struct{
+	ch   <-chan *outcome
+	n    int
+	out  []*outcome // In the order of arrival.
+	acks int // Successful outcomes.
+}
+
+/*
+Sends kvr to all nodes in parallel. Once all outcomes arrived, cancel is called
+(if not nil).
+*/
+func (r *Router) fanOut(nodes []string, kvr *kvtp.Request, ctx context.Context, cancel context.CancelFunc) *fan {
+	ch := make(chan *outcome,len(nodes))
+	var wg sync.WaitGroup
+	for _,node := range nodes {
+		wg.Add(1)
+		go func(node string, msg *kvtp.Request) {
+			defer wg.Done()
+			o := r.send(node,msg,ctx)
+			ch <- &o
+		}(node,copyRequest(kvr))
+	}
+	if cancel!=nil {
+		go func() {
+			wg.Wait()
+			cancel()
+		}()
+	}
+	return &fan{ch:ch,n:len(nodes)}
+}
+
+func (f *fan) next() {
+	o := <-f.ch
+	f.out = append(f.out,o)
+	if o.ok() { f.acks++ }
+}
+
+/*
+Waits, until need replicas succeeded, or too many failed. Reports, whether need
+replicas succeeded.
+*/
+func (f *fan) wait(need int) bool {
+	for len(f.out)<f.n && f.acks<need && len(f.out)-f.acks<=f.n-need { f.next() }
+	return f.acks>=need
+}
+
+/*
+Waits for the outcomes of all replicas.
+*/
+func (f *fan) rest() {
+	for len(f.out)<f.n { f.next() }
+}
+
+/*
+Returns the first successful outcome, or, if byTime is true, the one with the
+newest timestamp. If none succeeded, the first failed one is returned.
+*/
+func (f *fan) best(byTime bool) *outcome {
+	var best *outcome
+	for _,o := range f.out {
+		if !o.ok() { continue }
+		if best==nil || (byTime && o.resp.Timestamp>best.resp.Timestamp) { best = o }
+	}
+	if best==nil { best = f.out[0] }
+	return best
+}
+
+/*
+Waits for the outcomes of all replicas and releases them.
+*/
+func (f *fan) done() {
+	f.rest()
+	for _,o := range f.out { o.done() }
+}
+
+/*
+Replies ERR_Unavailable, with the failure o (if any) as reason.
+*/
+func unavailable(req *rpcmux.Request, o *outcome, need int) {
+	msg := fmt.Sprintf("Consistency level requires %d replicas",need)
+	if o!=nil && !o.ok() { msg += ", "+o.node+": "+o.decision() }
+	routing.ReplyError(req,kvtp.ERR_Unavailable,msg)
+}
+
+/*
+Performs a request on the replica set of its key. Blocks until done and releases req.
+
+The consistency level of the request (or Router.Consistency) determines, how
+many replicas must answer, see Router.need. If too few replicas answer,
+ERR_Unavailable is replied.
+
+Writes get a timestamp and are sent to all replicas. The response of the first
+replica, that succeeded, is replied, once enough replicas succeeded. The other
+replicas are not waited for (but given ReplicaTimeout to complete). Replicas,
+that are down or full, get a hint (see Router.Hints), that is replayed later.
+Hints do not count towards the consistency level.
+
+Reads with CL_ONE are sent to one replica after another, the healthy ones first,
+until one succeeds. With a higher level, they are sent to all replicas, and the
+newest of the first responses is replied. Afterwards, stale replicas are
+repaired, see Router.repair.
+
+Read-modify-writes (CMD_Incr, CMD_Append, CMD_PutIfAbsent, CMD_PutIfVersion) are
+performed by the first healthy replica, the primary. Its new value is then copied
+to the other replicas with CMD_ReadRepair, like a write. Their outcome counts
+towards the consistency level. If the primary changes (because it failed) while
+such requests are in flight, one of two concurrent updates may be lost.
+
+Versions are local to a node, so the replicas of a value have different ones.
+Reads therefore return the timestamp of the value as its version, and
+CMD_PutIfVersion compares it with kvtp.FLAG_Timestamp.
+
+CMD_Trace asks all replicas and reports the outcome of each.
+*/
+func (r *Router) replicate(req *rpcmux.Request, kvr *kvtp.Request, nodes []string) {
+	defer req.Release()
+	ctx := req.Context()
+	n := len(nodes)
+	need := r.need(kvr.Consistency,n)
+	switch kind(kvr) {
+	case kindRead:
+		if need==1 {
+			var last outcome
+			for _,node := range r.byHealth(nodes) {
+				last.done()
+				last = r.send(node,copyRequest(kvr),ctx)
+				if last.ok() { break }
+			}
+			if last.ok() {
+				last.byTimestamp().reply(req)
+			} else {
+				unavailable(req,&last,need)
+			}
+			last.done()
+			return
+		}
+		
+		// The replicas, that are not waited for, must not be canceled by Release.
+		rctx,cancel := context.WithTimeout(context.Background(),ReplicaTimeout)
+		f := r.fanOut(nodes,kvr,rctx,cancel)
+		if f.wait(need) {
+			f.best(true).byTimestamp().reply(req)
+		} else {
+			unavailable(req,f.best(true),need)
+		}
+		var rep *kvtp.Request
+		switch kvr.Cmd {
+		case kvtp.CMD_Get,kvtp.CMD_GetNoRedirect: rep = copyRequest(kvr)
+		}
+		r.spawn(func() {
+			if rep!=nil {
+				f.rest()
+				r.repair(rep,f)
+			}
+			f.done()
+		})
+	case kindWrite:
+		if kvr.Timestamp==0 { kvr.Timestamp = uint64(time.Now().UnixNano()) }
+		wctx,cancel := context.WithTimeout(context.Background(),ReplicaTimeout)
+		f := r.fanOut(nodes,kvr,wctx,cancel)
+		if f.wait(need) {
+			f.best(false).reply(req)
+		} else {
+			unavailable(req,f.best(false),need)
+		}
+		var hint *kvtp.Request
+		if r.Hints!=nil { hint = handoff(kvr) }
+		r.spawn(func() {
+			if hint!=nil {
+				f.rest()
+				r.hint(hint,f)
+			}
+			f.done()
+		})
+	case kindPrimary:
+		nodes = r.byHealth(nodes)
+		msg := copyRequest(kvr)
+		switch kvr.Cmd {
+		case kvtp.CMD_PutIfVersion,kvtp.CMD_PutIfAbsent: msg.Flags |= kvtp.FLAG_Timestamp
+		}
+		o := r.send(nodes[0],msg,ctx)
+		defer o.done()
+		if !o.ok() || o.resp.Code==kvtp.RESP_Conflict {
+			o.reply(req)
+			return
+		}
+		if need==1 { o.reply(req) }
+		f := r.copyValue(kvr,nodes)
+		if need>1 {
+			if f!=nil && f.wait(need-1) {
+				o.reply(req)
+			} else if f!=nil {
+				unavailable(req,f.best(false),need)
+			} else {
+				unavailable(req,nil,need)
+			}
+		}
+		if f!=nil { r.spawn(f.done) }
+	case kindTrace:
+		out := r.sendAll(nodes,kvr,ctx)
+		resp,ok := req.DefaultResponse().(*kvtp.Response)
+		if !ok {
+			req.ReplyDefault()
+			return
+		}
+		resp.Code = kvtp.RESP_Value
+		base := len(kvr.Hops)
+		resp.Hops = append(resp.Hops[:0],kvr.Hops...)
+		for i := range out {
+			o := &out[i]
+			decision := fmt.Sprintf("replica %d/%d %s: %s",i+1,len(out),o.node,o.decision())
+			resp.Hops = append(resp.Hops,kvtp.Hop{Node:r.Name,Role:"router",Decision:decision,Elapsed:time.Since(req.Received())})
+			if o.err==nil && len(o.resp.Hops)>base { resp.Hops = append(resp.Hops,o.resp.Hops[base:]...) }
+			o.done()
+		}
+		req.Reply(resp)
+	}
+}
+
+/*
+Copies the value of the key of kvr from the primary nodes[0] to the other nodes,
+after a read-modify-write. The value is read back from the primary, so it keeps
+the timestamp, the primary assigned. It is sent as CMD_ReadRepair, so a newer
+value on a replica is not overwritten.
+
+Returns the outcomes of the copies, or nil, if the value could not be read. The
+caller must call done.
+*/
+func (r *Router) copyValue(kvr *kvtp.Request, nodes []string) *fan {
+	ctx,cancel := context.WithTimeout(context.Background(),ReplicaTimeout)
+	get := kvtp.NewRequest().(*kvtp.Request)
+	get.Cmd = kvtp.CMD_Get
+	get.Namespace = kvr.Namespace
+	get.Key = append(get.Key,kvr.Key...)
+	o := r.send(nodes[0],get,ctx)
+	defer o.done()
+	if !o.ok() || o.resp.Code!=kvtp.RESP_Value || o.resp.Timestamp==0 {
+		cancel()
+		return nil
+	}
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_ReadRepair
+	msg.Namespace = kvr.Namespace
+	msg.Key = append(msg.Key,kvr.Key...)
+	msg.Val = append(msg.Val,o.resp.Val...)
+	msg.ExpiresAt = o.resp.ExpiresAt
+	msg.Timestamp = o.resp.Timestamp
+	return r.fanOut(nodes[1:],msg,ctx,cancel)
+}
@@ -0,0 +1,252 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"github.com/dchest/siphash"
+	"github.com/byte-mug/zrab2k/routing"
+)
+
+/* Virtual nodes per unit of weight, if Ring.VNodes is 0. */
+const DefaultVNodes = 128
+
+/*
+A range of the hash space: (Start, End]. If Start>=End, the range wraps around.
+From and To are the owners of the range, before and after a change of the ring.
+*/
+type Range struct{
+	Start,End uint64
+	From,To   string
+}
+
+/*
+Reports, whether the hash h is within the range.
+*/
+func (r *Range) Contains(h uint64) bool {
+	if r.Start<r.End { return r.Start<h && h<=r.End }
+	return r.Start<h || h<=r.End
+}
+
+type point struct{
+	hash uint64
+	node string
+}
+
+/*
+A consistent hash ring with virtual nodes.
+
+Every node is placed on the ring VNodes*weight times. A key belongs to the first
+virtual node at or after the hash of the key. Adding or removing a node only
+moves the keys, that belong to its virtual nodes.
+
+The ring is safe for concurrent use.
+*/
+type Ring struct{
+	K1,K2  uint64 // SipHash keys. Must be the same on all routers.
+	VNodes int    // Virtual nodes per unit of weight. 0 -> DefaultVNodes.
+	
+	mu      sync.RWMutex
+	points  []point
+	weights map[string]int
+}
+
+/*
+Returns the hash of a key.
+*/
+func (r *Ring) Hash(key []byte) uint64 {
+	return siphash.Hash(r.K1,r.K2,key)
+}
+
+func (r *Ring) vnodes() int {
+	if r.VNodes>0 { return r.VNodes }
+	return DefaultVNodes
+}
+
+/*
+Returns the owner of key. Returns false, if the ring is empty.
+*/
+func (r *Ring) Node(key []byte) (string,bool) {
+	h := r.Hash(key)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return owner(r.points,h)
+}
+
+/*
+Returns up to n distinct nodes, that follow the hash of key on the ring. The
+first one is the owner.
+*/
+func (r *Ring) Replicas(key []byte, n int) []string {
+	h := r.Hash(key)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n>len(r.weights) { n = len(r.weights) }
+	if n<=0 || len(r.points)==0 { return nil }
+	i := sort.Search(len(r.points),func(i int) bool { return r.points[i].hash>=h })
+	return replicasAt(r.points,i,n)
+}
+
+/*
+Returns n distinct nodes, starting at the point i.
+*/
+func replicasAt(points []point, i, n int) []string {
+	nodes := make([]string,0,n)
+	for j := 0 ; j<len(points) && len(nodes)<n ; j++ {
+		node := points[(i+j)%len(points)].node
+		dup := false
+		for _,o := range nodes { dup = dup || o==node }
+		if !dup { nodes = append(nodes,node) }
+	}
+	return nodes
+}
+
+/*
+Returns the ranges of the ring and the replica sets of up to n nodes, that the
+keys in these ranges belong to (see Replicas). Adjacent ranges with the same
+replica set are merged. From and To are not set.
+*/
+func (r *Ring) Ranges(n int) (ranges []Range, replicas [][]string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n>len(r.weights) { n = len(r.weights) }
+	if n<=0 || len(r.points)==0 { return }
+	prev := r.points[len(r.points)-1].hash // The first range wraps around.
+	for i,p := range r.points {
+		if i!=0 && p.hash==prev { continue }
+		set := replicasAt(r.points,i,n)
+		if l := len(ranges); l!=0 && ranges[l-1].End==prev && sameNodes(replicas[l-1],set) {
+			ranges[l-1].End = p.hash
+		} else {
+			ranges = append(ranges,Range{Start:prev,End:p.hash})
+			replicas = append(replicas,set)
+		}
+		prev = p.hash
+	}
+	return
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a)!=len(b) { return false }
+	for i := range a {
+		if a[i]!=b[i] { return false }
+	}
+	return true
+}
+
+func owner(points []point, h uint64) (string,bool) {
+	if len(points)==0 { return "",false }
+	i := sort.Search(len(points),func(i int) bool { return points[i].hash>=h })
+	if i==len(points) { i = 0 }
+	return points[i].node,true
+}
+
+/*
+Returns the nodes and their weights.
+*/
+func (r *Ring) Nodes() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := make(map[string]int,len(r.weights))
+	for n,w := range r.weights { m[n] = w }
+	return m
+}
+
+/*
+Adds a node with the given weight, or changes the weight of a node. A weight
+of 0 or less removes the node. Returns the ranges, that changed their owner.
+*/
+func (r *Ring) Add(node string, weight int) []Range {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.weights==nil { r.weights = make(map[string]int) }
+	if weight<=0 {
+		delete(r.weights,node)
+	} else {
+		r.weights[node] = weight
+	}
+	return r.rebuild()
+}
+
+/*
+Removes a node. Returns the ranges, that changed their owner.
+*/
+func (r *Ring) Remove(node string) []Range {
+	return r.Add(node,0)
+}
+
+func (r *Ring) rebuild() []Range {
+	n := 0
+	for _,w := range r.weights { n += w*r.vnodes() }
+	points := make([]point,0,n)
+	var buf []byte
+	for node,w := range r.weights {
+		for i := 0 ; i<w*r.vnodes() ; i++ {
+			buf = strconv.AppendInt(append(append(buf[:0],node...),'#'),int64(i),10)
+			points = append(points,point{siphash.Hash(r.K1,r.K2,buf),node})
+		}
+	}
+	// Ties are broken by the node name, so that all routers agree.
+	sort.Slice(points,func(i,j int) bool {
+		if points[i].hash!=points[j].hash { return points[i].hash<points[j].hash }
+		return points[i].node<points[j].node
+	})
+	moved := diff(r.points,points)
+	r.points = points
+	return moved
+}
+
+/*
+Returns the ranges, whose owner in a differs from their owner in b.
+*/
+func diff(a, b []point) []Range {
+	bounds := make([]uint64,0,len(a)+len(b))
+	for _,p := range a { bounds = append(bounds,p.hash) }
+	for _,p := range b { bounds = append(bounds,p.hash) }
+	if len(bounds)==0 { return nil }
+	sort.Slice(bounds,func(i,j int) bool { return bounds[i]<bounds[j] })
+	
+	var moved []Range
+	prev := bounds[len(bounds)-1] // The first range wraps around.
+	for i,h := range bounds {
+		if i!=0 && h==bounds[i-1] { continue }
+		from,_ := owner(a,h)
+		to,_ := owner(b,h)
+		if from!=to {
+			if l := len(moved); l!=0 && moved[l-1].End==prev && moved[l-1].From==from && moved[l-1].To==to {
+				moved[l-1].End = h
+			} else {
+				moved = append(moved,Range{prev,h,from,to})
+			}
+		}
+		prev = h
+	}
+	return moved
+}
+
+var _ routing.ReplicaPlacement = (*Ring)(nil)
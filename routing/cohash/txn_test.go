@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package cohash
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+/*
+Returns count keys, each owned by a different node.
+*/
+func spread(t *testing.T, r *Router, count int) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for i := 0 ; i<1000 && len(keys)<count ; i++ {
+		k := fmt.Sprint("key",i)
+		if n := r.node([]byte(k)); !seen[n] {
+			seen[n] = true
+			keys = append(keys,k)
+		}
+	}
+	if len(keys)<count { t.Fatalf("found %d keys on different nodes",len(keys)) }
+	return keys
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	r,ns,cli := openRouter(t,3,nil)
+	ctx := context.Background()
+	keys := spread(t,r,3)
+	tx := cli.Begin()
+	for _,k := range keys { tx.Put([]byte(k),[]byte("v"+k),0) }
+	if err := tx.Commit(ctx); err!=nil { t.Fatal(err) }
+	for _,k := range keys {
+		if v := stored(t,ns,r.node([]byte(k)),k); v!="v"+k { t.Errorf("%s: %q",k,v) }
+	}
+	
+	// A check, that fails on one node, aborts the parts on the other nodes.
+	tx = cli.Begin()
+	if _,err := tx.Get(ctx,[]byte(keys[0])); err!=nil { t.Fatal(err) }
+	tx.Put([]byte(keys[1]),[]byte("x"),0)
+	tx.Put([]byte(keys[2]),[]byte("x"),0)
+	if err := cli.Put(ctx,[]byte(keys[0]),[]byte("changed")); err!=nil { t.Fatal(err) }
+	if err := tx.Commit(ctx); err!=client.ErrConflict { t.Fatalf("commit: %v",err) }
+	for _,k := range keys[1:] {
+		if v := stored(t,ns,r.node([]byte(k)),k); v!="v"+k { t.Errorf("%s after abort: %q",k,v) }
+		// The key is not locked anymore.
+		if err := cli.Put(ctx,[]byte(k),[]byte("y")); err!=nil { t.Errorf("put %s after abort: %v",k,err) }
+	}
+}
+
+/*
+A key, that is locked by another transaction on one node, fails the whole
+transaction. The parts on the other nodes are aborted.
+*/
+func TestTwoPhaseCommitPartialFailure(t *testing.T) {
+	r,ns,cli := openRouter(t,3,nil)
+	ctx := context.Background()
+	keys := spread(t,r,3)
+	
+	locked := client.Over(ns[r.node([]byte(keys[0]))],nil)
+	err := locked.Do(ctx,func(m *kvtp.Request) {
+		m.Cmd = kvtp.CMD_TxnPrepare
+		m.Val = append(m.Val,"other"...)
+		e := m.AddEntry()
+		e.Code = kvtp.TXN_Put
+		e.Key = append(e.Key,keys[0]...)
+	},nil)
+	if err!=nil { t.Fatal(err) }
+	
+	tx := cli.Begin()
+	for _,k := range keys { tx.Put([]byte(k),[]byte("x"),0) }
+	if err := tx.Commit(ctx); err==nil { t.Fatal("commit succeeded, though a key is locked") }
+	for _,k := range keys[1:] {
+		if v := stored(t,ns,r.node([]byte(k)),k); v!="" { t.Errorf("%s after abort: %q",k,v) }
+		if err := cli.Put(ctx,[]byte(k),[]byte("y")); err!=nil { t.Errorf("put %s after abort: %v",k,err) }
+	}
+	
+	// A node, that can't be reached, fails the transaction too.
+	delete(ns,r.node([]byte(keys[0])))
+	tx = cli.Begin()
+	for _,k := range keys { tx.Put([]byte(k),[]byte("z"),0) }
+	if err := tx.Commit(ctx); err==nil { t.Fatal("commit succeeded, though a node is down") }
+	for _,k := range keys[1:] {
+		if v := stored(t,ns,r.node([]byte(k)),k); v!="y" { t.Errorf("%s after abort: %q",k,v) }
+	}
+}
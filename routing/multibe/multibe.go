@@ -27,6 +27,9 @@ package multibe
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
 	"github.com/byte-mug/zrab2k/rpcmux"
 	"github.com/byte-mug/zrab2k/routing"
 )
@@ -45,6 +48,7 @@ type Client struct {
 	node string
 	nlck sync.Mutex
 	died <-chan struct{}
+	beating int32 // 1, while a heartbeat is pending.
 	
 	stream *rpcmux.Stream
 	client rpcmux.Client
@@ -68,11 +72,28 @@ func (c *Client) reinstantiate() error {
 	stream,err := c.parent.Dial(c.node)
 	if err!=nil { return err }
 	
+	if det := c.parent.Detector; det!=nil {
+		node := c.node
+		stream.OnReply = func(latency time.Duration) { det.Response(node,latency) }
+	}
 	c.stream = stream
 	c.died = stream.Die
 	c.client = stream.Client()
+	if c.parent.OnConnect!=nil { c.parent.OnConnect(c.node) }
 	return nil
 }
+
+/*
+Connects to the node, unless it is connected already. Can be used to check,
+whether the node is reachable.
+*/
+func (c *Client) Connect() error {
+	return c.reinstantiate()
+}
+/*
+Sends a request. Once the reply arrives, the response time is reported to the
+Detector of the Forwarder (see rpcmux.Stream.OnReply).
+*/
 func (c *Client) Request(msg rpcmux.Message, ctx context.Context) (resp *rpcmux.Response, err error) {
 	err = c.reinstantiate()
 	if err==nil {
@@ -81,40 +102,134 @@ func (c *Client) Request(msg rpcmux.Message, ctx context.Context) (resp *rpcmux.
 	return
 }
 
+/*
+Sends a heartbeat (CMD_Ping) and reports the response to the Detector of the
+Forwarder. Does nothing, while the previous heartbeat is pending.
+*/
+func (c *Client) heartbeat(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&c.beating,0,1) { return }
+	defer atomic.StoreInt32(&c.beating,0)
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_Ping
+	msg.Flags = kvtp.FLAG_NoRedirect
+	ctx,cancel := context.WithTimeout(context.Background(),timeout)
+	defer cancel()
+	_,release,err := routing.Call(c,msg,ctx)
+	if err!=nil { return }
+	release()
+	c.parent.Detector.Heartbeat(c.node)
+}
+
 type Forwarder struct {
 	Dial     Dialer
 	ReadOnly bool
+	Name     string // Forwarder-ID, used in CMD_Trace.
 	
-	ndmap map[string] *Client
-	ndmpl sync.Mutex
+	// Optional: Called, after a connection to a node has been established.
+	// Must not block.
+	OnConnect func(node string)
+	
+	// Optional: Watches the nodes, fed by Monitor.
+	Detector routing.FailureDetector
+	
+	ndmap atomic.Value // map[string] *Client, replaced on change.
+	ndmpl sync.Mutex // Serializes changes of ndmap.
+}
+func (s *Forwarder) clients() map[string] *Client {
+	m,_ := s.ndmap.Load().(map[string] *Client)
+	return m
 }
 func (s *Forwarder) create(node string) *Client {
 	s.ndmpl.Lock()
 	defer s.ndmpl.Unlock()
-	cl,ok := s.ndmap[node]
+	ndmap := s.clients()
+	cl,ok := ndmap[node]
 	if ok { return cl }
 	cl = &Client{parent:s,node:node,died:died}
-	nnmap := make(map[string] *Client,len(s.ndmap)+1)
-	for k,v := range s.ndmap { nnmap[k] = v }
+	nnmap := make(map[string] *Client,len(ndmap)+1)
+	for k,v := range ndmap { nnmap[k] = v }
 	nnmap[node] = cl
-	
-	// TODO: Compiler-Barrier.
-	s.ndmap = nnmap
+	s.ndmap.Store(nnmap)
+	if s.Detector!=nil { s.Detector.Watch(node) }
 	return cl
 }
 
+/*
+Sends a heartbeat to every node every interval and reports the responses to
+Detector, until die is closed. Heartbeats time out after 10 intervals.
+*/
+func (s *Forwarder) Monitor(interval time.Duration, die <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <- die: return
+		case <- t.C:
+		}
+		for _,cl := range s.clients() { go cl.heartbeat(10*interval) }
+	}
+}
+
+/*
+Adds a client for node, even if the Forwarder is ReadOnly. Implements
+routing.MemberListener.
+*/
+func (s *Forwarder) NodeJoined(node string) {
+	s.create(node)
+}
+
+/*
+Removes the client of node and closes its connection. Implements
+routing.MemberListener.
+*/
+func (s *Forwarder) NodeLeft(node string) {
+	s.ndmpl.Lock()
+	ndmap := s.clients()
+	cl,ok := ndmap[node]
+	if ok {
+		nnmap := make(map[string] *Client,len(ndmap))
+		for k,v := range ndmap {
+			if k!=node { nnmap[k] = v }
+		}
+		s.ndmap.Store(nnmap)
+	}
+	s.ndmpl.Unlock()
+	if !ok { return }
+	
+	// A dial in progress holds nlck, so don't block the caller.
+	go func() {
+		cl.nlck.Lock()
+		defer cl.nlck.Unlock()
+		if cl.stream!=nil && cl.stream.Close!=nil { cl.stream.Close() }
+	}()
+}
+
 func (s *Forwarder) Node(node string) (cl *Client,ok bool) {
-	cl,ok = s.ndmap[node]
+	cl,ok = s.clients()[node]
 	if !(ok || s.ReadOnly) {
 		cl = s.create(node)
 		ok = true
 	}
 	return
 }
+func (s *Forwarder) NodeClient(node string) (rpcmux.Client,bool) {
+	cl,ok := s.Node(node)
+	if !ok { return nil,false }
+	return cl,true
+}
 func (s *Forwarder) RedirectRead(other string,req *rpcmux.Request) bool {
+	kvr,_ := req.Msg.(*kvtp.Request)
 	cli,ok := s.Node(other)
-	if !ok { return false }
-	return routing.Forward(req,cli)!=nil
+	if !ok {
+		if kvr!=nil { kvr.AddHop(s.Name,"forwarder","unknown "+other,req.Received()) }
+		return false
+	}
+	if kvr!=nil { kvr.AddHop(s.Name,"forwarder","forward "+other,req.Received()) }
+	err := routing.Forward(req,cli)
+	if err!=nil && kvr!=nil {
+		kvr.AddHop(s.Name,"forwarder",kvtp.ErrName(routing.ErrCode(err))+" "+err.Error(),req.Received())
+	}
+	return err==nil
 }
 
 type Selector struct{
@@ -122,8 +237,38 @@ type Selector struct{
 	routing.NodeGoodness
 	Nodes []string
 	MinGoodness uint64
+	
+	mu sync.RWMutex // Guards Nodes against NodeJoined and NodeLeft.
 }
-func (s *Selector) RedirectWrite(req *rpcmux.Request) (string,bool) {
+
+/*
+Adds node to Nodes. Implements routing.MemberListener.
+*/
+func (s *Selector) NodeJoined(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _,n := range s.Nodes {
+		if n==node { return }
+	}
+	s.Nodes = append(s.Nodes[:len(s.Nodes):len(s.Nodes)],node)
+}
+
+/*
+Removes node from Nodes. Implements routing.MemberListener.
+*/
+func (s *Selector) NodeLeft(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := make([]string,0,len(s.Nodes))
+	for _,n := range s.Nodes {
+		if n!=node { nodes = append(nodes,n) }
+	}
+	s.Nodes = nodes
+}
+
+func (s *Selector) SelectNode() (string,bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	cur := ""
 	goodness := uint64(0)
 	for _,n := range s.Nodes {
@@ -134,6 +279,11 @@ func (s *Selector) RedirectWrite(req *rpcmux.Request) (string,bool) {
 		}
 	}
 	if goodness<=s.MinGoodness || len(cur)==0 { return "",false }
+	return cur,true
+}
+func (s *Selector) RedirectWrite(req *rpcmux.Request) (string,bool) {
+	cur,ok := s.SelectNode()
+	if !ok { return "",false }
 	if s.RedirectRead(cur,req) { return cur,true }
 	return "",false
 }
@@ -0,0 +1,261 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+The phi-accrual failure detector (Hayashibara et al.): Instead of a boolean,
+the suspicion of a node is a level phi, derived from the distribution of the
+intervals between its past heartbeats. phi=1 means, the probability, that the
+node is alive and the next heartbeat is just late, is 10%, phi=2 means 1%, etc.
+
+Besides heartbeats, every response of a node is a sign of life. Its response
+times lower its goodness.
+
+Nodes, that are flapping (their phi exceeds Threshold repeatedly), are
+penalized, like by route flap damping: Every recovery adds half of Threshold to
+the penalty of the node, which halves every FlapHalfLife. The suspicion of a node
+is the maximum of its phi and its penalty. So a single outage is forgotten,
+but a node, that recovered three times within a FlapHalfLife, stays suspected.
+*/
+package phi
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/* Defaults of Detector. */
+const (
+	DefaultThreshold     = 8.0
+	DefaultWindow        = 100
+	DefaultMinStdDev     = 100*time.Millisecond
+	DefaultFirstInterval = time.Second
+	DefaultFlapHalfLife  = time.Minute
+	DefaultLatencyScale  = 100*time.Millisecond
+)
+
+/*
+The heartbeats of a node.
+*/
+type history struct{
+	intervals []float64 // Seconds, a ring buffer.
+	next      int
+	sum,sumSq float64
+	last      time.Time // Of the last heartbeat or response.
+	beat      time.Time // Of the last heartbeat.
+	latency   float64 // Seconds, moving average of the response times.
+	penalty   float64
+	penaltyAt time.Time
+}
+
+func (h *history) add(iv float64, window int) {
+	if len(h.intervals)<window {
+		h.intervals = append(h.intervals,iv)
+	} else {
+		old := h.intervals[h.next]
+		h.sum -= old
+		h.sumSq -= old*old
+		h.intervals[h.next] = iv
+		h.next = (h.next+1)%window
+	}
+	h.sum += iv
+	h.sumSq += iv*iv
+}
+
+/*
+A phi-accrual failure detector. Implements routing.FailureDetector and
+routing.NodeGoodness: Nodes, whose suspicion is Threshold or higher, have
+goodness 0, the others between 1 and 1001 (no suspicion, instant responses).
+Nodes, that are not watched, have goodness 1: Nothing is known about them, so
+they are not preferred.
+
+Detector is safe for concurrent use.
+*/
+type Detector struct{
+	Threshold     float64 // 0 -> DefaultThreshold.
+	Window        int // Number of intervals, phi is derived from. 0 -> DefaultWindow.
+	MinStdDev     time.Duration // Lower bound of the standard deviation of the intervals. 0 -> DefaultMinStdDev.
+	FirstInterval time.Duration // Expected interval, before the first one has been measured. 0 -> DefaultFirstInterval.
+	FlapHalfLife  time.Duration // 0 -> DefaultFlapHalfLife.
+	LatencyScale  time.Duration // The goodness halves at this average response time. 0 -> DefaultLatencyScale.
+	
+	mu    sync.Mutex
+	nodes map[string]*history
+}
+
+func (d *Detector) threshold() float64 {
+	if d.Threshold>0 { return d.Threshold }
+	return DefaultThreshold
+}
+
+func (d *Detector) history(node string) *history {
+	if d.nodes==nil { d.nodes = make(map[string]*history) }
+	h,ok := d.nodes[node]
+	if !ok {
+		h = new(history)
+		d.nodes[node] = h
+	}
+	return h
+}
+
+/*
+Starts watching node, as if it had sent a heartbeat, unless it is watched already.
+A node, that never sends a heartbeat, is suspected eventually.
+*/
+func (d *Detector) Watch(node string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h := d.history(node); h.last.IsZero() {
+		h.last = time.Now()
+		h.beat = h.last
+	}
+}
+
+/*
+Records a sign of life of h at now. A recovery raises the flap penalty.
+*/
+func (d *Detector) alive(h *history, now time.Time) {
+	if !h.last.IsZero() && d.phi(h,now)>=d.threshold() {
+		h.penalty = d.penalty(h,now)+d.threshold()/2
+		h.penaltyAt = now
+	}
+	h.last = now
+}
+
+/*
+Records a heartbeat of node.
+*/
+func (d *Detector) Heartbeat(node string) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.history(node)
+	d.alive(h,now)
+	
+	// After a recovery, the outage is not a regular interval, so it is not added.
+	if !h.beat.IsZero() && !h.penaltyAt.After(h.beat) {
+		w := d.Window
+		if w<=0 { w = DefaultWindow }
+		h.add(now.Sub(h.beat).Seconds(),w)
+	}
+	h.beat = now
+}
+
+/*
+Records a response of node, that took latency.
+*/
+func (d *Detector) Response(node string, latency time.Duration) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.history(node)
+	d.alive(h,now)
+	if h.latency==0 {
+		h.latency = latency.Seconds()
+	} else {
+		h.latency += (latency.Seconds()-h.latency)/8
+	}
+}
+
+/*
+Stops watching node.
+*/
+func (d *Detector) Forget(node string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes,node)
+}
+
+/*
+Returns phi of h at now.
+*/
+func (d *Detector) phi(h *history, now time.Time) float64 {
+	if h.last.IsZero() { return 0 }
+	var mean,std float64
+	if n := float64(len(h.intervals)); n!=0 {
+		mean = h.sum/n
+		std = math.Sqrt(math.Max(h.sumSq/n-mean*mean,0))
+	} else {
+		mean = d.FirstInterval.Seconds()
+		if mean<=0 { mean = DefaultFirstInterval.Seconds() }
+		std = mean/4
+	}
+	min := d.MinStdDev.Seconds()
+	if min<=0 { min = DefaultMinStdDev.Seconds() }
+	if std<min { std = min }
+	
+	// The logistic approximation of the normal distribution, as in Akka.
+	t := now.Sub(h.last).Seconds()
+	y := (t-mean)/std
+	e := math.Exp(-y*(1.5976+0.070566*y*y))
+	if t>mean { return -math.Log10(e/(1+e)) }
+	return -math.Log10(1-1/(1+e))
+}
+
+/*
+Returns the flap penalty of h at now.
+*/
+func (d *Detector) penalty(h *history, now time.Time) float64 {
+	if h.penalty==0 { return 0 }
+	hl := d.FlapHalfLife
+	if hl<=0 { hl = DefaultFlapHalfLife }
+	return h.penalty*math.Exp2(-now.Sub(h.penaltyAt).Seconds()/hl.Seconds())
+}
+
+/*
+Returns phi of node. 0, if node is not watched.
+*/
+func (d *Detector) Phi(node string) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h,ok := d.nodes[node]
+	if !ok { return 0 }
+	return d.phi(h,time.Now())
+}
+
+/*
+Returns the maximum of phi and the flap penalty of node.
+*/
+func (d *Detector) Suspicion(node string) float64 {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h,ok := d.nodes[node]
+	if !ok { return 0 }
+	return math.Max(d.phi(h,now),d.penalty(h,now))
+}
+
+func (d *Detector) RequestGoodness(other string) uint64 {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h,ok := d.nodes[other]
+	if !ok { return 1 }
+	s,th := math.Max(d.phi(h,now),d.penalty(h,now)),d.threshold()
+	if s>=th { return 0 }
+	scale := d.LatencyScale.Seconds()
+	if scale<=0 { scale = DefaultLatencyScale.Seconds() }
+	return 1+uint64(1000*(1-s/th)*scale/(scale+h.latency))
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package phi
+
+import (
+	"testing"
+	"time"
+)
+
+func testDetector() *Detector {
+	return &Detector{FirstInterval:10*time.Millisecond,MinStdDev:time.Millisecond,FlapHalfLife:time.Hour}
+}
+
+/*
+Lets node miss its heartbeats, until it is suspected, and recover.
+*/
+func outage(t *testing.T, d *Detector, node string) {
+	for i := 0 ; d.RequestGoodness(node)!=0 ; i++ {
+		if i==100 { t.Fatal("never suspected") }
+		time.Sleep(10*time.Millisecond)
+	}
+	d.Heartbeat(node)
+}
+
+func TestUnwatchedNodeNotPreferred(t *testing.T) {
+	d := testDetector()
+	d.Watch("a")
+	if g,u := d.RequestGoodness("a"),d.RequestGoodness("b"); u!=1 || g<=u {
+		t.Fatalf("goodness: watched %d, unwatched %d",g,u)
+	}
+}
+
+func TestFlapping(t *testing.T) {
+	d := testDetector()
+	d.Watch("a")
+	outage(t,d,"a")
+	if d.RequestGoodness("a")==0 { t.Fatal("suppressed after a single outage") }
+	outage(t,d,"a")
+	outage(t,d,"a")
+	if d.RequestGoodness("a")!=0 { t.Fatal("not suppressed after three outages") }
+}
+
+func TestResponseTime(t *testing.T) {
+	d := testDetector()
+	d.Response("fast",time.Millisecond)
+	d.Response("slow",time.Second)
+	if f,s := d.RequestGoodness("fast"),d.RequestGoodness("slow"); f<=s || s==0 {
+		t.Fatalf("goodness: fast %d, slow %d",f,s)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package routing
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"github.com/dchest/siphash"
+)
+
+/*
+Maps keys to nodes. Implemented by cohash.Ring, HRW and Jump.
+
+	Strategy  Lookup    Moved keys on change       Weights
+	Ring      O(log n)  ~1/n, any node             yes
+	HRW       O(n)      ~1/n, any node             yes
+	Jump      O(log n)  ~1/n, only the last node   no
+*/
+type Placement interface{
+	// Returns the owner of key. Returns false, if there are no nodes.
+	Node(key []byte) (string,bool)
+}
+
+/*
+A Placement, that places a key on several nodes (replicas).
+*/
+type ReplicaPlacement interface{
+	Placement
+	
+	// Returns up to n distinct nodes for key. The first one is the owner (see Node).
+	Replicas(key []byte, n int) []string
+}
+
+/*
+A 64 bit mixing function (the finalizer of SplitMix64).
+*/
+func mix64(x uint64) uint64 {
+	x ^= x>>30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x>>27
+	x *= 0x94d049bb133111eb
+	x ^= x>>31
+	return x
+}
+
+type hrwNode struct{
+	name   string
+	seed   uint64
+	weight float64
+}
+
+/*
+Rendezvous hashing (highest random weight): Every node gets a score for the key,
+the node with the highest score owns it. The score is weighted, so a node owns a
+share of the keys proportional to its weight.
+
+HRW is safe for concurrent use.
+*/
+type HRW struct{
+	K1,K2 uint64 // SipHash keys. Must be the same on all routers.
+	
+	mu    sync.RWMutex
+	nodes []hrwNode
+}
+
+/*
+Adds a node with the given weight, or changes the weight of a node. A weight
+of 0 or less removes the node.
+*/
+func (h *HRW) Add(node string, weight float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nodes := make([]hrwNode,0,len(h.nodes)+1)
+	for _,n := range h.nodes {
+		if n.name!=node { nodes = append(nodes,n) }
+	}
+	if weight>0 {
+		nodes = append(nodes,hrwNode{node,siphash.Hash(h.K1,h.K2,[]byte(node)),weight})
+	}
+	h.nodes = nodes
+}
+
+/*
+Removes a node.
+*/
+func (h *HRW) Remove(node string) {
+	h.Add(node,0)
+}
+
+/*
+Returns the weighted score of node n for the key hash kh.
+*/
+func (n *hrwNode) score(kh uint64) float64 {
+	// u is uniform in (0,1). -weight/ln(u) is the weighted score.
+	u := (float64(mix64(kh^n.seed)>>11)+0.5)/(1<<53)
+	return -n.weight/math.Log(u)
+}
+
+func (h *HRW) Node(key []byte) (string,bool) {
+	kh := siphash.Hash(h.K1,h.K2,key)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	best,score := "",math.Inf(-1)
+	for i := range h.nodes {
+		n := &h.nodes[i]
+		s := n.score(kh)
+		if s>score || (s==score && n.name<best) { best,score = n.name,s }
+	}
+	return best,len(h.nodes)!=0
+}
+
+/*
+Returns the n nodes with the highest scores, the highest first.
+*/
+func (h *HRW) Replicas(key []byte, n int) []string {
+	kh := siphash.Hash(h.K1,h.K2,key)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	type scored struct{
+		name  string
+		score float64
+	}
+	all := make([]scored,len(h.nodes))
+	for i := range h.nodes {
+		all[i] = scored{h.nodes[i].name,h.nodes[i].score(kh)}
+	}
+	sort.Slice(all,func(i,j int) bool {
+		if all[i].score!=all[j].score { return all[i].score>all[j].score }
+		return all[i].name<all[j].name
+	})
+	if n>len(all) { n = len(all) }
+	nodes := make([]string,n)
+	for i := range nodes { nodes[i] = all[i].name }
+	return nodes
+}
+
+/*
+Jump consistent hashing (Lamping, Veach). It needs no memory besides the list of
+nodes, but nodes can only be appended or removed at the end of Nodes, without
+moving more keys than necessary.
+
+Nodes must not be modified, while Node is called.
+*/
+type Jump struct{
+	K1,K2 uint64 // SipHash keys. Must be the same on all routers.
+	Nodes []string
+}
+
+func (j *Jump) Node(key []byte) (string,bool) {
+	n := len(j.Nodes)
+	if n==0 { return "",false }
+	return j.Nodes[JumpHash(siphash.Hash(j.K1,j.K2,key),n)],true
+}
+
+/*
+Returns the owner and the nodes, that follow it in Nodes.
+*/
+func (j *Jump) Replicas(key []byte, n int) []string {
+	l := len(j.Nodes)
+	if n>l { n = l }
+	if n<=0 { return nil }
+	b := JumpHash(siphash.Hash(j.K1,j.K2,key),l)
+	nodes := make([]string,n)
+	for i := range nodes { nodes[i] = j.Nodes[(b+i)%l] }
+	return nodes
+}
+
+/*
+Maps key to a bucket in [0,buckets).
+*/
+func JumpHash(key uint64, buckets int) int {
+	var b,j int64 = -1,0
+	for j<int64(buckets) {
+		b = j
+		key = key*2862933555777941757+1
+		j = int64(float64(b+1)*(float64(int64(1)<<31)/float64((key>>33)+1)))
+	}
+	return int(b)
+}
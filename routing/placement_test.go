@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package routing_test
+
+import (
+	"fmt"
+	"testing"
+	"github.com/byte-mug/zrab2k/routing"
+	"github.com/byte-mug/zrab2k/routing/cohash"
+)
+
+/* Number of nodes in the benchmarks. */
+const benchNodes = 16
+
+func benchNode(i int) string { return fmt.Sprint("node",i) }
+
+func benchKeys(n int) [][]byte {
+	keys := make([][]byte,n)
+	for i := range keys { keys[i] = []byte(fmt.Sprint("key",i)) }
+	return keys
+}
+
+/*
+A Placement of benchNodes nodes, and the changes, that are benchmarked.
+*/
+type bench struct{
+	p              routing.Placement
+	add,unadd      func() // Adds a node, and removes it again.
+	remove,restore func() // Removes a node, and adds it again.
+}
+
+func benchRing() *bench {
+	r := &cohash.Ring{K1:1,K2:2}
+	for i := 0 ; i<benchNodes ; i++ { r.Add(benchNode(i),1) }
+	return &bench{
+		p:r,
+		add:func() { r.Add(benchNode(benchNodes),1) },
+		unadd:func() { r.Remove(benchNode(benchNodes)) },
+		remove:func() { r.Remove(benchNode(benchNodes/2)) },
+		restore:func() { r.Add(benchNode(benchNodes/2),1) },
+	}
+}
+
+func benchHRW() *bench {
+	h := &routing.HRW{K1:1,K2:2}
+	for i := 0 ; i<benchNodes ; i++ { h.Add(benchNode(i),1) }
+	return &bench{
+		p:h,
+		add:func() { h.Add(benchNode(benchNodes),1) },
+		unadd:func() { h.Remove(benchNode(benchNodes)) },
+		remove:func() { h.Remove(benchNode(benchNodes/2)) },
+		restore:func() { h.Add(benchNode(benchNodes/2),1) },
+	}
+}
+
+/* Only the last node can be removed, without moving the keys of others. */
+func benchJump() *bench {
+	j := &routing.Jump{K1:1,K2:2}
+	for i := 0 ; i<benchNodes ; i++ { j.Nodes = append(j.Nodes,benchNode(i)) }
+	nodes := j.Nodes
+	return &bench{
+		p:j,
+		add:func() { j.Nodes = append(nodes[:benchNodes:benchNodes],benchNode(benchNodes)) },
+		unadd:func() { j.Nodes = nodes },
+		remove:func() { j.Nodes = nodes[:benchNodes-1] },
+		restore:func() { j.Nodes = nodes },
+	}
+}
+
+var placements = []struct{
+	name string
+	new  func() *bench
+}{
+	{"Ring",benchRing},
+	{"HRW",benchHRW},
+	{"Jump",benchJump},
+}
+
+/*
+Times change and undo, and reports the share of keys, that change moves to
+another node, as "moved/key".
+*/
+func benchChange(b *testing.B, p routing.Placement, change, undo func()) {
+	keys := benchKeys(10000)
+	owners := make([]string,len(keys))
+	for i,k := range keys { owners[i],_ = p.Node(k) }
+	change()
+	moved := 0
+	for i,k := range keys {
+		if o,_ := p.Node(k); o!=owners[i] { moved++ }
+	}
+	undo()
+	b.ResetTimer()
+	for i := 0 ; i<b.N ; i++ {
+		change()
+		undo()
+	}
+	b.ReportMetric(float64(moved)/float64(len(keys)),"moved/key")
+}
+
+func BenchmarkNode(b *testing.B) {
+	for _,pl := range placements {
+		p := pl.new().p
+		b.Run(pl.name,func(b *testing.B) {
+			keys := benchKeys(1024)
+			b.ResetTimer()
+			for i := 0 ; i<b.N ; i++ { p.Node(keys[i%len(keys)]) }
+		})
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for _,pl := range placements {
+		x := pl.new()
+		b.Run(pl.name,func(b *testing.B) { benchChange(b,x.p,x.add,x.unadd) })
+	}
+}
+
+func BenchmarkRemove(b *testing.B) {
+	for _,pl := range placements {
+		x := pl.new()
+		b.Run(pl.name,func(b *testing.B) { benchChange(b,x.p,x.remove,x.restore) })
+	}
+}
@@ -25,6 +25,9 @@ SOFTWARE.
 package routing
 
 import (
+	"context"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
 	"github.com/byte-mug/zrab2k/rpcmux"
 )
 
@@ -39,15 +42,105 @@ type RedirectWriter interface{
 	RedirectWrite(req *rpcmux.Request) (string,bool)
 }
 
+/*
+Provides a client for a particular node, backend, etc...
+
+Unlike RedirectReader, this allows the caller to issue its own requests and
+to process the responses, instead of forwarding the whole request.
+*/
+type NodeClients interface{
+	NodeClient(other string) (rpcmux.Client,bool)
+}
+
+/*
+Selects a node, writes can be redirected to.
+*/
+type NodeSelector interface{
+	SelectNode() (string,bool)
+}
+
 type NodeGoodness interface{
 	RequestGoodness(other string) uint64
 }
 
+/*
+A failure detector, that is fed with heartbeats (see phi.Detector). The
+goodness of a node decreases, the more it is suspected to have failed.
+*/
+type FailureDetector interface{
+	NodeGoodness
+	
+	// Starts watching node, as if it had sent a heartbeat.
+	Watch(node string)
+	
+	// Records a heartbeat of node.
+	Heartbeat(node string)
+	
+	// Records a response of node, that took latency.
+	Response(node string, latency time.Duration)
+}
+
+/*
+Is notified about changes of the cluster membership (see swim.Members), so the
+set of nodes can change without reconfiguration. Must not block.
+*/
+type MemberListener interface{
+	// node has joined the cluster, or has become alive again.
+	NodeJoined(node string)
+	
+	// node has left the cluster, or has been declared dead.
+	NodeLeft(node string)
+}
+
+/*
+Stores writes for nodes, that are unavailable, and replays them later (hinted
+handoff). msg is a CMD_HintedHandoff request.
+*/
+type HintStore interface{
+	Hint(node string, msg *kvtp.Request) error
+}
+
+/*
+Maps an error to a kvtp error code.
+*/
+func ErrCode(err error) uint8 {
+	switch err {
+	case context.DeadlineExceeded,context.Canceled: return kvtp.ERR_Timeout
+	}
+	return kvtp.ERR_RedirectFailed
+}
+
+/*
+Replies with an error, if the default response is a *kvtp.Response, or with the
+default response otherwise.
+*/
+func ReplyError(req *rpcmux.Request, code uint8, msg string) {
+	resp := req.DefaultResponse()
+	if resp==nil { return }
+	if kvr,ok := resp.(*kvtp.Response); ok {
+		kvr.SetError(code,msg)
+	}
+	req.Reply(resp)
+}
+
+/*
+Relays the response, including partial replies, to req.
+*/
 func ForwardResponse(resp *rpcmux.Response, req *rpcmux.Request) {
 	defer req.Release()
-	msg,_ := resp.Get()
+	defer resp.Release()
+	for {
+		part,err := resp.Next()
+		if part==nil || err!=nil { break }
+		resp.RetainPart()
+		if !req.ReplyPartial(part) { return }
+	}
+	msg,err := resp.Get()
 	if msg!=nil {
+		resp.RetainMsg()
 		req.Reply(msg)
+	} else if err!=nil {
+		ReplyError(req,ErrCode(err),err.Error())
 	} else {
 		req.ReplyDefault()
 	}
@@ -57,8 +150,9 @@ func Forward(req *rpcmux.Request, cli rpcmux.Client) error {
 	resp,err := cli.Request(req.Msg,req.Context())
 	if err!=nil { return err }
 	if resp==nil {
-		req.ReplyDefault()
+		ReplyError(req,kvtp.ERR_RedirectFailed,"No response")
 		req.Release()
+		return nil
 	}
 	go ForwardResponse(resp,req)
 	return nil
@@ -0,0 +1,587 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+Cluster membership with SWIM (Das, Gupta, Motivala): Every node probes a
+random member per ProbeInterval with CMD_Ping. If the member does not answer,
+other members are asked to probe it (CMD_PingReq). If they fail as well, the
+member is suspected, and declared dead, unless it refutes the suspicion within
+SuspectTimeout. Changes of the membership are piggybacked on the probes and
+their responses (gossip), so they spread without extra messages.
+
+Changes are pushed into routers and selectors through routing.MemberListener,
+so nodes can join and leave without reconfiguration.
+*/
+package swim
+
+import (
+	"context"
+	"errors"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/routing"
+)
+
+/* Defaults of Members. */
+const (
+	DefaultProbeInterval  = time.Second
+	DefaultProbeTimeout   = 500*time.Millisecond
+	DefaultIndirectProbes = 3
+	DefaultSuspectTimeout = 5*time.Second
+	DefaultMaxGossip      = 8
+)
+
+var errUnknownNode = errors.New("Unknown node")
+
+type State uint8
+const (
+	Alive   State = kvtp.MEMBER_Alive
+	Suspect State = kvtp.MEMBER_Suspect
+	Dead    State = kvtp.MEMBER_Dead
+)
+func (s State) String() string {
+	switch s {
+	case Alive: return "alive"
+	case Suspect: return "suspect"
+	case Dead: return "dead"
+	}
+	return "unknown"
+}
+
+type Member struct{
+	Name        string
+	Role        string
+	State       State
+	Incarnation uint64 // Increased by the member, to refute a suspicion.
+	Since       time.Time // Time of the last change of State.
+}
+
+type subscriber struct{
+	role string
+	l    routing.MemberListener
+}
+
+type event struct{
+	node,role string
+	joined    bool
+}
+
+/*
+The member list of a node.
+
+Members must be reachable through NC by their Name, so Name is the address of
+the node, like the peers in the configuration of zrab2kd. The requests of the
+node must be passed through Serve (or Process), so CMD_Ping and CMD_PingReq
+are answered.
+
+Members implements routing.NodeGoodness: Alive members have goodness 2,
+suspected and unknown ones 1, dead ones 0.
+*/
+type Members struct{
+	Name  string // Address of this node.
+	Role  string // Announced to the other members, see Subscribe.
+	NC    routing.NodeClients
+	Seeds []string // Nodes to join the cluster through.
+	
+	ProbeInterval  time.Duration // 0 -> DefaultProbeInterval.
+	ProbeTimeout   time.Duration // 0 -> DefaultProbeTimeout.
+	IndirectProbes int // Members asked to probe a member, that did not answer. 0 -> DefaultIndirectProbes.
+	SuspectTimeout time.Duration // 0 -> DefaultSuspectTimeout.
+	MaxGossip      int // Updates piggybacked on a message. 0 -> DefaultMaxGossip.
+	
+	once        sync.Once
+	mu          sync.Mutex
+	members     map[string]*Member
+	incarnation uint64
+	left        bool
+	gossip      map[string]int // Member -> remaining transmissions of its state.
+	probes      []string
+	events      []event
+	subs        []subscriber
+	nmu         sync.Mutex // Serializes the notification of the subscribers.
+}
+
+func (m *Members) init() {
+	m.once.Do(func() {
+		m.members = make(map[string]*Member)
+		m.gossip = make(map[string]int)
+	})
+}
+
+func (m *Members) probeInterval() time.Duration {
+	if m.ProbeInterval>0 { return m.ProbeInterval }
+	return DefaultProbeInterval
+}
+func (m *Members) probeTimeout() time.Duration {
+	if m.ProbeTimeout>0 { return m.ProbeTimeout }
+	return DefaultProbeTimeout
+}
+func (m *Members) suspectTimeout() time.Duration {
+	if m.SuspectTimeout>0 { return m.SuspectTimeout }
+	return DefaultSuspectTimeout
+}
+
+/*
+Calls l.NodeJoined and l.NodeLeft, if a member with the given role joins or
+leaves ("" -> any role). l.NodeJoined is called for the alive members at once.
+*/
+func (m *Members) Subscribe(role string, l routing.MemberListener) {
+	m.init()
+	m.nmu.Lock()
+	defer m.nmu.Unlock()
+	m.mu.Lock()
+	m.subs = append(m.subs,subscriber{role,l})
+	var alive []string
+	for _,mb := range m.members {
+		if mb.State!=Dead && (role=="" || role==mb.Role) { alive = append(alive,mb.Name) }
+	}
+	m.mu.Unlock()
+	sort.Strings(alive)
+	for _,n := range alive { l.NodeJoined(n) }
+}
+
+/*
+Notifies the subscribers about the pending events.
+*/
+func (m *Members) notify() {
+	m.nmu.Lock()
+	defer m.nmu.Unlock()
+	m.mu.Lock()
+	events,subs := m.events,m.subs
+	m.events = nil
+	m.mu.Unlock()
+	for _,ev := range events {
+		for _,s := range subs {
+			if s.role!="" && s.role!=ev.role { continue }
+			if ev.joined {
+				s.l.NodeJoined(ev.node)
+			} else {
+				s.l.NodeLeft(ev.node)
+			}
+		}
+	}
+}
+
+/*
+Returns the members, except this node, sorted by name.
+*/
+func (m *Members) Members() []Member {
+	m.init()
+	m.mu.Lock()
+	list := make([]Member,0,len(m.members))
+	for _,mb := range m.members { list = append(list,*mb) }
+	m.mu.Unlock()
+	sort.Slice(list,func(i,j int) bool { return list[i].Name<list[j].Name })
+	return list
+}
+
+func (m *Members) RequestGoodness(other string) uint64 {
+	m.init()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if other==m.Name {
+		if m.left { return 0 }
+		return 2
+	}
+	mb,ok := m.members[other]
+	if !ok { return 1 }
+	switch mb.State {
+	case Alive: return 2
+	case Suspect: return 1
+	}
+	return 0
+}
+
+/*
+Number of messages, an update is piggybacked on: 3*log2(n+1).
+*/
+func (m *Members) transmissions() int {
+	return 3*bits.Len(uint(len(m.members)+1))
+}
+
+/*
+Sets the state of a member and schedules the change for gossip and
+notification. m.mu must be held.
+*/
+func (m *Members) set(mb *Member, state State, inc uint64) {
+	was := mb.State
+	mb.State,mb.Incarnation = state,inc
+	if state!=was { mb.Since = time.Now() }
+	m.gossip[mb.Name] = m.transmissions()
+	switch {
+	case state==Dead && was!=Dead: m.events = append(m.events,event{mb.Name,mb.Role,false})
+	case state!=Dead && was==Dead: m.events = append(m.events,event{mb.Name,mb.Role,true})
+	}
+}
+
+/*
+Applies an update. m.mu must be held.
+*/
+func (m *Members) apply(e *kvtp.Entry) {
+	name,state,inc := string(e.Key),State(e.Code),e.Version
+	if name=="" { return }
+	if name==m.Name {
+		// Refute the suspicion. This node is the first Entry of every message.
+		if state!=Alive && inc>=m.incarnation && !m.left { m.incarnation = inc+1 }
+		return
+	}
+	mb,ok := m.members[name]
+	switch state {
+	case Alive:
+		if !ok {
+			mb = &Member{Name:name,State:Dead}
+			m.members[name] = mb
+		} else if inc<=mb.Incarnation {
+			return
+		}
+		mb.Role = string(e.Val)
+		m.set(mb,Alive,inc)
+	case Suspect:
+		if !ok || mb.State==Dead { return }
+		if inc<mb.Incarnation || (inc==mb.Incarnation && mb.State==Suspect) { return }
+		m.set(mb,Suspect,inc)
+	case Dead:
+		if !ok || mb.State==Dead || inc<mb.Incarnation { return }
+		m.set(mb,Dead,inc)
+	}
+}
+
+/*
+Applies the updates of a message. from is the sender. Returns true, if the
+sender was not known to be alive.
+*/
+func (m *Members) receive(from string, entries []kvtp.Entry) (isNew bool) {
+	m.mu.Lock()
+	if from!="" && from!=m.Name {
+		mb,ok := m.members[from]
+		isNew = !ok || mb.State==Dead
+		// A dead node, that came back, must learn about it to refute.
+		if ok && mb.State==Dead { m.gossip[from] = m.transmissions() }
+	}
+	for i := range entries { m.apply(&entries[i]) }
+	m.mu.Unlock()
+	m.notify()
+	return
+}
+
+func (m *Members) self(add func() *kvtp.Entry) {
+	e := add()
+	e.Key = append(e.Key,m.Name...)
+	e.Val = append(e.Val,m.Role...)
+	e.Code = kvtp.MEMBER_Alive
+	if m.left { e.Code = kvtp.MEMBER_Dead }
+	e.Version = m.incarnation
+}
+
+/*
+Adds this node and the updates to gossip (all members, if full is set).
+*/
+func (m *Members) updates(add func() *kvtp.Entry, full bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.self(add)
+	var names []string
+	if full {
+		for name := range m.members { names = append(names,name) }
+	} else {
+		for name := range m.gossip { names = append(names,name) }
+		// The updates, that have been sent least often, first.
+		sort.Slice(names,func(i,j int) bool { return m.gossip[names[i]]>m.gossip[names[j]] })
+		max := m.MaxGossip
+		if max<=0 { max = DefaultMaxGossip }
+		if len(names)>max { names = names[:max] }
+		for _,name := range names {
+			if m.gossip[name]--; m.gossip[name]<=0 { delete(m.gossip,name) }
+		}
+	}
+	for _,name := range names {
+		mb,ok := m.members[name]
+		if !ok { continue }
+		e := add()
+		e.Key = append(e.Key,mb.Name...)
+		e.Val = append(e.Val,mb.Role...)
+		e.Code = uint8(mb.State)
+		e.Version = mb.Incarnation
+	}
+}
+
+func (m *Members) request(cmd uint8) *kvtp.Request {
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = cmd
+	msg.Flags = kvtp.FLAG_NoRedirect
+	msg.Key = append(msg.Key,m.Name...)
+	m.updates(msg.AddEntry,false)
+	return msg
+}
+
+/*
+Sends msg to node and applies the updates of the response.
+*/
+func (m *Members) call(node string, msg *kvtp.Request, timeout time.Duration) error {
+	cli,ok := m.NC.NodeClient(node)
+	if !ok { return errUnknownNode }
+	ctx,cancel := context.WithTimeout(context.Background(),timeout)
+	defer cancel()
+	resp,release,err := routing.Call(cli,msg,ctx)
+	if err!=nil { return err }
+	defer release()
+	if resp.Code!=kvtp.RESP_Entries { return errors.New(kvtp.ErrName(resp.Err)+" "+string(resp.Val)) }
+	from := ""
+	if len(resp.Entries)!=0 { from = string(resp.Entries[0].Key) }
+	m.receive(from,resp.Entries)
+	return nil
+}
+
+/*
+Pings node directly.
+*/
+func (m *Members) ping(node string) bool {
+	return m.call(node,m.request(kvtp.CMD_Ping),m.probeTimeout())==nil
+}
+
+/*
+Asks up to IndirectProbes members to ping node.
+*/
+func (m *Members) pingIndirect(node string) bool {
+	k := m.IndirectProbes
+	if k<=0 { k = DefaultIndirectProbes }
+	var helpers []string
+	m.mu.Lock()
+	for name,mb := range m.members {
+		if name!=node && mb.State==Alive { helpers = append(helpers,name) }
+	}
+	m.mu.Unlock()
+	rand.Shuffle(len(helpers),func(i,j int) { helpers[i],helpers[j] = helpers[j],helpers[i] })
+	if len(helpers)>k { helpers = helpers[:k] }
+	if len(helpers)==0 { return false }
+	
+	acks := make(chan bool,len(helpers))
+	for _,h := range helpers {
+		msg := m.request(kvtp.CMD_PingReq)
+		msg.Val = append(msg.Val,node...)
+		go func(h string) { acks <- m.call(h,msg,2*m.probeTimeout())==nil }(h)
+	}
+	for range helpers {
+		if <- acks { return true }
+	}
+	return false
+}
+
+/*
+Returns the next member to probe. The members are probed in random order,
+every member once per round.
+*/
+func (m *Members) next() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if len(m.probes)==0 {
+			for name,mb := range m.members {
+				if mb.State!=Dead { m.probes = append(m.probes,name) }
+			}
+			if len(m.probes)==0 { return "" }
+			rand.Shuffle(len(m.probes),func(i,j int) { m.probes[i],m.probes[j] = m.probes[j],m.probes[i] })
+		}
+		name := m.probes[0]
+		m.probes = m.probes[1:]
+		if mb,ok := m.members[name]; ok && mb.State!=Dead { return name }
+	}
+}
+
+/*
+Suspects node, if it is alive.
+*/
+func (m *Members) suspect(node string) {
+	m.mu.Lock()
+	if mb,ok := m.members[node]; ok && mb.State==Alive { m.set(mb,Suspect,mb.Incarnation) }
+	m.mu.Unlock()
+}
+
+/*
+Declares the members dead, that have been suspected for longer than SuspectTimeout.
+*/
+func (m *Members) expire() {
+	m.mu.Lock()
+	for _,mb := range m.members {
+		if mb.State==Suspect && time.Since(mb.Since)>m.suspectTimeout() { m.set(mb,Dead,mb.Incarnation) }
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+/*
+Pings the seeds, that are not members, in parallel.
+*/
+func (m *Members) join() {
+	var wg sync.WaitGroup
+	for _,seed := range m.Seeds {
+		if seed==m.Name { continue }
+		m.mu.Lock()
+		mb,ok := m.members[seed]
+		m.mu.Unlock()
+		if ok && mb.State!=Dead { continue }
+		wg.Add(1)
+		go func(seed string) {
+			defer wg.Done()
+			m.ping(seed)
+		}(seed)
+	}
+	wg.Wait()
+}
+
+/*
+Probes one member.
+*/
+func (m *Members) probe() {
+	node := m.next()
+	if node=="" {
+		m.join()
+		return
+	}
+	if m.ping(node) || m.pingIndirect(node) { return }
+	m.suspect(node)
+}
+
+/*
+Joins the cluster through the Seeds and probes the members, until die is
+closed. Then the node leaves the cluster (see Leave).
+*/
+func (m *Members) Run(die <-chan struct{}) {
+	m.init()
+	m.join()
+	t := time.NewTicker(m.probeInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <- die:
+			m.Leave()
+			return
+		case <- t.C:
+		}
+		m.probe()
+		m.expire()
+	}
+}
+
+/*
+Announces, that this node leaves the cluster, to up to IndirectProbes+1 members.
+*/
+func (m *Members) Leave() {
+	m.init()
+	m.mu.Lock()
+	m.left = true
+	var alive []string
+	for name,mb := range m.members {
+		if mb.State==Alive { alive = append(alive,name) }
+	}
+	m.mu.Unlock()
+	k := m.IndirectProbes
+	if k<=0 { k = DefaultIndirectProbes }
+	rand.Shuffle(len(alive),func(i,j int) { alive[i],alive[j] = alive[j],alive[i] })
+	if len(alive)>k+1 { alive = alive[:k+1] }
+	var wg sync.WaitGroup
+	for _,node := range alive {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			m.ping(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+/*
+Answers CMD_Ping and CMD_PingReq. Returns false for other requests.
+*/
+func (m *Members) Process(req *rpcmux.Request) bool {
+	m.init()
+	kvr,ok := req.Msg.(*kvtp.Request)
+	if !ok { return false }
+	switch kvr.Cmd {
+	case kvtp.CMD_Ping: m.pong(req,kvr)
+	case kvtp.CMD_PingReq: go m.pingReq(req,kvr)
+	default: return false
+	}
+	return true
+}
+
+func (m *Members) pong(req *rpcmux.Request, kvr *kvtp.Request) {
+	defer req.Release()
+	isNew := m.receive(string(kvr.Key),kvr.Entries)
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	resp.Code = kvtp.RESP_Entries
+	// A node, that joins, gets the whole member list.
+	m.updates(resp.AddEntry,isNew)
+	req.Reply(resp)
+}
+
+func (m *Members) pingReq(req *rpcmux.Request, kvr *kvtp.Request) {
+	defer req.Release()
+	m.receive(string(kvr.Key),kvr.Entries)
+	if !m.ping(string(kvr.Val)) {
+		routing.ReplyError(req,kvtp.ERR_Unavailable,string(kvr.Val)+" did not answer")
+		return
+	}
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	resp.Code = kvtp.RESP_Entries
+	m.updates(resp.AddEntry,false)
+	req.Reply(resp)
+}
+
+/*
+Answers CMD_Ping and CMD_PingReq from src, and passes the other requests on to
+the returned channel, until die is closed.
+*/
+func (m *Members) Serve(src <-chan *rpcmux.Request, die <-chan struct{}) <-chan *rpcmux.Request {
+	m.init()
+	out := make(chan *rpcmux.Request)
+	go func() {
+		for {
+			select {
+			case <- die: return
+			case req := <- src:
+				if m.Process(req) { continue }
+				select {
+				case out <- req:
+				case <- die: return
+				}
+			}
+		}
+	}()
+	return out
+}
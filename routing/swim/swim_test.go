@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package swim_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/routing/swim"
+)
+
+/*
+Nodes connected through rpcmux.Pipes. Nodes, that are cut off, can't reach
+the others, nor be reached.
+*/
+type network struct{
+	mu      sync.Mutex
+	clients map[string]rpcmux.Client
+	cut     map[string]bool
+}
+
+func (n *network) setCut(node string, cut bool) {
+	n.mu.Lock()
+	n.cut[node] = cut
+	n.mu.Unlock()
+}
+
+/* The routing.NodeClients of a node. */
+type view struct{
+	n    *network
+	from string
+}
+
+func (v view) NodeClient(other string) (rpcmux.Client,bool) {
+	v.n.mu.Lock()
+	defer v.n.mu.Unlock()
+	if v.n.cut[v.from] || v.n.cut[other] { return nil,false }
+	c,ok := v.n.clients[other]
+	return c,ok
+}
+
+/* Records the NodeJoined and NodeLeft calls. */
+type listener struct{
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *listener) NodeJoined(node string) { l.add("+"+node) }
+func (l *listener) NodeLeft(node string) { l.add("-"+node) }
+func (l *listener) add(ev string) {
+	l.mu.Lock()
+	l.events = append(l.events,ev)
+	l.mu.Unlock()
+}
+func (l *listener) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil),l.events...)
+}
+
+/*
+Starts a cluster of n members, that join through the first one.
+*/
+func cluster(t *testing.T, n int) (*network,[]*swim.Members) {
+	net := &network{clients:make(map[string]rpcmux.Client),cut:make(map[string]bool)}
+	die := make(chan struct{})
+	var wg sync.WaitGroup
+	var shutdowns []func()
+	ms := make([]*swim.Members,n)
+	for i := range ms {
+		name := fmt.Sprint("n",i)
+		ms[i] = &swim.Members{
+			Name:name,
+			Role:"storage",
+			NC:view{net,name},
+			Seeds:[]string{"n0"},
+			ProbeInterval:20*time.Millisecond,
+			ProbeTimeout:100*time.Millisecond,
+			SuspectTimeout:300*time.Millisecond,
+		}
+		reqs := &sync.Pool{New:kvtp.NewRequest}
+		resps := &sync.Pool{New:kvtp.NewResponse}
+		cs,ss,shutdown := rpcmux.Pipe(16)
+		shutdowns = append(shutdowns,shutdown)
+		cs.Cancel = kvtp.ReqCancel(reqs)
+		cs.IsPartial = kvtp.RespIsPartial
+		ss.IsCancel = kvtp.ReqIsCancel
+		ss.DefaultResponse = kvtp.RespDefault(resps)
+		other := ms[i].Serve(ss.Serve(),die)
+		go func() {
+			for {
+				select {
+				case req := <- other:
+					req.ReplyDefault()
+					req.Release()
+				case <- die: return
+				}
+			}
+		}()
+		net.clients[name] = cs.Client()
+	}
+	for _,m := range ms {
+		wg.Add(1)
+		go func(m *swim.Members) {
+			defer wg.Done()
+			m.Run(die)
+		}(m)
+	}
+	t.Cleanup(func() {
+		close(die)
+		wg.Wait()
+		for _,f := range shutdowns { f() }
+	})
+	return net,ms
+}
+
+/* Returns the state of node in the member list of m, or 255, if it is unknown. */
+func state(m *swim.Members, node string) swim.State {
+	for _,mb := range m.Members() {
+		if mb.Name==node { return mb.State }
+	}
+	return 255
+}
+
+/* Waits until cond holds. */
+func await(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10*time.Second)
+	for !cond() {
+		if time.Now().After(deadline) { t.Fatal("timed out waiting for ",what) }
+		time.Sleep(5*time.Millisecond)
+	}
+}
+
+func allAlive(ms []*swim.Members) bool {
+	for _,m := range ms {
+		list := m.Members()
+		if len(list)!=len(ms)-1 { return false }
+		for _,mb := range list {
+			if mb.State!=swim.Alive { return false }
+		}
+	}
+	return true
+}
+
+func TestJoin(t *testing.T) {
+	_,ms := cluster(t,4)
+	await(t,"all members to join",func() bool { return allAlive(ms) })
+	for _,mb := range ms[3].Members() {
+		if mb.Role!="storage" { t.Errorf("%s: role %q",mb.Name,mb.Role) }
+	}
+	l := new(listener)
+	ms[1].Subscribe("storage",l)
+	if evs := l.get(); len(evs)!=3 || evs[0]!="+n0" || evs[1]!="+n2" || evs[2]!="+n3" { t.Errorf("events: %q",evs) }
+	
+	// Other roles are not reported.
+	l = new(listener)
+	ms[1].Subscribe("router",l)
+	if evs := l.get(); len(evs)!=0 { t.Errorf("events of routers: %q",evs) }
+}
+
+/*
+A member, that doesn't answer, is suspected, then declared dead. Once it is
+reachable again, it refutes its death with a higher incarnation and rejoins.
+*/
+func TestSuspectDeadRejoin(t *testing.T) {
+	net,ms := cluster(t,3)
+	await(t,"all members to join",func() bool { return allAlive(ms) })
+	l := new(listener)
+	ms[0].Subscribe("",l)
+	inc := ms[0].Members()[1].Incarnation
+	
+	net.setCut("n2",true)
+	suspected := false
+	await(t,"n2 to be declared dead",func() bool {
+		s := state(ms[0],"n2")
+		if s==swim.Suspect { suspected = true }
+		return s==swim.Dead
+	})
+	if !suspected { t.Error("n2 was not suspected before it was declared dead") }
+	if g := ms[0].RequestGoodness("n2"); g!=0 { t.Errorf("goodness of a dead member: %d",g) }
+	await(t,"n1 to learn n2 is dead",func() bool { return state(ms[1],"n2")==swim.Dead })
+	
+	net.setCut("n2",false)
+	await(t,"n2 to rejoin",func() bool { return allAlive(ms) })
+	for _,mb := range ms[0].Members() {
+		if mb.Name=="n2" && mb.Incarnation<=inc { t.Errorf("incarnation of n2: %d, want more than %d",mb.Incarnation,inc) }
+	}
+	
+	// n2 may spread, that it declared n1 dead, until n1 refutes it, so only the
+	// events of n2 are checked.
+	var evs []string
+	for _,ev := range l.get() {
+		if ev[1:]=="n2" { evs = append(evs,ev) }
+	}
+	if len(evs)!=3 || evs[0]!="+n2" || evs[1]!="-n2" || evs[2]!="+n2" { t.Errorf("events of n2: %q",evs) }
+}
+
+/*
+A member, that leaves, is declared dead at once, without suspicion.
+*/
+func TestLeave(t *testing.T) {
+	_,ms := cluster(t,3)
+	await(t,"all members to join",func() bool { return allAlive(ms) })
+	ms[2].Leave()
+	if s := state(ms[0],"n2"); s!=swim.Dead { t.Errorf("state of n2 at n0: %v",s) }
+	if s := state(ms[1],"n2"); s!=swim.Dead { t.Errorf("state of n2 at n1: %v",s) }
+	if g := ms[2].RequestGoodness("n2"); g!=0 { t.Errorf("goodness of itself, after leaving: %d",g) }
+}
@@ -0,0 +1,260 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+)
+
+var errNoResponse = errors.New("No response")
+
+/* Timeout of one attempt to commit or abort a prepared transaction. */
+const TxnCommitTimeout = 5*time.Second
+
+/* Number of attempts to commit a prepared transaction on a node. */
+const TxnCommitAttempts = 3
+
+/*
+Prepared transactions are committed within this time after the prepare started.
+Must be below the TxnTimeout of the nodes (lsm2.DefaultTxnTimeout), after which
+they abort the transaction.
+*/
+const TxnDeadline = 20*time.Second
+
+/*
+Sends msg using cli and waits for the response.
+
+The caller must call release(), if err is nil.
+*/
+func Call(cli rpcmux.Client, msg *kvtp.Request, ctx context.Context) (resp *kvtp.Response, release func(), err error) {
+	r,err := cli.Request(msg,ctx)
+	if err!=nil { return }
+	if r==nil { return nil,nil,errNoResponse }
+	rmsg,err := r.Get()
+	if err!=nil { r.Release(); return }
+	resp,ok := rmsg.(*kvtp.Response)
+	if !ok { r.Release(); return nil,nil,errNoResponse }
+	release = r.Release
+	return
+}
+
+/*
+The part of a transaction, that is sent to one node.
+*/
+type txnPart struct{
+	node     string
+	idx      []int // Indices into the Entries of the transaction.
+	prepared bool
+}
+
+func (p *txnPart) request(cmd uint8, id []byte, kvr *kvtp.Request) *kvtp.Request {
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = cmd
+	msg.Val = append(msg.Val,id...)
+	msg.Namespace = kvr.Namespace
+	if cmd!=kvtp.CMD_TxnPrepare { return msg }
+	for _,i := range p.idx {
+		e,me := &kvr.Entries[i],msg.AddEntry()
+		me.Code = e.Code
+		me.Key = append(me.Key,e.Key...)
+		me.Val = append(me.Val,e.Val...)
+		me.ExpiresAt = e.ExpiresAt
+		me.Version = e.Version
+	}
+	return msg
+}
+
+/*
+Prepares the part and merges the results into resp.
+*/
+func (p *txnPart) prepare(nc NodeClients, id []byte, kvr *kvtp.Request, resp *kvtp.Response, ctx context.Context) {
+	fail := func(code uint8, s string) {
+		for _,i := range p.idx {
+			resp.Entries[i].SetError(code,s)
+		}
+	}
+	cli,ok := nc.NodeClient(p.node)
+	if !ok {
+		fail(kvtp.ERR_RedirectFailed,"Redirection failed")
+		return
+	}
+	rr,release,err := Call(cli,p.request(kvtp.CMD_TxnPrepare,id,kvr),ctx)
+	if err!=nil {
+		fail(ErrCode(err),err.Error())
+		return
+	}
+	defer release()
+	switch {
+	case rr.Code==kvtp.RESP_None:
+		p.prepared = true
+	case len(rr.Entries)==len(p.idx):
+		failed := false
+		for j,i := range p.idx {
+			e,re := &resp.Entries[i],&rr.Entries[j]
+			e.Code = re.Code
+			e.Err = re.Err
+			e.Val = append(e.Val[:0],re.Val...)
+			e.Version = re.Version
+			failed = failed || re.Code!=kvtp.RESP_None
+		}
+		// The transaction failed as a whole.
+		if !failed && rr.Code==kvtp.RESP_Error { fail(rr.Err,string(rr.Val)) }
+	case rr.Code==kvtp.RESP_Error:
+		fail(rr.Err,string(rr.Val))
+	default:
+		fail(kvtp.ERR_Internal,"Unexpected response")
+	}
+}
+
+/*
+Commits or aborts the prepared part. Commits are attempted up to TxnCommitAttempts
+times, until the deadline.
+*/
+func (p *txnPart) end(cmd uint8, nc NodeClients, id []byte, kvr *kvtp.Request, deadline time.Time) bool {
+	cli,ok := nc.NodeClient(p.node)
+	if !ok { return false }
+	n := 1
+	if cmd==kvtp.CMD_TxnCommit { n = TxnCommitAttempts }
+	for ; n>0 && time.Now().Before(deadline) ; n-- {
+		d := time.Now().Add(TxnCommitTimeout)
+		if d.After(deadline) { d = deadline }
+		ctx,cancel := context.WithDeadline(context.Background(),d)
+		rr,release,err := Call(cli,p.request(cmd,id,kvr),ctx)
+		cancel()
+		if err!=nil { continue }
+		
+		// RESP_Error: The commit failed, but the transaction is still prepared.
+		if rr.Code==kvtp.RESP_Error && n>1 {
+			release()
+			continue
+		}
+		
+		/*
+		RESP_NotFound: The transaction is unknown, it timed out. The nodes remember
+		committed transactions, so a retry of a commit, that succeeded, succeeds.
+		*/
+		ok = rr.Code==kvtp.RESP_None
+		release()
+		return ok
+	}
+	return false
+}
+
+/*
+Performs a transaction (CMD_Txn), whose keys are owned by different nodes, using
+a two-phase commit: Every node prepares (checks and locks) its part of the
+transaction. If all nodes succeed, the parts are committed, otherwise aborted.
+owners[i] is the node, that owns req's Entries[i].
+
+If a node fails to commit, the transaction may have been partially committed.
+In this case, ERR_InDoubt is returned. Prepared transactions are aborted by the
+nodes, after they time out, so the commits are sent within TxnDeadline.
+
+This function blocks until the transaction is done, and releases req.
+*/
+func TwoPhaseCommit(req *rpcmux.Request, nc NodeClients, owners []string) {
+	defer req.Release()
+	kvr := req.Msg.(*kvtp.Request)
+	resp,ok := req.DefaultResponse().(*kvtp.Response)
+	if !ok {
+		req.ReplyDefault()
+		return
+	}
+	var buf [16]byte
+	if _,err := rand.Read(buf[:]); err!=nil {
+		resp.SetError(kvtp.ERR_Internal,err.Error())
+		req.Reply(resp)
+		return
+	}
+	id := []byte(hex.EncodeToString(buf[:]))
+	
+	var parts []*txnPart
+	byNode := make(map[string]*txnPart)
+	for i := range kvr.Entries {
+		e := resp.AddEntry()
+		e.Code = kvtp.RESP_None
+		e.Key = append(e.Key,kvr.Entries[i].Key...)
+		p := byNode[owners[i]]
+		if p==nil {
+			p = &txnPart{node:owners[i]}
+			byNode[owners[i]] = p
+			parts = append(parts,p)
+		}
+		p.idx = append(p.idx,i)
+	}
+	
+	// Phase 1: Prepare.
+	each := func(f func(p *txnPart)) {
+		var wg sync.WaitGroup
+		for _,p := range parts {
+			wg.Add(1)
+			go func(p *txnPart) {
+				defer wg.Done()
+				f(p)
+			}(p)
+		}
+		wg.Wait()
+	}
+	deadline := time.Now().Add(TxnDeadline)
+	ctx,cancel := context.WithDeadline(req.Context(),deadline)
+	each(func(p *txnPart) { p.prepare(nc,id,kvr,resp,ctx) })
+	cancel()
+	
+	all := time.Now().Before(deadline)
+	for _,p := range parts { all = all && p.prepared }
+	if !all {
+		// Abort. A node may have prepared, even though we didn't get its response.
+		abort := time.Now().Add(TxnCommitTimeout)
+		each(func(p *txnPart) { p.end(kvtp.CMD_TxnAbort,nc,id,kvr,abort) })
+		resp.SetTxnFailed()
+		req.Reply(resp)
+		return
+	}
+	
+	// Phase 2: Commit.
+	var mu sync.Mutex
+	committed := true
+	each(func(p *txnPart) {
+		if p.end(kvtp.CMD_TxnCommit,nc,id,kvr,deadline) { return }
+		mu.Lock()
+		committed = false
+		mu.Unlock()
+	})
+	resp.Entries = resp.Entries[:0]
+	if committed {
+		resp.Code = kvtp.RESP_None
+	} else {
+		resp.SetError(kvtp.ERR_InDoubt,"Transaction may have been committed partially")
+	}
+	req.Reply(resp)
+}
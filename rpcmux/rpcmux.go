@@ -26,6 +26,19 @@ package rpcmux
 import "sync"
 import "context"
 import "fmt"
+import "time"
+import "errors"
+
+/*
+Partial replies, that are queued per request, until Next() takes them.
+*/
+const DefaultMaxParts = 1024
+
+/*
+Returned by Get() and Next(), if the partial replies of a request exceeded
+Stream.MaxParts. The request has been canceled.
+*/
+var ErrTooManyParts = errors.New("Too many partial replies")
 
 func debug(i ...interface{}) {
 	fmt.Println(i...)
@@ -49,7 +62,17 @@ type Stream struct {
 	Cancel func() Message // generate a cancel-message.
 	IsCancel func(m Message) bool // detect a cancel-message.
 	
+	// Support for streaming replies.
+	IsPartial func(m Message) bool // detect a partial reply, that is followed by more replies.
+	MaxParts int // Optional: Limit of queued partial replies per request. 0 -> DefaultMaxParts.
+	
 	DefaultResponse func() Message // Generate default response message.
+	
+	Close func() // Optional: Close the underlying connection.
+	
+	// Optional: Called by the Client, when the first reply to a request arrives,
+	// with the time since the request has been sent. Must not block.
+	OnReply func(latency time.Duration)
 }
 
 /*
@@ -62,10 +85,16 @@ type Request struct {
 	lcf context.CancelFunc
 	seq uint64
 	sig chan uint8
+	recv time.Time
 }
 func (r *Request) clear() {
 	*r = Request{sig:r.sig}
 }
+
+/*
+The time, the request has been received.
+*/
+func (r *Request) Received() time.Time { return r.recv }
 func (r *Request) cancel() {
 	select {
 	case r.sig <- 0:
@@ -87,12 +116,20 @@ func (r *Request) testcancel() bool {
 	}
 	return false
 }
-func (r *Request) pollfunc() {
+/*
+Cancels ctx, once the request is canceled. The fields of the request are passed,
+because the request might be released and cleared, while this goroutine runs.
+*/
+func pollfunc(sig chan uint8, ctx context.Context, cf context.CancelFunc) {
 	select {
-	case <- r.sig:
-		r.lcf()
-		r.cancel()
-	case <- r.lctx.Done():
+	case <- sig:
+		cf()
+		// Keep the signal for testcancel().
+		select {
+		case sig <- 0:
+		default:
+		}
+	case <- ctx.Done():
 	}
 }
 func (r *Request) getCtx() context.Context {
@@ -106,7 +143,7 @@ Get a context. Useful since the server can cancel requests.
 func (r *Request) Context() context.Context {
 	if r.lctx==nil {
 		r.lctx,r.lcf = context.WithCancel(r.srv.ctx)
-		go r.pollfunc()
+		go pollfunc(r.sig,r.lctx,r.lcf)
 	}
 	return r.lctx
 }
@@ -127,6 +164,19 @@ Replies with a message. Reply() calls m.SetSeq() with the correct sequence numbe
 Returns true if the message has been pushed to the Stream.Out queue, false otherwise.
 */
 func (r *Request) Reply(m Message) (taken bool) {
+	return r.reply(m,true)
+}
+
+/*
+Replies with a partial message, that is followed by more replies. The final reply
+must be sent with Reply(). Stream.IsPartial must recognize m on the client side.
+
+Returns false, if the request has been canceled. The server should stop streaming then.
+*/
+func (r *Request) ReplyPartial(m Message) (taken bool) {
+	return r.reply(m,false)
+}
+func (r *Request) reply(m Message, final bool) (taken bool) {
 	m.SetSeq(r.seq)
 	select {
 	case <- r.getCtx().Done(): return
@@ -141,7 +191,7 @@ func (r *Request) Reply(m Message) (taken bool) {
 		r.cancel()
 		return
 	case r.srv.base.Out <- m:
-		if r.lcf!=nil { r.lcf() }
+		if final && r.lcf!=nil { r.lcf() }
 		return true
 	}
 	return
@@ -154,12 +204,22 @@ This is useful, if the server does not know, how to respond. This is the case wi
 applications.
 */
 func (r *Request) ReplyDefault() {
+	resp := r.DefaultResponse()
+	if resp==nil { return }
+	r.Reply(resp)
+}
+
+/*
+Generates a Message using Stream.DefaultResponse. Returns nil, if not supported.
+
+This is useful, if the caller wants to modify the response before replying.
+*/
+func (r *Request) DefaultResponse() Message {
 	srv := r.srv
-	if srv==nil { return }
+	if srv==nil { return nil }
 	dr := srv.base.DefaultResponse
-	if dr==nil { return }
-	resp := dr()
-	r.Reply(resp)
+	if dr==nil { return nil }
+	return dr()
 }
 
 func nRequest() interface{} {
@@ -211,6 +271,7 @@ func (srv *server) dispatch() {
 			r.seq = seq
 			r.srv = srv
 			r.Msg = msg
+			r.recv = time.Now()
 			if srv.base.IsCancel(msg) {
 				delete(srv.reqm,seq)
 			} else {
@@ -233,9 +294,45 @@ type Response struct {
 	msg Message
 	seq uint64
 	sig chan uint8
+	sent time.Time
+	replied bool // A reply has arrived.
+	err error // Set instead of msg, if the request failed.
+	
+	// Partial replies.
+	mu    sync.Mutex
+	parts []Message
+	cur   Message
+	more  chan uint8
 }
 func (r *Response) clear() {
-	*r = Response{sig:r.sig}
+	select {
+	case <- r.more:
+	default:
+	}
+	*r = Response{sig:r.sig,more:r.more}
+}
+/* Queues a partial reply. Returns false, if max replies are queued already. */
+func (r *Response) push(m Message, max int) bool {
+	r.mu.Lock()
+	full := len(r.parts)>=max
+	if !full { r.parts = append(r.parts,m) }
+	r.mu.Unlock()
+	if full { return false }
+	select {
+	case r.more <- 0:
+	default:
+	}
+	return true
+}
+func (r *Response) pop() (m Message) {
+	r.mu.Lock()
+	if len(r.parts)!=0 {
+		m = r.parts[0]
+		r.parts[0] = nil
+		r.parts = r.parts[1:]
+	}
+	r.mu.Unlock()
+	return
 }
 func (r *Response) done() {
 	select {
@@ -290,7 +387,7 @@ func (r *Response) Get() (Message,error) {
 	select {
 	case <- r.sig:
 		r.done()
-		return r.msg,nil
+		return r.msg,r.err
 	case <- r.cli.ctx.Done():
 		if r.cli.base.Err!=nil { return nil,r.cli.base.Err }
 		return nil,r.cli.ctx.Err()
@@ -300,6 +397,49 @@ func (r *Response) Get() (Message,error) {
 	panic("unreachable")
 }
 
+/*
+Retrieves the next partial reply of a streaming request, waiting if necessary.
+Returns nil, once the final reply has arrived. It can be obtained using Get().
+
+The returned message is recycled with the next call to Next() or Release(),
+unless RetainPart() is called.
+*/
+func (r *Response) Next() (Message,error) {
+	if r.cur!=nil {
+		r.cli.base.InRelease(r.cur)
+		r.cur = nil
+	}
+	for {
+		if m := r.pop(); m!=nil {
+			r.cur = m
+			return m,nil
+		}
+		select {
+		case <- r.more:
+		case <- r.sig:
+			r.done()
+			// Partial replies, that arrived before the final one.
+			if m := r.pop(); m!=nil {
+				r.cur = m
+				return m,nil
+			}
+			return nil,r.err
+		case <- r.cli.ctx.Done():
+			if r.cli.base.Err!=nil { return nil,r.cli.base.Err }
+			return nil,r.cli.ctx.Err()
+		case <- r.lctx.Done():
+			return nil,r.lctx.Err()
+		}
+	}
+}
+
+/*
+Saves the last message returned by Next() from recycling.
+*/
+func (r *Response) RetainPart() {
+	r.cur = nil
+}
+
 /*
 Should be called after the client is done with the response.
 */
@@ -310,7 +450,7 @@ func (r *Response) Release() {
 }
 
 func nResponse() interface{} {
-	return &Response{sig:make(chan uint8,1)}
+	return &Response{sig:make(chan uint8,1),more:make(chan uint8,1)}
 }
 
 type client struct{
@@ -326,6 +466,8 @@ type client struct{
 func (cli *client) init(b *Stream) *client{
 	if b.InRelease==nil { b.InRelease = func(m Message) {} }
 	if b.Cancel==nil { b.Cancel = func() Message { return nil } }
+	if b.IsPartial==nil { b.IsPartial = func(m Message) bool { return false } }
+	if b.MaxParts<=0 { b.MaxParts = DefaultMaxParts }
 	
 	// XXX: This will be set, in the dispatch loop!
 	cli.ctx = nil
@@ -347,6 +489,14 @@ func (cli *client) nextSeq(pseq *uint64) {
 		if _,ok := cli.reqm[*pseq]; !ok { return }
 	}
 }
+/* Sends a cancel request, if supported. */
+func (cli *client) cancel(seq uint64) {
+	msg := cli.base.Cancel()
+	if msg!=nil {
+		msg.SetSeq(seq)
+		cli.base.Out <- msg
+	}
+}
 func (cli *client) dispatch() {
 	var cf context.CancelFunc
 	cli.ctx,cf = context.WithCancel(context.Background())
@@ -369,6 +519,19 @@ func (cli *client) dispatch() {
 		case msg := <- cli.base.In:
 			seq := msg.Seq()
 			if r := cli.reqm[seq]; r!=nil {
+				if !r.replied && cli.base.OnReply!=nil { cli.base.OnReply(time.Since(r.sent)) }
+				r.replied = true
+				if cli.base.IsPartial(msg) {
+					if r.push(msg,cli.base.MaxParts) { continue }
+					
+					// The receiver can't keep up. Cancel and fail the request.
+					cli.base.InRelease(msg)
+					cli.cancel(seq)
+					r.err = ErrTooManyParts
+					r.done()
+					delete(cli.reqm,seq)
+					continue
+				}
 				if !r.testcancel() {
 					r.msg = msg
 					r.done()
@@ -379,19 +542,19 @@ func (cli *client) dispatch() {
 		case req := <- cli.rele:
 			seq := req.seq
 			if r := cli.reqm[seq]; r==req {
-				if !r.testdone() { /* Send a cancel request, if supported. */
-					msg := cli.base.Cancel()
-					if msg!=nil {
-						msg.SetSeq(seq)
-						cli.base.Out <- msg
-					}
-				}
+				if !r.testdone() { cli.cancel(seq) }
 				/* Remove it from the queue. */
 				delete(cli.reqm,seq)
 			}
 			if msg := req.msg; msg!=nil {
 				cli.base.InRelease(msg)
 			}
+			if msg := req.cur; msg!=nil {
+				cli.base.InRelease(msg)
+			}
+			for _,msg := range req.parts {
+				cli.base.InRelease(msg)
+			}
 			req.clear()
 			cli.pool.Put(req)
 		}
@@ -424,6 +587,7 @@ func (cli *client) Request(msg Message,ctx context.Context) (resp *Response,err
 	req.seq = seq
 	req.lctx = ctx
 	req.undone()
+	req.sent = time.Now()
 	select {
 	case <- cli.ctx.Done(): err = cli.ctx.Err() ; return 
 	case cli.base.Out <- msg:
@@ -455,3 +619,21 @@ func (s *Stream) Client() (c Client) {
 	return
 }
 
+
+/*
+Creates a pair of connected in-process Streams. Requests sent by a Client of the
+client Stream are served by the server Stream. Calling shutdown tears both down.
+
+Protocol specific fields (Cancel, IsCancel, DefaultResponse, InRelease) must be
+set by the caller, before Client() or Serve() is called.
+*/
+func Pipe(size int) (client, server *Stream, shutdown func()) {
+	a := make(chan Message,size)
+	b := make(chan Message,size)
+	die := make(chan struct{})
+	var once sync.Once
+	client = &Stream{Die:die,In:b,Out:a}
+	server = &Stream{Die:die,In:a,Out:b}
+	shutdown = func() { once.Do(func(){ close(die) }) }
+	return
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package rpcmux_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+)
+
+/*
+Opens a Pipe, whose requests are passed to serve.
+*/
+func pipe(t *testing.T, serve func(req *rpcmux.Request)) (*rpcmux.Stream,*rpcmux.Stream) {
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	t.Cleanup(shutdown)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	src := ss.Serve()
+	go func() {
+		for {
+			select {
+			case req := <- src: go serve(req)
+			case <- ss.Die: return
+			}
+		}
+	}()
+	return cs,ss
+}
+
+func TestOnReply(t *testing.T) {
+	const delay = 50*time.Millisecond
+	cs,_ := pipe(t,func(req *rpcmux.Request) {
+		time.Sleep(delay)
+		req.ReplyDefault()
+		req.Release()
+	})
+	latencies := make(chan time.Duration,2)
+	cs.OnReply = func(latency time.Duration) { latencies <- latency }
+	cli := cs.Client()
+	
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_Ping
+	resp,err := cli.Request(msg,context.Background())
+	if err!=nil { t.Fatal(err) }
+	defer resp.Release()
+	select {
+	case l := <- latencies: t.Fatalf("reported %v before the reply",l)
+	default:
+	}
+	if _,err := resp.Get(); err!=nil { t.Fatal(err) }
+	if l := <- latencies; l<delay { t.Fatalf("latency %v, want at least %v",l,delay) }
+}
+
+/*
+A streaming request, whose partial replies aren't taken, is canceled, once too
+many are queued.
+*/
+func TestTooManyParts(t *testing.T) {
+	canceled := make(chan struct{})
+	cs,_ := pipe(t,func(req *rpcmux.Request) {
+		defer req.Release()
+		ctx := req.Context()
+		for {
+			resp := kvtp.NewResponse().(*kvtp.Response)
+			resp.Code = kvtp.RESP_Event
+			req.ReplyPartial(resp)
+			select {
+			case <- ctx.Done():
+				close(canceled)
+				return
+			case <- time.After(time.Millisecond):
+			}
+		}
+	})
+	cs.MaxParts = 4
+	cli := cs.Client()
+	
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_Watch
+	resp,err := cli.Request(msg,context.Background())
+	if err!=nil { t.Fatal(err) }
+	defer resp.Release()
+	select {
+	case <- canceled:
+	case <- time.After(5*time.Second): t.Fatal("request not canceled")
+	}
+	for i := 0 ; i<4 ; i++ {
+		if m,err := resp.Next(); m==nil || err!=nil { t.Fatalf("part %d: %v %v",i,m,err) }
+	}
+	if _,err := resp.Next(); err!=rpcmux.ErrTooManyParts { t.Fatalf("got %v, want ErrTooManyParts",err) }
+}
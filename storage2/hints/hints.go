@@ -0,0 +1,324 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+/*
+Hinted handoff: Writes for nodes, that are unavailable, are stored as hints in
+a Badger DB and replayed, once the nodes are reachable again.
+
+Hints are stored under 0xFF 'h' <len(node)> <node> <time> <seq>, so the Badger DB
+can be shared with a lsm2.DB, where keys starting with 0xFF are reserved.
+*/
+package hints
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/routing"
+	"github.com/dgraph-io/badger"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	DefaultMaxAge = 3*time.Hour
+	DefaultMaxBytes = 64<<20
+	DefaultInterval = 10*time.Second
+	
+	ReplayTimeout = 5*time.Second // Timeout of a replayed hint.
+)
+
+var ErrFull = errors.New("Hint store full")
+
+var prefix = []byte{0xFF,'h'}
+
+func nodePrefix(node string) []byte {
+	return append(append(append([]byte{},prefix...),byte(len(node))),node...)
+}
+
+func hintKey(node string, t time.Time, seq uint64) []byte {
+	k := nodePrefix(node)
+	k = append(k,make([]byte,16)...)
+	binary.BigEndian.PutUint64(k[len(k)-16:],uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[len(k)-8:],seq)
+	return k
+}
+
+/*
+Counters of a Store.
+*/
+type Stats struct{
+	Stored   uint64
+	Dropped  uint64 // Hints, that have been dropped, as the store was full.
+	Replayed uint64
+	Failed   uint64 // Replays, that failed. The hint is retried later.
+}
+
+/*
+A HintStore in a Badger DB.
+
+Hints expire after MaxAge. If the hints exceed MaxBytes, further hints are
+dropped (ErrFull). Hints, that expired, are still accounted for, until the store
+is recounted. This happens at most once a second, when the store appears to be full.
+*/
+type Store struct{
+	stats Stats // First, as the counters are updated atomically (64-bit alignment).
+	
+	DB       *badger.DB
+	MaxAge   time.Duration // 0 -> DefaultMaxAge.
+	MaxBytes int64 // 0 -> DefaultMaxBytes.
+	Interval time.Duration // See Deliver, 0 -> DefaultInterval.
+	
+	once    sync.Once
+	mu      sync.Mutex
+	bytes   int64
+	counted time.Time
+	seq     uint64
+	busy    map[string]bool // Nodes, hints are replayed to.
+	wake    chan struct{}
+}
+
+var _ routing.HintStore = (*Store)(nil)
+
+func (s *Store) init() {
+	s.once.Do(func() {
+		s.busy = make(map[string]bool)
+		s.wake = make(chan struct{},1)
+	})
+}
+
+/*
+Returns the counters of the store.
+*/
+func (s *Store) Stats() (st Stats) {
+	st.Stored = atomic.LoadUint64(&s.stats.Stored)
+	st.Dropped = atomic.LoadUint64(&s.stats.Dropped)
+	st.Replayed = atomic.LoadUint64(&s.stats.Replayed)
+	st.Failed = atomic.LoadUint64(&s.stats.Failed)
+	return
+}
+
+/*
+Counts the size of the hints. Must be called with s.mu held.
+*/
+func (s *Store) count() {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	s.bytes = 0
+	s.DB.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			s.bytes += int64(len(it.Item().Key()))+it.Item().ValueSize()
+		}
+		it.Close()
+		return nil
+	})
+	s.counted = time.Now()
+}
+
+/*
+Stores msg as hint for node.
+*/
+func (s *Store) Hint(node string, msg *kvtp.Request) error {
+	s.init()
+	val,err := msgpack.Marshal(msg)
+	if err!=nil { return err }
+	maxBytes,maxAge := s.MaxBytes,s.MaxAge
+	if maxBytes<=0 { maxBytes = DefaultMaxBytes }
+	if maxAge<=0 { maxAge = DefaultMaxAge }
+	
+	now := time.Now()
+	s.mu.Lock()
+	s.seq++
+	key := hintKey(node,now,s.seq)
+	size := int64(len(key)+len(val))
+	if s.counted.IsZero() || (s.bytes+size>maxBytes && time.Since(s.counted)>time.Second) { s.count() }
+	if s.bytes+size>maxBytes {
+		s.mu.Unlock()
+		atomic.AddUint64(&s.stats.Dropped,1)
+		return ErrFull
+	}
+	s.bytes += size
+	s.mu.Unlock()
+	
+	ent := &badger.Entry{Key:key,Value:val,ExpiresAt:uint64(now.Add(maxAge).Unix())}
+	err = s.DB.Update(func(tx *badger.Txn) error { return tx.SetEntry(ent) })
+	if err!=nil {
+		s.mu.Lock()
+		s.bytes -= size
+		s.mu.Unlock()
+		return err
+	}
+	atomic.AddUint64(&s.stats.Stored,1)
+	return nil
+}
+
+/*
+Returns the nodes, that have hints.
+*/
+func (s *Store) Nodes() (nodes []string) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	s.DB.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(opts)
+		for it.Rewind(); it.Valid(); {
+			k := it.Item().Key()
+			if len(k)<3 || len(k)<3+int(k[2]) { break }
+			node := string(k[3:3+int(k[2])])
+			nodes = append(nodes,node)
+			
+			// Skip the other hints of node.
+			it.Seek(append(nodePrefix(node),0xFF))
+		}
+		it.Close()
+		return nil
+	})
+	return
+}
+
+type hint struct{
+	key []byte
+	val []byte
+}
+
+/*
+Returns up to n hints of node.
+*/
+func (s *Store) next(node string, n int) (hs []hint) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = nodePrefix(node)
+	s.DB.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(opts)
+		for it.Rewind(); it.Valid() && len(hs)<n; it.Next() {
+			val,err := it.Item().ValueCopy(nil)
+			if err!=nil { continue }
+			hs = append(hs,hint{it.Item().KeyCopy(nil),val})
+		}
+		it.Close()
+		return nil
+	})
+	return
+}
+
+func (s *Store) remove(h hint) {
+	err := s.DB.Update(func(tx *badger.Txn) error { return tx.Delete(h.key) })
+	if err!=nil { return }
+	s.mu.Lock()
+	s.bytes -= int64(len(h.key)+len(h.val))
+	s.mu.Unlock()
+}
+
+/*
+Replays the hints of node in the order they were stored, until one fails.
+Hints, that have been replayed, are removed. Returns the number of hints replayed.
+*/
+func (s *Store) Replay(node string, cli rpcmux.Client) (n int, err error) {
+	s.init()
+	s.mu.Lock()
+	if s.busy[node] {
+		s.mu.Unlock()
+		return
+	}
+	s.busy[node] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.busy,node)
+		s.mu.Unlock()
+	}()
+	
+	for {
+		hs := s.next(node,64)
+		if len(hs)==0 { return }
+		for _,h := range hs {
+			msg := kvtp.NewRequest().(*kvtp.Request)
+			if msgpack.Unmarshal(h.val,msg)!=nil {
+				// Can't be replayed ever.
+				s.remove(h)
+				continue
+			}
+			if err = s.replay(cli,msg); err!=nil {
+				atomic.AddUint64(&s.stats.Failed,1)
+				return
+			}
+			s.remove(h)
+			atomic.AddUint64(&s.stats.Replayed,1)
+			n++
+		}
+	}
+}
+
+func (s *Store) replay(cli rpcmux.Client, msg *kvtp.Request) error {
+	ctx,cancel := context.WithTimeout(context.Background(),ReplayTimeout)
+	defer cancel()
+	resp,release,err := routing.Call(cli,msg,ctx)
+	if err!=nil { return err }
+	defer release()
+	if resp.Code==kvtp.RESP_Error { return errors.New(kvtp.ErrName(resp.Err)+": "+string(resp.Val)) }
+	return nil
+}
+
+/*
+Wakes Deliver up, to replay the hints of node. Can be used as multibe.Forwarder.OnConnect.
+*/
+func (s *Store) Wake(node string) {
+	s.init()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Replays the hints to their nodes, every Interval and whenever Wake is called,
+until die is closed. Nodes, whose client has a Connect method (like
+multibe.Client), are skipped, if they can't be connected to.
+*/
+func (s *Store) Deliver(nc routing.NodeClients, die <-chan struct{}) {
+	s.init()
+	iv := s.Interval
+	if iv<=0 { iv = DefaultInterval }
+	t := time.NewTicker(iv)
+	defer t.Stop()
+	for {
+		select {
+		case <- die: return
+		case <- t.C:
+		case <- s.wake:
+		}
+		for _,node := range s.Nodes() {
+			cli,ok := nc.NodeClient(node)
+			if !ok { continue }
+			if c,ok := cli.(interface{ Connect() error }); ok && c.Connect()!=nil { continue }
+			s.Replay(node,cli)
+		}
+	}
+}
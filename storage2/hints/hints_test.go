@@ -0,0 +1,222 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package hints_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/byte-mug/zrab2k/storage2/hints"
+	"github.com/dgraph-io/badger"
+)
+
+func openStore(t *testing.T) *hints.Store {
+	dir,err := ioutil.TempDir("","hints")
+	if err!=nil { t.Fatal(err) }
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return &hints.Store{DB:bdb}
+}
+
+/*
+A node, that records the keys of the requests it receives. Requests for the key
+in fail are answered with an error.
+*/
+type node struct{
+	mu   sync.Mutex
+	keys []string
+	fail string
+}
+
+func (n *node) received() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil),n.keys...)
+}
+
+func (n *node) setFail(key string) {
+	n.mu.Lock()
+	n.fail = key
+	n.mu.Unlock()
+}
+
+func (n *node) serve(req *rpcmux.Request) {
+	defer req.Release()
+	msg := req.Msg.(*kvtp.Request)
+	resp := kvtp.NewResponse().(*kvtp.Response)
+	resp.Code = kvtp.RESP_None
+	n.mu.Lock()
+	n.keys = append(n.keys,string(msg.Key))
+	if string(msg.Key)==n.fail { resp.SetError(kvtp.ERR_Internal,"failed") }
+	n.mu.Unlock()
+	req.Reply(resp)
+}
+
+/*
+Connects a client to n through an rpcmux.Pipe.
+*/
+func (n *node) client(t *testing.T) rpcmux.Client {
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	t.Cleanup(shutdown)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	src := ss.Serve()
+	go func() {
+		for {
+			select {
+			case req := <- src: n.serve(req)
+			case <- ss.Die: return
+			}
+		}
+	}()
+	return cs.Client()
+}
+
+type nodes map[string]rpcmux.Client
+func (n nodes) NodeClient(other string) (rpcmux.Client,bool) {
+	c,ok := n[other]
+	return c,ok
+}
+
+func put(key string) *kvtp.Request {
+	msg := kvtp.NewRequest().(*kvtp.Request)
+	msg.Cmd = kvtp.CMD_Put
+	msg.Key = []byte(key)
+	msg.Val = []byte("v")
+	return msg
+}
+
+func hint(t *testing.T, s *hints.Store, node string, keys ...string) {
+	for _,k := range keys {
+		if err := s.Hint(node,put(k)); err!=nil { t.Fatal(err) }
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := openStore(t)
+	hint(t,s,"n1","a","b","c")
+	hint(t,s,"n2","d")
+	if ns := s.Nodes(); !reflect.DeepEqual(ns,[]string{"n1","n2"}) { t.Errorf("Nodes: %q",ns) }
+	
+	n := new(node)
+	if r,err := s.Replay("n1",n.client(t)); r!=3 || err!=nil { t.Errorf("Replay: %d %v",r,err) }
+	if ks := n.received(); !reflect.DeepEqual(ks,[]string{"a","b","c"}) { t.Errorf("received %q",ks) }
+	if ns := s.Nodes(); !reflect.DeepEqual(ns,[]string{"n2"}) { t.Errorf("Nodes after Replay: %q",ns) }
+	if st := s.Stats(); st!=(hints.Stats{Stored:4,Replayed:3}) { t.Errorf("Stats: %+v",st) }
+}
+
+/*
+Replay stops at the first hint, that fails, and keeps it and all later hints.
+*/
+func TestReplayFailure(t *testing.T) {
+	s := openStore(t)
+	hint(t,s,"n1","a","b","c")
+	n := &node{fail:"b"}
+	cli := n.client(t)
+	if r,err := s.Replay("n1",cli); r!=1 || err==nil { t.Errorf("Replay: %d %v",r,err) }
+	if st := s.Stats(); st.Replayed!=1 || st.Failed!=1 { t.Errorf("Stats: %+v",st) }
+	
+	n.setFail("")
+	if r,err := s.Replay("n1",cli); r!=2 || err!=nil { t.Errorf("second Replay: %d %v",r,err) }
+	if ks := n.received(); !reflect.DeepEqual(ks,[]string{"a","b","b","c"}) { t.Errorf("received %q",ks) }
+	if ns := s.Nodes(); len(ns)!=0 { t.Errorf("Nodes after Replay: %q",ns) }
+}
+
+func TestFull(t *testing.T) {
+	s := openStore(t)
+	s.MaxBytes = 100
+	hint(t,s,"n1","a")
+	if err := s.Hint("n1",put("b")); err!=hints.ErrFull { t.Fatalf("Hint into a full store: %v",err) }
+	if st := s.Stats(); st.Stored!=1 || st.Dropped!=1 { t.Errorf("Stats: %+v",st) }
+	
+	// Replayed hints free their space.
+	n := new(node)
+	if r,err := s.Replay("n1",n.client(t)); r!=1 || err!=nil { t.Fatalf("Replay: %d %v",r,err) }
+	hint(t,s,"n1","b")
+}
+
+/*
+Hints expire after MaxAge, and their space is reclaimed, once the store is recounted.
+*/
+func TestExpiry(t *testing.T) {
+	s := openStore(t)
+	s.MaxAge = time.Second
+	s.MaxBytes = 100
+	hint(t,s,"n1","a")
+	if err := s.Hint("n1",put("b")); err!=hints.ErrFull { t.Fatalf("Hint into a full store: %v",err) }
+	
+	// Badger expires at whole seconds.
+	time.Sleep(2100*time.Millisecond)
+	if ns := s.Nodes(); len(ns)!=0 { t.Errorf("Nodes after expiry: %q",ns) }
+	n := new(node)
+	if r,err := s.Replay("n1",n.client(t)); r!=0 || err!=nil { t.Errorf("Replay after expiry: %d %v",r,err) }
+	hint(t,s,"n1","b")
+}
+
+func TestDeliver(t *testing.T) {
+	s := openStore(t)
+	s.Interval = time.Hour
+	hint(t,s,"n1","a","b")
+	hint(t,s,"gone","c")
+	n := new(node)
+	die := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Deliver(nodes{"n1":n.client(t)},die)
+		close(done)
+	}()
+	defer func() {
+		close(die)
+		<- done
+	}()
+	
+	s.Wake("n1")
+	deadline := time.Now().Add(5*time.Second)
+	for s.Stats().Replayed<2 {
+		if time.Now().After(deadline) { t.Fatalf("not delivered, Stats: %+v",s.Stats()) }
+		time.Sleep(10*time.Millisecond)
+	}
+	if ks := n.received(); !reflect.DeepEqual(ks,[]string{"a","b"}) { t.Errorf("received %q",ks) }
+	
+	// Hints for unknown nodes are kept.
+	if ns := s.Nodes(); !reflect.DeepEqual(ns,[]string{"gone"}) { t.Errorf("Nodes after Deliver: %q",ns) }
+}
@@ -40,17 +40,14 @@ const (
 
 func respErr(err string,pool *sync.Pool) *kvtp.Response {
 	resp := pool.Get().(*kvtp.Response)
-	resp.Code = kvtp.RESP_Error
-	resp.ExpiresAt = 0
-	resp.Val = append(resp.Val[:0],err...)
+	resp.Reset()
+	resp.SetError(kvtp.ERR_Internal,err)
 	return resp
 }
 
 func respOk(pool *sync.Pool) *kvtp.Response {
 	resp := pool.Get().(*kvtp.Response)
-	resp.Code = kvtp.RESP_None
-	resp.ExpiresAt = 0
-	resp.Val = resp.Val[:0]
+	resp.Reset()
 	return resp
 }
 
@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+The last fencing token, granted by this node.
+
+Tokens are taken from the clock (time.UnixNano), but always increase on this
+node. So they increase across nodes too, if the lock moves to another node (after
+a placement change or a failover), as long as the clocks of the nodes differ by
+less than the time between the grants. Locks are never redirected to another
+node, when the disk is full.
+*/
+var keyFencing = []byte{keyReserved,'f'}
+
+/*
+Locks are stored as <token (8 bytes, big endian)> <owner>.
+*/
+func lockValue(token uint64, owner []byte) []byte {
+	val := make([]byte,8,8+len(owner))
+	binary.BigEndian.PutUint64(val,token)
+	return append(val,owner...)
+}
+func parseLock(val []byte) (token uint64, owner []byte, ok bool) {
+	if len(val)<8 { return }
+	return binary.BigEndian.Uint64(val),val[8:],true
+}
+
+func (w *writer) nextToken() (uint64,error) {
+	var n uint64
+	item,err := w.tx.Get(keyFencing)
+	switch err {
+	case nil:
+		val,err := item.ValueCopy(nil)
+		if err!=nil { return 0,err }
+		if len(val)==8 { n = binary.BigEndian.Uint64(val) }
+	case badger.ErrKeyNotFound:
+	default: return 0,err
+	}
+	n++
+	if now := uint64(time.Now().UnixNano()); now>n { n = now }
+	val := make([]byte,8)
+	binary.BigEndian.PutUint64(val,n)
+	return n,w.setEntry(&badger.Entry{Key: keyFencing, Value: val})
+}
+
+/*
+Performs CMD_Lock, CMD_Renew and CMD_Unlock.
+
+A lock is a key with ExpiresAt, so an expired lease disappears on its own. As the
+writer is the only goroutine, that writes to the DB, the checks and the writes are
+atomic. If the lock has been redirected, the request is forwarded.
+*/
+func (w *writer) lease(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	if len(msg.Val)==0 {
+		w.reply(req,respErr(kvtp.ERR_InvalidKey,"Missing owner",db.Resps))
+		return
+	}
+	item,done := w.lookup(req,msg)
+	if done { return }
+	w.quiet = true
+	defer func() { w.quiet = false }()
+	
+	var token uint64
+	var owner []byte
+	held := false
+	if item!=nil {
+		if item.UserMeta()==t_redirect {
+			w.reply(req,respErr(kvtp.ERR_RedirectFailed,"Redirection failed",db.Resps))
+			return
+		}
+		val,err := valueCopy(item,nil)
+		if err!=nil {
+			w.reply(req,respFail(err,db.Resps))
+			return
+		}
+		token,owner,held = parseLock(val)
+		if !held {
+			w.reply(req,respErr(kvtp.ERR_InvalidKey,"Key is not a lock",db.Resps))
+			return
+		}
+	}
+	
+	mine := held && bytes.Equal(owner,msg.Val)
+	if msg.Cmd!=kvtp.CMD_Lock {
+		if !held {
+			w.reply(req,respNew(kvtp.RESP_NotFound,db.Resps))
+			return
+		}
+		mine = mine && token==msg.Version
+	}
+	if held && !mine {
+		resp := respNew(kvtp.RESP_Conflict,db.Resps)
+		resp.Val = append(resp.Val,owner...)
+		resp.ExpiresAt = item.ExpiresAt()
+		w.reply(req,resp)
+		return
+	}
+	
+	key := append([]byte{},nsKey(msg.Namespace,msg.Key)...)
+	if msg.Cmd==kvtp.CMD_Unlock {
+		if err := w.delete(key); err!=nil {
+			w.reply(req,respFail(err,db.Resps))
+			return
+		}
+		w.bj.add(req)
+		return
+	}
+	
+	if !held {
+		if !db.DS.HasEnoughDiskSpace(msg.Key,lockValue(0,msg.Val)) {
+			// Another node would grant tokens from its own counter.
+			w.reply(req,respErr(kvtp.ERR_DiskFull,"Disk full",db.Resps))
+			return
+		}
+		var err error
+		token,err = w.nextToken()
+		if err!=nil {
+			w.reply(req,respFail(err,db.Resps))
+			return
+		}
+	}
+	val := lockValue(token,msg.Val)
+	err := w.setEntry(&badger.Entry{Key: key, Value: stamp(w.stampFor(key,msg.Timestamp),val), UserMeta: t_stamped, ExpiresAt: msg.ExpiresAt})
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	if !held { db.DS.AccountForDiskSpace(msg.Key,val) }
+	
+	expiresAt := msg.ExpiresAt
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			w.reply(req,respFail(e,db.Resps))
+			return
+		}
+		resp := respNew(kvtp.RESP_Value,db.Resps)
+		resp.Version = token
+		resp.ExpiresAt = expiresAt
+		w.reply(req,resp)
+	})
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+type fullDisk struct{}
+func (fullDisk) HasEnoughDiskSpace(key, value []byte) bool { return false }
+func (fullDisk) AccountForDiskSpace(key, value []byte) {}
+
+func TestFencingTokens(t *testing.T) {
+	start := uint64(time.Now().UnixNano())
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	var last uint64
+	for i := 0 ; i<3 ; i++ {
+		l,err := tdb.cli.Lock(ctx,[]byte("l"),[]byte("me"),time.Minute)
+		if err!=nil { t.Fatal(err) }
+		if l.Token<=last || l.Token<start { t.Fatalf("token %d after %d, started at %d",l.Token,last,start) }
+		last = l.Token
+		if err := l.Unlock(ctx); err!=nil { t.Fatal(err) }
+	}
+	
+	// Another node, that takes over the lock, grants a greater token.
+	other := openDB(t,nil)
+	l,err := other.cli.Lock(ctx,[]byte("l"),[]byte("you"),time.Minute)
+	if err!=nil { t.Fatal(err) }
+	if l.Token<=last { t.Errorf("token %d of the other node, not greater than %d",l.Token,last) }
+}
+
+func TestLockNotRedirected(t *testing.T) {
+	tdb := openDB(t,func(db *DB) { db.DS = fullDisk{} })
+	_,err := tdb.cli.Lock(context.Background(),[]byte("l"),[]byte("me"),time.Minute)
+	if e,ok := err.(*client.Error); !ok || e.Code!=kvtp.ERR_DiskFull { t.Fatalf("got %v, want ERR_DiskFull",err) }
+}
@@ -26,7 +26,9 @@ package lsm2
 
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"github.com/byte-mug/zrab2k/kvtp"
 	"github.com/byte-mug/zrab2k/rpcmux"
 	"github.com/dgraph-io/badger"
@@ -44,24 +46,53 @@ func debug(i ...interface{}) {
 const (
 	t_data = iota
 	t_redirect
+	t_stamped // Data with a timestamp, see stamp.
+	t_tombstone // A deleted key, see stamp.
 )
 
-func respErr(err string,pool *sync.Pool) *kvtp.Response {
+func respNew(code uint8,pool *sync.Pool) *kvtp.Response {
 	resp := pool.Get().(*kvtp.Response)
-	resp.Code = kvtp.RESP_Error
-	resp.ExpiresAt = 0
-	resp.Val = append(resp.Val[:0],err...)
+	resp.Reset()
+	resp.Code = code
 	return resp
 }
 
-func respOk(pool *sync.Pool) *kvtp.Response {
-	resp := pool.Get().(*kvtp.Response)
-	resp.Code = kvtp.RESP_None
-	resp.ExpiresAt = 0
-	resp.Val = resp.Val[:0]
+func respErr(code uint8,err string,pool *sync.Pool) *kvtp.Response {
+	resp := respNew(kvtp.RESP_Error,pool)
+	resp.SetError(code,err)
 	return resp
 }
 
+/*
+Maps an error to a kvtp error code.
+*/
+func errCode(err error) uint8 {
+	switch err {
+	case badger.ErrTxnTooBig: return kvtp.ERR_TxnTooBig
+	case badger.ErrConflict: return kvtp.ERR_Conflict
+	case errQuota: return kvtp.ERR_QuotaExceeded
+	case errLocked: return kvtp.ERR_Conflict
+	case errDiskFull: return kvtp.ERR_DiskFull
+	case context.DeadlineExceeded,context.Canceled: return kvtp.ERR_Timeout
+	}
+	return kvtp.ERR_Internal
+}
+
+func respFail(err error,pool *sync.Pool) *kvtp.Response {
+	return respErr(errCode(err),err.Error(),pool)
+}
+
+func respOk(pool *sync.Pool) *kvtp.Response {
+	return respNew(kvtp.RESP_None,pool)
+}
+
+func noRedirect(msg *kvtp.Request) bool {
+	switch msg.Cmd {
+	case kvtp.CMD_GetNoRedirect,kvtp.CMD_PutNoRedirect: return true
+	}
+	return msg.Flags&kvtp.FLAG_NoRedirect!=0
+}
+
 func getstr(i *badger.Item) string {
 	var s string
 	i.Value(func(val []byte) error {
@@ -72,30 +103,41 @@ func getstr(i *badger.Item) string {
 }
 
 func nBatchJob() interface{} {
-	return &batchJob{make([]*rpcmux.Request,0,32),nil,nil,nil}
+	return &batchJob{make([]*rpcmux.Request,0,32),nil,nil,0,nil,nil,nil,nil}
 }
 var pBatchJob = sync.Pool{New:nBatchJob}
 type batchJob struct{
 	requests []*rpcmux.Request
+	hooks []func(e error) // Called instead of replying, for requests with a custom response.
 	pool *sync.Pool
-	sync *chan struct{}
+	seq uint64 // Sequence number, batches complete in this order.
 	thro *y.Throttle
+	events []kvtp.Entry // Changes, see CMD_Watch.
+	commits *sequencer
+	failed *int32 // Set, if the commit failed.
 }
 func (b *batchJob) hasSpace(max int) bool {
-	return len(b.requests) < max
+	return len(b.requests)+len(b.hooks) < max
 }
 func (b *batchJob) add(i *rpcmux.Request) {
 	b.requests = append(b.requests,i)
 }
+func (b *batchJob) addHook(f func(e error)) {
+	b.hooks = append(b.hooks,f)
+}
 func (b *batchJob) done(e error) {
+	var events []kvtp.Entry
+	if e==nil && len(b.events)!=0 {
+		events = b.events
+		b.events = nil
+	}
+	b.events = b.events[:0]
+	b.commits.complete(b.seq,events)
+	if e!=nil { atomic.StoreInt32(b.failed,1) }
 	b.thro.Done(nil)
-	osync := *b.sync
-	*b.sync = make(chan struct{})
-	close(osync)
 	if e!=nil {
-		s := e.Error()
 		for _,req := range b.requests{
-			req.Reply(respErr(s,b.pool))
+			req.Reply(respFail(e,b.pool))
 			req.Release()
 		}
 	} else {
@@ -104,140 +146,470 @@ func (b *batchJob) done(e error) {
 			req.Release()
 		}
 	}
+	for _,f := range b.hooks { f(e) }
+	for i := range b.hooks { b.hooks[i] = nil }
+	b.hooks = b.hooks[:0]
 	for i := range b.requests { b.requests[i] = nil }
 	b.requests = b.requests[:0]
 	b.pool = nil
-	b.sync = nil
 	b.thro = nil
+	b.commits = nil
+	b.failed = nil
 	pBatchJob.Put(b)
 }
 
+/*
+Completes the committed batches in the order, they were flushed: Publishes their
+events and lets the readers renew their snapshot. Badger runs the callbacks of
+CommitWith concurrently, so batches may complete out of order.
+*/
+type sequencer struct{
+	mu   sync.Mutex
+	next uint64 // Sequence number of the next batch, whose events are published.
+	held map[uint64][]kvtp.Entry // Events of batches, that completed before their predecessors.
+	sync chan struct{} // Closed, once a batch completed.
+	hub  *watchHub
+}
+func (s *sequencer) init(hub *watchHub) {
+	s.held = make(map[uint64][]kvtp.Entry)
+	s.sync = make(chan struct{})
+	s.hub = hub
+}
+func (s *sequencer) complete(seq uint64, events []kvtp.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.sync)
+	s.sync = make(chan struct{})
+	if seq!=s.next {
+		s.held[seq] = events
+		return
+	}
+	for {
+		if len(events)!=0 { s.hub.publish(events) }
+		s.next++
+		var ok bool
+		events,ok = s.held[s.next]
+		if !ok { return }
+		delete(s.held,s.next)
+	}
+}
+/* Returns a channel, that is closed, once the next batch completed. */
+func (s *sequencer) synced() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync
+}
+
 type DB struct{
 	storage2.EndPoint
+	Name string // Node-ID, used in CMD_Trace.
 	DS storage2.DiskSpace
 	RR storage2.RedirectReader
 	RW storage2.RedirectWriter
+	NC storage2.NodeClients
+	NS storage2.NodeSelector
 	DB *badger.DB
+	Reqs *sync.Pool // Optional: kvtp.Request-pool for requests to other nodes.
+	Spaces map[string]*Namespace // Optional: TTL defaults and quotas of namespaces.
+	TxnTimeout time.Duration // Prepared transactions are aborted after this time. 0 -> DefaultTxnTimeout.
+	TombstoneTTL time.Duration // Tombstones of deleted keys expire after this time. 0 -> DefaultTombstoneTTL.
+	MerkleMaxAge time.Duration // Merkle trees (CMD_Merkle) are rebuilt after this time. 0 -> DefaultMerkleMaxAge.
 	read chan *rpcmux.Request
-	sync chan struct{}
+	tasks chan func(w *writer)
+	commits sequencer
+	failed int32 // Set, if a batch failed: The namespaces are recounted.
+	watch watchHub
+	merkles merkleCache
+	wg sync.WaitGroup
 }
 func (db *DB) Init(readers int) {
 	db.read = make(chan *rpcmux.Request,16)
-	db.sync = make(chan struct{})
+	db.tasks = make(chan func(w *writer))
+	db.commits.init(&db.watch)
 	if db.DS==nil { db.DS = storage2.InfiniteDiskSpace() }
+	db.wg.Add(1+readers)
 	go db.writer()
 	for i := 0 ; i<readers ; i++ { go db.reader() }
 }
+
+/*
+Waits, until the DB stopped after Die has been closed. Pending writes are
+committed before. Afterwards, the badger.DB can be closed.
+*/
+func (db *DB) Wait() {
+	db.wg.Wait()
+}
+/*
+Runs f on the writer goroutine. Returns false, if the DB is shutting down.
+*/
+func (db *DB) onWriter(f func(w *writer)) bool {
+	select {
+	case db.tasks <- f: return true
+	case <- db.Die: return false
+	}
+}
+
+/*
+State of the writer goroutine.
+*/
+type writer struct{
+	db    *DB
+	tx    *badger.Txn
+	bj    *batchJob
+	thro  *y.Throttle
+	tmout <- chan time.Time
+	seq   uint64 // Of the next batch.
+	dirty bool
+	written map[string]bool // Keys written in the current transaction.
+	quiet bool // Writes cause no events.
+	usages map[string]*usage
+	
+	// Prepared transactions.
+	prepared map[string]*prepared
+	locks    map[string]string // Locked key -> transaction id.
+	owner    string // Transaction, that is currently committed.
+	
+	repairs int64 // Number of CMD_ReadRepair received.
+	hints   int64 // Number of CMD_HintedHandoff received.
+}
+func (w *writer) begin() {
+	w.tx = w.db.DB.NewTransaction(true)
+	w.bj = pBatchJob.Get().(*batchJob)
+	w.bj.pool = w.db.Resps
+	w.bj.seq = w.seq
+	w.seq++
+	w.bj.thro = w.thro
+	w.bj.commits = &w.db.commits
+	w.bj.failed = &w.db.failed
+	w.tmout = nil
+	w.dirty = false
+	w.written = nil
+	w.count()
+}
+/* Commits the current transaction and starts a new one. */
+func (w *writer) flush() {
+	w.thro.Do()
+	w.tx.CommitWith(w.bj.done)
+	w.begin()
+}
+/* Schedules a flush. */
+func (w *writer) arm() {
+	if w.tmout==nil {
+		w.tmout = time.After(time.Millisecond*10)
+	}
+}
+/* Writes ent to the current transaction. */
+func (w *writer) set(ent *badger.Entry) error {
+	if w.locked(ent.Key) { return errLocked }
+	account,err := w.charge(ent)
+	if err!=nil { return err }
+	err = w.tx.SetEntry(ent)
+	if err==nil {
+		account()
+		w.wrote(ent.Key)
+		if ent.UserMeta==t_tombstone {
+			w.event(kvtp.EVENT_Delete,ent)
+		} else {
+			w.event(kvtp.EVENT_Put,ent)
+		}
+		w.dirty = true
+		w.arm()
+	}
+	return err
+}
+func (w *writer) wrote(key []byte) {
+	if w.written==nil { w.written = make(map[string]bool) }
+	w.written[string(key)] = true
+}
+/* Deletes key in the current transaction. */
+func (w *writer) del(key []byte) error {
+	if w.locked(key) { return errLocked }
+	account := w.discharge(key)
+	err := w.tx.Delete(key)
+	if err==nil {
+		account()
+		w.wrote(key)
+		w.event(kvtp.EVENT_Delete,&badger.Entry{Key:key})
+		w.dirty = true
+		w.arm()
+	}
+	return err
+}
+func (w *writer) setEntry(ent *badger.Entry) error {
+	err := w.set(ent)
+	if err==badger.ErrTxnTooBig {
+		// Flush Txn
+		w.flush()
+		
+		// Retry
+		err = w.set(ent)
+	}
+	return err
+}
+func (w *writer) delete(key []byte) error {
+	err := w.del(key)
+	if err==badger.ErrTxnTooBig {
+		w.flush()
+		err = w.del(key)
+	}
+	return err
+}
+func (w *writer) reply(req *rpcmux.Request, resp *kvtp.Response) {
+	req.Reply(resp)
+	req.Release()
+}
+/*
+Hands a read to the readers. They stop on Die, so the read fails then.
+*/
+func (w *writer) read(req *rpcmux.Request) {
+	select {
+	case w.db.read <- req:
+	case <- w.db.Die:
+		w.reply(req,respErr(kvtp.ERR_Internal,"Shutting down",w.db.Resps))
+	}
+}
+func (w *writer) redirectWrite(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	str,ok := "",false
+	ent := &badger.Entry{Key:append([]byte{},nsKey(msg.Namespace,msg.Key)...),UserMeta:t_redirect,ExpiresAt:msg.ExpiresAt}
+	if db.RW!=nil && !noRedirect(msg) {
+		if msg.Cmd==kvtp.CMD_Put {
+			msg.Cmd = kvtp.CMD_PutNoRedirect
+		} else {
+			msg.Flags |= kvtp.FLAG_NoRedirect
+		}
+		str,ok = db.RW.RedirectWrite(req)
+	}
+	if ok {
+		ent.Value = []byte(str)
+		w.setEntry(ent)
+	} else {
+		w.reply(req,respErr(kvtp.ERR_DiskFull,"Disk full and not redirection",db.Resps))
+	}
+}
+func (w *writer) put(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	if !db.DS.HasEnoughDiskSpace(msg.Key,msg.Val) {
+		w.redirectWrite(req,msg)
+		return
+	}
+	key := nsKey(msg.Namespace,msg.Key)
+	ts := msg.Timestamp
+	if ts!=0 {
+		// A newer write wins, even if it arrived earlier.
+		if w.superseded(key,msg) {
+			w.reply(req,respOk(db.Resps))
+			return
+		}
+	} else {
+		ts = w.stampFor(key,0)
+	}
+	ent := &badger.Entry{Key: key, Value: stamp(ts,msg.Val), UserMeta: t_stamped, ExpiresAt: msg.ExpiresAt}
+	err := w.setEntry(ent)
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	db.DS.AccountForDiskSpace(msg.Key,msg.Val)
+	w.bj.add(req)
+}
+
+/*
+Looks up a key within the write transaction. Returns nil, if the key does not exist.
+
+If the key has been redirected to another node, the request is forwarded to
+that node and done is true.
+*/
+func (w *writer) lookup(req *rpcmux.Request, msg *kvtp.Request) (item *badger.Item, done bool) {
+	db := w.db
+	item,err := w.tx.Get(nsKey(msg.Namespace,msg.Key))
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound: return nil,false
+	default:
+		w.reply(req,respFail(err,db.Resps))
+		return nil,true
+	}
+	switch item.UserMeta() {
+	case t_data,t_stamped:
+	case t_redirect:
+		if db.RR!=nil && !noRedirect(msg) {
+			msg.Flags |= kvtp.FLAG_NoRedirect
+			if !db.RR.RedirectRead(getstr(item),req) {
+				w.reply(req,respErr(kvtp.ERR_RedirectFailed,"Redirection failed",db.Resps))
+			}
+			return nil,true
+		}
+	default: return nil,false
+	}
+	return
+}
+
+/*
+Looks up the current version of a key within the write transaction.
+
+If the key has been redirected to another node, the request is forwarded to
+that node and done is true.
+
+With FLAG_Timestamp, the timestamp is returned instead. exists reports, whether
+the key exists, as a value may have no timestamp.
+*/
+func (w *writer) version(req *rpcmux.Request, msg *kvtp.Request) (version uint64, exists, done bool) {
+	// An uncommitted write has no version yet.
+	if w.written[string(nsKey(msg.Namespace,msg.Key))] { w.flush() }
+	
+	item,done := w.lookup(req,msg)
+	if item==nil { return }
+	if msg.Flags&kvtp.FLAG_Timestamp!=0 {
+		version = timestamp(item)
+	} else {
+		version = item.Version()
+	}
+	exists = true
+	return
+}
+func (w *writer) putIf(req *rpcmux.Request, msg *kvtp.Request) {
+	version,exists,done := w.version(req,msg)
+	if done { return }
+	ok := false
+	switch msg.Cmd {
+	case kvtp.CMD_PutIfAbsent: ok = !exists
+	case kvtp.CMD_PutIfVersion: ok = exists==(msg.Version!=0) && version==msg.Version
+	}
+	if !ok {
+		resp := respNew(kvtp.RESP_Conflict,w.db.Resps)
+		resp.Version = version
+		w.reply(req,resp)
+		return
+	}
+	
+	// The condition is met. From now on, it is an ordinary put, that must not be superseded.
+	msg.Cmd = kvtp.CMD_Put
+	db := w.db
+	if !db.DS.HasEnoughDiskSpace(msg.Key,msg.Val) {
+		w.redirectWrite(req,msg)
+		return
+	}
+	key := nsKey(msg.Namespace,msg.Key)
+	ts := w.stampFor(key,msg.Timestamp)
+	err := w.setEntry(&badger.Entry{Key: key, Value: stamp(ts,msg.Val), UserMeta: t_stamped, ExpiresAt: msg.ExpiresAt})
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	db.DS.AccountForDiskSpace(msg.Key,msg.Val)
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			w.reply(req,respFail(e,db.Resps))
+			return
+		}
+		resp := respOk(db.Resps)
+		resp.Version = db.versionOf(key,ts)
+		if resp.Version!=0 && msg.Flags&kvtp.FLAG_Timestamp!=0 { resp.Version = ts }
+		w.reply(req,resp)
+	})
+}
+
+/*
+Returns the version of key, if it still holds the value with timestamp ts, or 0,
+if it has been overwritten meanwhile. Called after the write committed.
+*/
+func (db *DB) versionOf(key []byte, ts uint64) (version uint64) {
+	db.DB.View(func(tx *badger.Txn) error {
+		item,err := tx.Get(key)
+		if err==nil && timestamp(item)==ts { version = item.Version() }
+		return nil
+	})
+	return
+}
 func (db *DB) writer() {
 	var req *rpcmux.Request
 	
-	var tmout <- chan time.Time
-	thro := y.NewThrottle(16)
-	
-	tx := db.DB.NewTransaction(true)
-	bj := pBatchJob.Get().(*batchJob)
-	bj.pool = db.Resps
-	bj.sync = &db.sync
-	bj.thro = thro
+	defer db.wg.Done()
+	w := &writer{db:db,thro:y.NewThrottle(16)}
+	w.begin()
+	w.loadPrepared()
 	for {
 		req = nil
 		// Peek!
 		select {
 		case req = <- db.Source: goto skip
+		case task := <- db.tasks:
+			task(w)
+			continue
 		default:
 		}
 		
 		// Wait!
 		select {
 		case <- db.Die:
-			tx.Discard()
+			w.flush()
+			w.thro.Finish()
+			w.tx.Discard()
 			return
 		case req = <- db.Source:
-		case <- tmout:
+		case task := <- db.tasks:
+			task(w)
+			continue
+		case <- w.tmout:
 		}
 skip:
-		if req==nil || !bj.hasSpace(32) {
-			thro.Do()
-			tx.CommitWith(bj.done)
-			tx = db.DB.NewTransaction(true)
-			bj = pBatchJob.Get().(*batchJob)
-			bj.pool = db.Resps
-			bj.sync = &db.sync
-			bj.thro = thro
-			tmout = nil
+		if req==nil || !w.bj.hasSpace(32) {
+			w.flush()
 		}
 		if req==nil { continue }
 		msg := req.Msg.(*kvtp.Request)
+		if code,e := checkRequest(msg); code!=kvtp.ERR_None {
+			w.reply(req,respErr(code,e,db.Resps))
+			continue
+		}
 		switch msg.Cmd {
 		case kvtp.CMD_Put,kvtp.CMD_PutNoRedirect:
-			if !db.DS.HasEnoughDiskSpace(msg.Key,msg.Val) {
-				str,ok := "",false
-				ent := &badger.Entry{Key:append([]byte{},msg.Key...),UserMeta:t_redirect,ExpiresAt:msg.ExpiresAt}
-				if db.RW!=nil && msg.Cmd!=kvtp.CMD_PutNoRedirect {
-					msg.Cmd = kvtp.CMD_PutNoRedirect
-					str,ok = db.RW.RedirectWrite(req)
-				}
-				if ok {
-					ent.Value = []byte(str)
-					err := tx.SetEntry(ent)
-					if err==badger.ErrTxnTooBig {
-						// Flush Txn
-						thro.Do()
-						tx.CommitWith(bj.done)
-						tx = db.DB.NewTransaction(true)
-						bj = pBatchJob.Get().(*batchJob)
-						bj.pool = db.Resps
-						bj.sync = &db.sync
-						bj.thro = thro
-						tmout = nil
-						
-						// Retry
-						tx.SetEntry(ent)
-					}
-				} else {
-					req.Reply(respErr("Disk full and not redirection",db.Resps))
-					req.Release()
-				}
-				continue
-			}
-			ent := &badger.Entry{Key: msg.Key, Value: msg.Val, ExpiresAt: msg.ExpiresAt}
-			err := tx.SetEntry(ent)
-			if err==badger.ErrTxnTooBig {
-				// Flush Txn
-				thro.Do()
-				tx.CommitWith(bj.done)
-				tx = db.DB.NewTransaction(true)
-				bj = pBatchJob.Get().(*batchJob)
-				bj.pool = db.Resps
-				bj.sync = &db.sync
-				bj.thro = thro
-				tmout = nil
-				
-				// Retry
-				err = tx.SetEntry(ent)
-			}
-			if err!=nil {
-				req.Reply(respErr(err.Error(),db.Resps))
-				req.Release()
-				continue
+			msg.ExpiresAt = db.expiresAt(msg.Namespace,msg.ExpiresAt)
+			w.put(req,msg)
+		case kvtp.CMD_PutIfVersion,kvtp.CMD_PutIfAbsent:
+			msg.ExpiresAt = db.expiresAt(msg.Namespace,msg.ExpiresAt)
+			w.putIf(req,msg)
+		case kvtp.CMD_MultiPut:
+			for i := range msg.Entries {
+				e := &msg.Entries[i]
+				e.ExpiresAt = db.expiresAt(msg.Namespace,e.ExpiresAt)
 			}
-			if tmout==nil {
-				tmout = time.After(time.Millisecond*10)
+			w.multiPut(req,msg)
+		case kvtp.CMD_Incr,kvtp.CMD_Append:
+			w.modify(req,msg)
+		case kvtp.CMD_Delete:
+			w.remove(req,msg)
+		case kvtp.CMD_Watch:
+			db.watchStart(req,msg)
+		case kvtp.CMD_Txn,kvtp.CMD_TxnPrepare:
+			w.txn(req,msg)
+		case kvtp.CMD_TxnCommit,kvtp.CMD_TxnAbort:
+			w.txnEnd(req,msg)
+		case kvtp.CMD_Lock,kvtp.CMD_Renew,kvtp.CMD_Unlock:
+			w.lease(req,msg)
+		case kvtp.CMD_Stat:
+			w.stat(req,msg)
+		case kvtp.CMD_ReadRepair,kvtp.CMD_HintedHandoff:
+			w.readRepair(req,msg)
+		case kvtp.CMD_Touch:
+			if msg.ExpiresAt!=0 {
+				w.touch(req,msg)
+			} else {
+				w.read(req)
 			}
-			db.DS.AccountForDiskSpace(msg.Key,msg.Val)
-			bj.add(req)
-		case kvtp.CMD_Get,kvtp.CMD_Touch,kvtp.CMD_Trace:
-			db.read <- req
+		case kvtp.CMD_Get,kvtp.CMD_GetNoRedirect,kvtp.CMD_Trace,kvtp.CMD_Scan,kvtp.CMD_MultiGet,kvtp.CMD_Merkle:
+			w.read(req)
 		default:
-			req.Reply(respErr("Command Unsupported",db.Resps))
-			req.Release()
+			w.reply(req,respErr(kvtp.ERR_Unsupported,"Command Unsupported",db.Resps))
 		}
 	}
 }
 func (db *DB) reader() {
 	var req *rpcmux.Request
 	
-	sync := db.sync
+	defer db.wg.Done()
+	sync := db.commits.synced()
 	
 	tx := db.DB.NewTransaction(false)
 	for {
@@ -252,60 +624,84 @@ func (db *DB) reader() {
 		select {
 		case <- sync:
 			tx.Discard()
-			sync = db.sync
+			sync = db.commits.synced()
 			tx = db.DB.NewTransaction(false)
 		default:
 		}
 		
 		msg := req.Msg.(*kvtp.Request)
-		item,err := tx.Get(msg.Key)
+		switch msg.Cmd {
+		case kvtp.CMD_Scan:
+			db.scan(tx,req,msg)
+			continue
+		case kvtp.CMD_MultiGet:
+			db.multiGet(tx,req,msg)
+			continue
+		case kvtp.CMD_Merkle:
+			db.merkle(tx,req,msg)
+			continue
+		}
+		var ts uint64
+		item,err := tx.Get(nsKey(msg.Namespace,msg.Key))
+		if err==nil && item.UserMeta()==t_tombstone {
+			ts = timestamp(item)
+			item,err = nil,badger.ErrKeyNotFound
+		}
 		if err==nil {
 			switch item.UserMeta() {
-			case t_data:
+			case t_data,t_stamped:
 			case t_redirect:
-				if db.RR!=nil && msg.Cmd!=kvtp.CMD_GetNoRedirect {
+				if db.RR!=nil && !noRedirect(msg) {
 					str := getstr(item)
-					db.RR.RedirectRead(str,req)
+					msg.AddHop(db.Name,"node","redirect "+str,req.Received())
+					if !db.RR.RedirectRead(str,req) {
+						req.Reply(respErr(kvtp.ERR_RedirectFailed,"Redirection failed",db.Resps))
+						req.Release()
+					}
 					continue
 				}
 			default:
-				{
-					resp := db.Resps.Get().(*kvtp.Response)
-					resp.Val = resp.Val[:0]
-					resp.Code = kvtp.RESP_NotFound
-					req.Reply(resp)
-					req.Release()
-				}
+				req.Reply(respNew(kvtp.RESP_NotFound,db.Resps))
+				req.Release()
 				continue
 			}
 		}
 		
-		resp := db.Resps.Get().(*kvtp.Response)
-		resp.Val = resp.Val[:0]
+		resp := respNew(kvtp.RESP_None,db.Resps)
+		resp.Timestamp = ts
 		switch msg.Cmd {
 		case kvtp.CMD_Get,kvtp.CMD_GetNoRedirect:
 			val := resp.Val
 			if err==nil {
 				resp.Code = kvtp.RESP_Value
-				resp.Val,err = item.ValueCopy(val)
+				resp.Version = item.Version()
+				resp.ExpiresAt = item.ExpiresAt()
+				resp.Timestamp = timestamp(item)
+				resp.Val,err = valueCopy(item,val)
 			}
 			if err==badger.ErrKeyNotFound {
 				resp.Code = kvtp.RESP_NotFound
 				resp.Val = val
 			} else if err!=nil {
-				resp.Code = kvtp.RESP_Error
-				resp.Val = append(val,err.Error()...)
+				resp.Val = val
+				resp.SetError(errCode(err),err.Error())
 			}
 		case kvtp.CMD_Trace:
 			resp.Code = kvtp.RESP_Value
 			if err==nil {
-				resp.Val = append(resp.Val,"\n--ok"...)
+				msg.AddHop(db.Name,"node","ok",req.Received())
 			} else {
-				resp.Val = append(resp.Val,"\n--not_found"...)
+				msg.AddHop(db.Name,"node","not_found",req.Received())
+			}
+			resp.Hops = append(resp.Hops,msg.Hops...)
+			for i := range resp.Hops {
+				resp.Val = append(append(resp.Val,'\n'),resp.Hops[i].String()...)
 			}
 		case kvtp.CMD_Touch:
 			resp.Code = kvtp.RESP_Value
 			if err==nil {
+				resp.Version = item.Version()
+				resp.ExpiresAt = item.ExpiresAt()
 				resp.Val = append(resp.Val,"ok"...)
 			} else {
 				resp.Val = append(resp.Val,"not_found"...)
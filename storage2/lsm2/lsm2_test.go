@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+A DB in a temporary directory, that is served through an rpcmux.Pipe.
+*/
+type testDB struct{
+	*DB
+	cli *client.Client
+	raw rpcmux.Client
+	stop func() // Closes Die.
+}
+
+/*
+Opens a DB. setup, if not nil, configures it before Init. The DB is closed and
+removed at the end of the test.
+*/
+func openDB(t *testing.T, setup func(db *DB)) *testDB {
+	return openReaders(t,2,setup)
+}
+
+/* Opens a DB with the given number of readers, see openDB. */
+func openReaders(t *testing.T, readers int, setup func(db *DB)) *testDB {
+	dir,err := ioutil.TempDir("","lsm2")
+	if err!=nil { t.Fatal(err) }
+	// Small tables, so a batch is too big after a few thousand entries.
+	bdb,err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil).WithMaxTableSize(1<<20))
+	if err!=nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	reqs := &sync.Pool{New:kvtp.NewRequest}
+	resps := &sync.Pool{New:kvtp.NewResponse}
+	cs,ss,shutdown := rpcmux.Pipe(16)
+	cs.Cancel = kvtp.ReqCancel(reqs)
+	cs.IsPartial = kvtp.RespIsPartial
+	ss.IsCancel = kvtp.ReqIsCancel
+	ss.DefaultResponse = kvtp.RespDefault(resps)
+	
+	die := make(chan struct{})
+	db := &DB{Name:"test",DB:bdb,Reqs:reqs}
+	db.Die = die
+	db.Source = ss.Serve()
+	db.Resps = resps
+	if setup!=nil { setup(db) }
+	db.Init(readers)
+	
+	raw := cs.Client()
+	var once sync.Once
+	tdb := &testDB{DB:db,cli:client.Over(raw,nil),raw:raw}
+	tdb.stop = func() { once.Do(func() { close(die) }) }
+	t.Cleanup(func() {
+		tdb.stop()
+		db.Wait()
+		shutdown()
+		bdb.Close()
+		os.RemoveAll(dir)
+	})
+	return tdb
+}
+
+/*
+Performs a raw request and returns a copy of the response.
+*/
+func (tdb *testDB) do(t *testing.T, build func(r *kvtp.Request)) *kvtp.Response {
+	var resp *kvtp.Response
+	err := tdb.cli.Do(context.Background(),build,func(r *kvtp.Response) error {
+		resp = new(kvtp.Response)
+		resp.CopyFrom(r)
+		return nil
+	})
+	if err!=nil { t.Fatal(err) }
+	return resp
+}
+
+/*
+Returns the stored meta byte and timestamp of key.
+*/
+func (tdb *testDB) stored(t *testing.T, key string) (meta byte, ts uint64) {
+	err := tdb.DB.DB.View(func(tx *badger.Txn) error {
+		item,err := tx.Get([]byte(key))
+		if err!=nil { return err }
+		meta,ts = item.UserMeta(),timestamp(item)
+		return nil
+	})
+	if err!=nil { t.Fatalf("%s: %v",key,err) }
+	return
+}
+
+func TestWritesAreStamped(t *testing.T) {
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	
+	if err := tdb.cli.Put(ctx,[]byte("put"),[]byte("a")); err!=nil { t.Fatal(err) }
+	if _,err := tdb.cli.PutIfAbsent(ctx,[]byte("absent"),[]byte("a"),0); err!=nil { t.Fatal(err) }
+	tdb.do(t,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Incr
+		r.Key = append(r.Key,"incr"...)
+		r.Initial = 1
+	})
+	tdb.do(t,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Append
+		r.Key = append(r.Key,"append"...)
+		r.Val = append(r.Val,"a"...)
+	})
+	if _,err := tdb.cli.Lock(ctx,[]byte("lock"),[]byte("me"),time.Minute); err!=nil { t.Fatal(err) }
+	tx := tdb.cli.Begin()
+	tx.Put([]byte("txn"),[]byte("a"),0)
+	if err := tx.Commit(ctx); err!=nil { t.Fatal(err) }
+	
+	for _,key := range []string{"put","absent","incr","append","lock","txn"} {
+		if meta,ts := tdb.stored(t,key); meta!=t_stamped || ts==0 {
+			t.Errorf("%s: meta %d, timestamp %d",key,meta,ts)
+		}
+	}
+}
+
+/*
+A read-modify-write must be newer than the value, it has been derived from, even
+if that value has a timestamp from the future. Otherwise a read repair with the
+old value undoes it.
+*/
+func TestModifySupersedesOldValue(t *testing.T) {
+	tdb := openDB(t,nil)
+	future := uint64(time.Now().Add(time.Hour).UnixNano())
+	write := func(cmd uint8, val string, ts uint64) *kvtp.Response {
+		return tdb.do(t,func(r *kvtp.Request) {
+			r.Cmd = cmd
+			r.Key = append(r.Key,"n"...)
+			r.Val = append(r.Val,val...)
+			r.Delta = 1
+			r.Timestamp = ts
+		})
+	}
+	write(kvtp.CMD_Put,"1",future)
+	write(kvtp.CMD_Incr,"",0)
+	if _,ts := tdb.stored(t,"n"); ts<=future {
+		t.Fatalf("timestamp %d, not newer than %d",ts,future)
+	}
+	write(kvtp.CMD_ReadRepair,"1",future)
+	write(kvtp.CMD_Append,"0",0)
+	write(kvtp.CMD_ReadRepair,"2",future+1)
+	
+	item,err := tdb.cli.Get(context.Background(),[]byte("n"))
+	if err!=nil { t.Fatal(err) }
+	if string(item.Value)!="20" { t.Errorf("got %q, want \"20\"",item.Value) }
+}
+
+func TestPutIfReturnsVersion(t *testing.T) {
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	key := []byte("v")
+	
+	v1,err := tdb.cli.PutIfAbsent(ctx,key,[]byte("1"),0)
+	if err!=nil { t.Fatal(err) }
+	item,err := tdb.cli.Get(ctx,key)
+	if err!=nil { t.Fatal(err) }
+	if v1==0 || item.Version!=v1 { t.Fatalf("PutIfAbsent returned version %d, Get %d",v1,item.Version) }
+	
+	v2,err := tdb.cli.PutIfVersion(ctx,key,[]byte("2"),0,v1)
+	if err!=nil { t.Fatal(err) }
+	item,err = tdb.cli.Get(ctx,key)
+	if err!=nil { t.Fatal(err) }
+	if v2==v1 || item.Version!=v2 { t.Fatalf("PutIfVersion returned version %d, Get %d",v2,item.Version) }
+	
+	if _,err := tdb.cli.PutIfVersion(ctx,key,[]byte("3"),0,v1); err!=client.ErrConflict { t.Fatalf("stale version: %v",err) }
+}
+
+/*
+The writer must not block on handing reads to the readers, after they stopped.
+*/
+func TestShutdownWithPendingReads(t *testing.T) {
+	tdb := openReaders(t,0,nil)
+	ctx,cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// More reads, than the queue holds.
+	for i := 0 ; i<cap(tdb.read)+4 ; i++ {
+		go tdb.cli.Get(ctx,[]byte("a"))
+	}
+	for len(tdb.read)<cap(tdb.read) { time.Sleep(time.Millisecond) }
+	
+	done := make(chan struct{})
+	tdb.stop()
+	go func() {
+		tdb.Wait()
+		close(done)
+	}()
+	select {
+	case <- done:
+	case <- time.After(5*time.Second): t.Fatal("writer blocked")
+	}
+}
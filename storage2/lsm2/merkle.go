@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lsm2
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dchest/siphash"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Merkle trees are rebuilt after this time, if DB.MerkleMaxAge is 0.
+*/
+const DefaultMerkleMaxAge = time.Minute
+
+/*
+At most this many Merkle trees are cached. A tree takes 8 bytes per node,
+about 35 KiB.
+*/
+const merkleMaxTrees = 64
+
+/*
+A hash range (start, end], see kvtp.CMD_Merkle.
+*/
+type hashRange struct{
+	start,end uint64
+}
+func (r hashRange) contains(h uint64) bool {
+	if r.start<r.end { return r.start<h && h<=r.end }
+	return r.start<h || h<=r.end
+}
+
+/*
+The parameters of a CMD_Merkle request, that select the keys of the tree.
+*/
+type merkleScope struct{
+	ns     string
+	k1,k2  uint64
+	ranges []hashRange
+}
+
+func parseScope(msg *kvtp.Request) (s merkleScope, ok bool) {
+	if len(msg.Val)!=16 { return }
+	s.ns = msg.Namespace
+	s.k1 = binary.BigEndian.Uint64(msg.Val)
+	s.k2 = binary.BigEndian.Uint64(msg.Val[8:])
+	for i := range msg.Entries {
+		e := &msg.Entries[i]
+		if len(e.Key)!=8 || len(e.Val)!=8 { return }
+		s.ranges = append(s.ranges,hashRange{binary.BigEndian.Uint64(e.Key),binary.BigEndian.Uint64(e.Val)})
+	}
+	return s,true
+}
+
+/*
+Reports, whether the key hash h is in the scope.
+*/
+func (s *merkleScope) contains(h uint64) bool {
+	if len(s.ranges)==0 { return true }
+	for _,r := range s.ranges {
+		if r.contains(h) { return true }
+	}
+	return false
+}
+
+/*
+Calls f for every key of the scope. Key is the key without the namespace, h its
+hash. Redirected keys are skipped, as are values without a timestamp, that have
+been written before the writes were stamped.
+
+This scans the whole namespace, its cost grows with the number of keys.
+*/
+func (s *merkleScope) each(tx *badger.Txn, f func(key []byte, h, ts uint64, deleted bool)) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = nsPrefix(s.ns)
+	base := len(opts.Prefix)
+	it := tx.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		
+		// Internal keys sort last.
+		if s.ns=="" && len(key)!=0 && key[0]==keyReserved { break }
+		switch item.UserMeta() {
+		case t_stamped,t_tombstone:
+		default: continue
+		}
+		key = key[base:]
+		h := siphash.Hash(s.k1,s.k2,key)
+		if !s.contains(h) { continue }
+		f(key,h,timestamp(item),item.UserMeta()==t_tombstone)
+	}
+	it.Close()
+}
+
+func leafOf(h uint64) uint32 {
+	return uint32(h>>(64-kvtp.MERKLE_Bits*kvtp.MERKLE_Depth))
+}
+
+/*
+A Merkle tree: levels[l][i] is the hash of node i at level l.
+
+The hash of a leaf combines the hashes of its keys and their timestamps by XOR,
+so the order of the keys does not matter. The hash of an inner node is the
+SipHash of the hashes of its children.
+*/
+type merkleTree struct{
+	levels [kvtp.MERKLE_Depth+1][]uint64
+	built  time.Time
+}
+
+func buildMerkle(tx *badger.Txn, s *merkleScope) *merkleTree {
+	t := &merkleTree{built:time.Now()}
+	leaves := make([]uint64,1<<(kvtp.MERKLE_Bits*kvtp.MERKLE_Depth))
+	var buf [8]byte
+	s.each(tx,func(key []byte, h, ts uint64, deleted bool) {
+		var d uint64
+		if deleted { d = 1 }
+		leaves[leafOf(h)] ^= siphash.Hash(ts,d,key)
+	})
+	t.levels[kvtp.MERKLE_Depth] = leaves
+	buf2 := make([]byte,0,8<<kvtp.MERKLE_Bits)
+	for l := kvtp.MERKLE_Depth-1; l>=0; l-- {
+		below := t.levels[l+1]
+		level := make([]uint64,len(below)>>kvtp.MERKLE_Bits)
+		for i := range level {
+			buf2 = buf2[:0]
+			for _,c := range below[i<<kvtp.MERKLE_Bits:(i+1)<<kvtp.MERKLE_Bits] {
+				binary.BigEndian.PutUint64(buf[:],c)
+				buf2 = append(buf2,buf[:]...)
+			}
+			level[i] = siphash.Hash(0,0,buf2)
+		}
+		t.levels[l] = level
+	}
+	return t
+}
+
+/*
+Merkle trees, that have been built recently, by scope.
+
+Building a tree scans the whole namespace (see merkleScope.each) on the reader
+goroutine, that serves the request. So a tree is built at most once per scope and
+MerkleMaxAge: Concurrent requests for a scope wait for the same build. A node
+is asked for the scopes of all replica pairs, it is part of, which are usually
+a few. At most merkleMaxTrees trees are kept, the oldest are evicted first.
+*/
+type merkleCache struct{
+	mu    sync.Mutex
+	trees map[string]*merkleEntry
+}
+type merkleEntry struct{
+	tree *merkleTree
+	done chan struct{} // Closed, once tree is built.
+}
+func (e *merkleEntry) built() bool {
+	select {
+	case <- e.done: return true
+	default: return false
+	}
+}
+
+func (c *merkleCache) get(tx *badger.Txn, msg *kvtp.Request, s *merkleScope, maxAge time.Duration) *merkleTree {
+	id := msg.Namespace+"\x00"+string(msg.Val)
+	for i := range msg.Entries { id += string(msg.Entries[i].Key)+string(msg.Entries[i].Val) }
+	c.mu.Lock()
+	e := c.trees[id]
+	if e!=nil && !(e.built() && time.Since(e.tree.built)>=maxAge) {
+		c.mu.Unlock()
+		<- e.done
+		return e.tree
+	}
+	e = &merkleEntry{done:make(chan struct{})}
+	c.evict(maxAge)
+	c.trees[id] = e
+	c.mu.Unlock()
+	
+	e.tree = buildMerkle(tx,s)
+	close(e.done)
+	return e.tree
+}
+
+/*
+Removes the trees, that are too old, and the oldest ones beyond merkleMaxTrees-1.
+Trees, that are being built, are kept. Must be called with mu held.
+*/
+func (c *merkleCache) evict(maxAge time.Duration) {
+	if c.trees==nil { c.trees = make(map[string]*merkleEntry) }
+	for k,e := range c.trees {
+		if e.built() && time.Since(e.tree.built)>=maxAge { delete(c.trees,k) }
+	}
+	for len(c.trees)>=merkleMaxTrees {
+		oldest := ""
+		var at time.Time
+		for k,e := range c.trees {
+			if !e.built() { continue }
+			if oldest=="" || e.tree.built.Before(at) { oldest,at = k,e.tree.built }
+		}
+		if oldest=="" { return }
+		delete(c.trees,oldest)
+	}
+}
+
+/*
+Performs CMD_Merkle.
+*/
+func (db *DB) merkle(tx *badger.Txn, req *rpcmux.Request, msg *kvtp.Request) {
+	s,ok := parseScope(msg)
+	if !ok || int(msg.Limit)>kvtp.MERKLE_Depth || len(msg.End)%4!=0 {
+		req.Reply(respErr(kvtp.ERR_InvalidKey,"Invalid Merkle request",db.Resps))
+		req.Release()
+		return
+	}
+	idx := make([]uint32,len(msg.End)/4)
+	for i := range idx { idx[i] = binary.BigEndian.Uint32(msg.End[i*4:]) }
+	resp := respNew(kvtp.RESP_Entries,db.Resps)
+	
+	if msg.Flags&kvtp.FLAG_KeysOnly!=0 {
+		leaves := make(map[uint32]bool,len(idx))
+		for _,i := range idx { leaves[i] = true }
+		s.each(tx,func(key []byte, h, ts uint64, deleted bool) {
+			if !leaves[leafOf(h)] { return }
+			e := resp.AddEntry()
+			e.Code = kvtp.RESP_Value
+			if deleted { e.Code = kvtp.RESP_NotFound }
+			e.Key = append(e.Key,key...)
+			e.Version = ts
+		})
+		req.Reply(resp)
+		req.Release()
+		return
+	}
+	
+	maxAge := db.MerkleMaxAge
+	if maxAge<=0 { maxAge = DefaultMerkleMaxAge }
+	level := db.merkles.get(tx,msg,&s,maxAge).levels[msg.Limit]
+	for _,i := range idx {
+		e := resp.AddEntry()
+		e.Code = kvtp.RESP_Value
+		e.Version = uint64(i)
+		if int(i)>=len(level) {
+			e.SetError(kvtp.ERR_InvalidKey,"No such node")
+			continue
+		}
+		e.Val = append(e.Val[:0],make([]byte,8)...)
+		binary.BigEndian.PutUint64(e.Val,level[i])
+	}
+	req.Reply(resp)
+	req.Release()
+}
@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+)
+
+func TestMerkleCache(t *testing.T) {
+	tdb := openDB(t,nil)
+	tx := tdb.DB.DB.NewTransaction(false)
+	defer tx.Discard()
+	var c merkleCache
+	get := func(k1 uint64) *merkleTree {
+		msg := &kvtp.Request{Val:make([]byte,16)}
+		binary.BigEndian.PutUint64(msg.Val,k1)
+		s,_ := parseScope(msg)
+		return c.get(tx,msg,&s,time.Minute)
+	}
+	
+	first := get(0)
+	if get(0)!=first { t.Fatal("the tree of a scope has been rebuilt") }
+	for i := 1 ; i<2*merkleMaxTrees ; i++ { get(uint64(i)) }
+	if len(c.trees)>merkleMaxTrees { t.Fatalf("%d trees cached, want at most %d",len(c.trees),merkleMaxTrees) }
+	if get(0)==first { t.Fatal("the oldest tree has not been evicted") }
+}
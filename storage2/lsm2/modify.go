@@ -0,0 +1,219 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lsm2
+
+import (
+	"strconv"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+func incr(cur []byte, delta int64) ([]byte,uint8,string) {
+	i,err := strconv.ParseInt(string(cur),10,64)
+	if err!=nil { return nil,kvtp.ERR_NotInteger,"Value is not an integer" }
+	n := i+delta
+	if (delta>0 && n<i) || (delta<0 && n>i) { return nil,kvtp.ERR_Overflow,"Increment overflows" }
+	return strconv.AppendInt(cur[:0],n,10),kvtp.ERR_None,""
+}
+
+/*
+Performs CMD_Incr and CMD_Append. As the writer is the only goroutine, that writes
+to the DB, the read-modify-write cycle is atomic.
+*/
+func (w *writer) modify(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	item,done := w.lookup(req,msg)
+	if done { return }
+	
+	var val []byte
+	expiresAt := msg.ExpiresAt
+	if item==nil { expiresAt = db.expiresAt(msg.Namespace,expiresAt) }
+	if item!=nil {
+		var err error
+		val,err = valueCopy(item,nil)
+		if err!=nil {
+			w.reply(req,respFail(err,db.Resps))
+			return
+		}
+		if expiresAt==0 { expiresAt = item.ExpiresAt() }
+	}
+	
+	switch msg.Cmd {
+	case kvtp.CMD_Incr:
+		if item==nil {
+			val = strconv.AppendInt(val,msg.Initial,10)
+		} else {
+			var code uint8
+			var e string
+			val,code,e = incr(val,msg.Delta)
+			if code!=kvtp.ERR_None {
+				w.reply(req,respErr(code,e,db.Resps))
+				return
+			}
+		}
+	case kvtp.CMD_Append:
+		val = append(val,msg.Val...)
+	}
+	
+	if !db.DS.HasEnoughDiskSpace(msg.Key,val) {
+		/*
+		The other node does not have the key, so it just stores, what we give it:
+		The new value as Initial, or as suffix to an empty value.
+		*/
+		if item!=nil {
+			switch msg.Cmd {
+			case kvtp.CMD_Incr:
+				msg.Initial,_ = strconv.ParseInt(string(val),10,64)
+			case kvtp.CMD_Append:
+				msg.Val = append(msg.Val[:0],val...)
+			}
+		}
+		msg.ExpiresAt = expiresAt
+		w.redirectWrite(req,msg)
+		return
+	}
+	
+	key := nsKey(msg.Namespace,msg.Key)
+	ent := &badger.Entry{Key: key, Value: stamp(w.stampFor(key,msg.Timestamp),val), UserMeta: t_stamped, ExpiresAt: expiresAt}
+	err := w.setEntry(ent)
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	db.DS.AccountForDiskSpace(msg.Key,val)
+	
+	cmd := msg.Cmd
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			w.reply(req,respFail(e,db.Resps))
+			return
+		}
+		resp := respNew(kvtp.RESP_None,db.Resps)
+		if cmd==kvtp.CMD_Incr {
+			resp.Code = kvtp.RESP_Value
+			resp.Val = append(resp.Val,val...)
+		}
+		w.reply(req,resp)
+	})
+}
+
+/*
+Performs CMD_Touch with ExpiresAt: Updates the expiration time of the key.
+*/
+func (w *writer) touch(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	key := nsKey(msg.Namespace,msg.Key)
+	item,err := w.tx.Get(key)
+	if err==nil && item.UserMeta()==t_tombstone { err = badger.ErrKeyNotFound }
+	if err==badger.ErrKeyNotFound {
+		resp := respNew(kvtp.RESP_Value,db.Resps)
+		resp.Val = append(resp.Val,"not_found"...)
+		w.reply(req,resp)
+		return
+	} else if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	
+	val,err := item.ValueCopy(nil)
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	
+	// Update the entry or the redirect pointer. An entry gets a new timestamp, so the
+	// expiration time is repaired on the other replicas.
+	ent := &badger.Entry{Key: key, Value: val, UserMeta: item.UserMeta(), ExpiresAt: msg.ExpiresAt}
+	if ent.UserMeta!=t_redirect {
+		val,_ = unstamp(ent.UserMeta,val)
+		ent.Value = stamp(w.stampFor(key,msg.Timestamp),val)
+		ent.UserMeta = t_stamped
+	}
+	if item.UserMeta()==t_redirect { ent.Key = append([]byte{},key...) }
+	err = w.setEntry(ent)
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	if item.UserMeta()==t_redirect && db.RR!=nil && !noRedirect(msg) {
+		msg.Flags |= kvtp.FLAG_NoRedirect
+		if !db.RR.RedirectRead(string(val),req) {
+			w.reply(req,respErr(kvtp.ERR_RedirectFailed,"Redirection failed",db.Resps))
+		}
+		return
+	}
+	
+	expiresAt := msg.ExpiresAt
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			w.reply(req,respFail(e,db.Resps))
+			return
+		}
+		resp := respNew(kvtp.RESP_Value,db.Resps)
+		resp.ExpiresAt = expiresAt
+		resp.Val = append(resp.Val,"ok"...)
+		w.reply(req,resp)
+	})
+}
+
+/*
+Performs CMD_Delete. If the key has been redirected, the redirect pointer is
+removed and the request is forwarded to the other node.
+*/
+func (w *writer) remove(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	key := nsKey(msg.Namespace,msg.Key)
+	item,err := w.tx.Get(key)
+	if msg.Timestamp!=0 && (err!=nil || item.UserMeta()!=t_redirect) {
+		w.removeStamped(req,msg)
+		return
+	}
+	if err==nil && item.UserMeta()==t_tombstone { err = badger.ErrKeyNotFound }
+	if err==badger.ErrKeyNotFound {
+		w.reply(req,respNew(kvtp.RESP_NotFound,db.Resps))
+		return
+	} else if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	redirect := item.UserMeta()==t_redirect
+	var node string
+	if redirect { node = getstr(item) }
+	
+	err = w.delete(append([]byte{},key...))
+	if err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	if redirect && db.RR!=nil && !noRedirect(msg) {
+		msg.Flags |= kvtp.FLAG_NoRedirect
+		if !db.RR.RedirectRead(node,req) {
+			w.reply(req,respErr(kvtp.ERR_RedirectFailed,"Redirection failed",db.Resps))
+		}
+		return
+	}
+	w.bj.add(req)
+}
@@ -0,0 +1,333 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lsm2
+
+import (
+	"sync"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+An entry of a response, that points to another node.
+*/
+type redirect struct{
+	index int
+	node  string
+}
+
+func (db *DB) newRequest() *kvtp.Request {
+	if db.Reqs!=nil {
+		r := db.Reqs.Get().(*kvtp.Request)
+		r.Reset()
+		return r
+	}
+	return kvtp.NewRequest().(*kvtp.Request)
+}
+
+/*
+Returns a request of newRequest to the pool. Only after its reply arrived, as
+the stream may still send it before.
+*/
+func (db *DB) freeRequest(r *kvtp.Request) {
+	if db.Reqs!=nil { db.Reqs.Put(r) }
+}
+
+/*
+Sends msg to node and waits for the response.
+
+The caller must call release(), if resp is not nil.
+*/
+func (db *DB) call(node string, msg *kvtp.Request, req *rpcmux.Request) (resp *kvtp.Response,release func()) {
+	if db.NC==nil { return }
+	cli,ok := db.NC.NodeClient(node)
+	if !ok { return }
+	r,err := cli.Request(msg,req.Context())
+	if err!=nil { return }
+	rmsg,err := r.Get()
+	if err!=nil { r.Release(); return }
+	resp,ok = rmsg.(*kvtp.Response)
+	if !ok { r.Release(); return }
+	release = r.Release
+	return
+}
+
+/*
+Fetches the redirected entries of resp from their nodes. One CMD_MultiGet is sent per node.
+
+Entries, that could not be fetched, get the code RESP_Error and ERR_RedirectFailed.
+*/
+func (db *DB) fanOut(req *rpcmux.Request, ns string, resp *kvtp.Response, redirs []redirect) {
+	nodes := make(map[string][]int)
+	for _,r := range redirs {
+		nodes[r.node] = append(nodes[r.node],r.index)
+	}
+	var wg sync.WaitGroup
+	for node,idx := range nodes {
+		wg.Add(1)
+		go func(node string, idx []int) {
+			defer wg.Done()
+			msg := db.newRequest()
+			msg.Cmd = kvtp.CMD_MultiGet
+			msg.Flags = kvtp.FLAG_NoRedirect
+			msg.Namespace = ns
+			for _,i := range idx {
+				e := msg.AddEntry()
+				e.Key = append(e.Key,resp.Entries[i].Key...)
+			}
+			rr,release := db.call(node,msg,req)
+			if rr!=nil { defer db.freeRequest(msg) }
+			if rr==nil || rr.Code!=kvtp.RESP_Entries || len(rr.Entries)!=len(idx) {
+				for _,i := range idx {
+					e := &resp.Entries[i]
+					e.SetError(kvtp.ERR_RedirectFailed,"Redirection failed")
+				}
+				if release!=nil { release() }
+				return
+			}
+			defer release()
+			for j,i := range idx {
+				e,re := &resp.Entries[i],&rr.Entries[j]
+				e.Code = re.Code
+				e.Err = re.Err
+				e.Val = append(e.Val[:0],re.Val...)
+				e.Version = re.Version
+				if re.ExpiresAt!=0 { e.ExpiresAt = re.ExpiresAt }
+			}
+		}(node,idx)
+	}
+	wg.Wait()
+}
+
+func (db *DB) multiGet(tx *badger.Txn, req *rpcmux.Request, msg *kvtp.Request) {
+	resp := respNew(kvtp.RESP_Entries,db.Resps)
+	var redirs []redirect
+	for i := range msg.Entries {
+		e := resp.AddEntry()
+		e.Key = append(e.Key,msg.Entries[i].Key...)
+		item,err := tx.Get(nsKey(msg.Namespace,e.Key))
+		if err==nil {
+			switch item.UserMeta() {
+			case t_data,t_stamped:
+			case t_redirect:
+				if db.NC!=nil && !noRedirect(msg) {
+					redirs = append(redirs,redirect{i,getstr(item)})
+					continue
+				}
+				e.SetError(kvtp.ERR_RedirectFailed,"Redirection failed")
+				continue
+			default:
+				e.Code = kvtp.RESP_NotFound
+				continue
+			}
+			e.Code = kvtp.RESP_Value
+			e.ExpiresAt = item.ExpiresAt()
+			e.Version = item.Version()
+			e.Val,err = valueCopy(item,e.Val)
+		}
+		if err==badger.ErrKeyNotFound {
+			e.Code = kvtp.RESP_NotFound
+			e.Val = e.Val[:0]
+		} else if err!=nil {
+			e.SetError(errCode(err),err.Error())
+		}
+	}
+	if len(redirs)!=0 {
+		go func() {
+			defer req.Release()
+			db.fanOut(req,msg.Namespace,resp,redirs)
+			req.Reply(resp)
+		}()
+		return
+	}
+	req.Reply(resp)
+	req.Release()
+}
+
+/*
+Writes the entries, that don't fit on this node, to another node.
+
+Returns the node and a function, that waits for it and merges its results into
+resp. The function returns the entries, that have been written.
+*/
+func (w *writer) spill(req *rpcmux.Request, msg *kvtp.Request, resp *kvtp.Response, spilled []int) (string,func() []int) {
+	db := w.db
+	fail := func(code uint8, s string) {
+		for _,i := range spilled {
+			resp.Entries[i].SetError(code,s)
+		}
+	}
+	if db.NS==nil || db.NC==nil || noRedirect(msg) {
+		fail(kvtp.ERR_DiskFull,"Disk full and not redirection")
+		return "",nil
+	}
+	node,ok := db.NS.SelectNode()
+	if !ok {
+		fail(kvtp.ERR_DiskFull,"Disk full and not redirection")
+		return "",nil
+	}
+	cli,ok := db.NC.NodeClient(node)
+	if !ok {
+		fail(kvtp.ERR_RedirectFailed,"Redirection failed")
+		return "",nil
+	}
+	sub := db.newRequest()
+	sub.Cmd = kvtp.CMD_MultiPut
+	sub.Flags = kvtp.FLAG_NoRedirect
+	sub.Namespace = msg.Namespace
+	for _,i := range spilled {
+		e,se := &msg.Entries[i],sub.AddEntry()
+		se.Key = append(se.Key,e.Key...)
+		se.Val = append(se.Val,e.Val...)
+		se.ExpiresAt = e.ExpiresAt
+	}
+	r,err := cli.Request(sub,req.Context())
+	if err!=nil {
+		fail(kvtp.ERR_RedirectFailed,"Redirection failed")
+		return "",nil
+	}
+	return node,func() (written []int) {
+		defer r.Release()
+		rmsg,err := r.Get()
+		if err==nil { defer db.freeRequest(sub) }
+		rr,ok := rmsg.(*kvtp.Response)
+		if err!=nil || !ok || rr.Code!=kvtp.RESP_Entries || len(rr.Entries)!=len(spilled) {
+			fail(kvtp.ERR_RedirectFailed,"Redirection failed")
+			return
+		}
+		for j,i := range spilled {
+			e := &resp.Entries[i]
+			e.Code = rr.Entries[j].Code
+			e.Err = rr.Entries[j].Err
+			e.Val = append(e.Val[:0],rr.Entries[j].Val...)
+			if e.Code==kvtp.RESP_None { written = append(written,i) }
+		}
+		return
+	}
+}
+
+/*
+Stores redirect pointers to node for the entries idx of msg, that have been written
+there. Replies resp, once they are committed.
+*/
+func (db *DB) pointTo(req *rpcmux.Request, msg *kvtp.Request, resp *kvtp.Response, node string, idx []int) {
+	fail := func(code uint8, s string) {
+		for _,i := range idx {
+			if resp.Entries[i].Code==kvtp.RESP_None { resp.Entries[i].SetError(code,s) }
+		}
+	}
+	ok := db.onWriter(func(w *writer) {
+		// The pointers must be committed together with the hook.
+		if w.dirty { w.flush() }
+		for _,i := range idx {
+			e := &msg.Entries[i]
+			ent := &badger.Entry{Key:append([]byte{},nsKey(msg.Namespace,e.Key)...),Value:[]byte(node),UserMeta:t_redirect,ExpiresAt:e.ExpiresAt}
+			if err := w.set(ent); err!=nil { resp.Entries[i].SetError(errCode(err),err.Error()) }
+		}
+		w.arm()
+		w.bj.addHook(func(e error) {
+			if e!=nil { fail(errCode(e),e.Error()) }
+			req.Reply(resp)
+			req.Release()
+		})
+	})
+	if !ok {
+		fail(kvtp.ERR_Internal,"Shutting down")
+		req.Reply(resp)
+		req.Release()
+	}
+}
+
+/*
+Performs CMD_MultiPut. The entries are written in one batch. If they don't fit
+into one, ERR_TxnTooBig is replied and nothing is written.
+
+Entries, that don't fit on the disk, are written to another node, see spill.
+Their redirect pointers are stored, once the other node succeeded.
+*/
+func (w *writer) multiPut(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	
+	// The request must be the only one in the Txn, so it can be rolled back.
+	if w.dirty { w.flush() }
+	
+	resp := respNew(kvtp.RESP_Entries,db.Resps)
+	events := len(w.bj.events)
+	var local,spilled []int
+	for i := range msg.Entries {
+		e,re := &msg.Entries[i],resp.AddEntry()
+		re.Code = kvtp.RESP_None
+		if !db.DS.HasEnoughDiskSpace(e.Key,e.Val) {
+			spilled = append(spilled,i)
+			continue
+		}
+		key := nsKey(msg.Namespace,e.Key)
+		err := w.set(&badger.Entry{Key: key, Value: stamp(w.stampFor(key,msg.Timestamp),e.Val), UserMeta: t_stamped, ExpiresAt: e.ExpiresAt})
+		if err==badger.ErrTxnTooBig {
+			w.rollback(events)
+			resp.Entries = resp.Entries[:0]
+			resp.SetError(errCode(err),err.Error())
+			w.reply(req,resp)
+			return
+		}
+		if err!=nil {
+			re.SetError(errCode(err),err.Error())
+			continue
+		}
+		local = append(local,i)
+	}
+	var node string
+	var wait func() []int
+	if len(spilled)!=0 {
+		node,wait = w.spill(req,msg,resp,spilled)
+	}
+	w.arm()
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			code,s := errCode(e),e.Error()
+			for _,i := range local { resp.Entries[i].SetError(code,s) }
+		} else {
+			for _,i := range local {
+				me := &msg.Entries[i]
+				db.DS.AccountForDiskSpace(me.Key,me.Val)
+			}
+		}
+		if wait==nil {
+			req.Reply(resp)
+			req.Release()
+			return
+		}
+		go func() {
+			written := wait()
+			if len(written)==0 {
+				req.Reply(resp)
+				req.Release()
+				return
+			}
+			db.pointTo(req,msg,resp,node,written)
+		}()
+	})
+}
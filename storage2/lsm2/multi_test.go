@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/routing"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Another node, entries are spilled to. Implements NodeSelector, NodeClients and
+RedirectReader.
+*/
+type peer struct{
+	name string
+	cli  rpcmux.Client
+	down bool
+}
+func (p *peer) SelectNode() (string,bool) { return p.name,true }
+func (p *peer) NodeClient(node string) (rpcmux.Client,bool) {
+	return p.cli,node==p.name && !p.down
+}
+func (p *peer) RedirectRead(node string, req *rpcmux.Request) bool {
+	return node==p.name && routing.Forward(req,p.cli)==nil
+}
+
+func (tdb *testDB) has(key string) (meta byte, ok bool) {
+	tdb.DB.DB.View(func(tx *badger.Txn) error {
+		item,err := tx.Get([]byte(key))
+		if err==nil { meta,ok = item.UserMeta(),true }
+		return nil
+	})
+	return
+}
+
+func multiPut(r *kvtp.Request, n int, prefix string) {
+	r.Cmd = kvtp.CMD_MultiPut
+	for i := 0 ; i<n ; i++ {
+		e := r.AddEntry()
+		e.Key = append(e.Key,fmt.Sprint(prefix,i)...)
+		e.Val = append(e.Val,"v"...)
+	}
+}
+
+/*
+A CMD_MultiPut, that does not fit into one batch, is refused as a whole.
+*/
+func TestMultiPutTooBig(t *testing.T) {
+	tdb := openDB(t,nil)
+	if err := tdb.cli.Put(context.Background(),[]byte("before"),[]byte("v")); err!=nil { t.Fatal(err) }
+	err := tdb.cli.Do(context.Background(),func(r *kvtp.Request) { multiPut(r,5000,"k") },nil)
+	if errCodeOf(err)!=kvtp.ERR_TxnTooBig { t.Fatalf("got %v, want ERR_TxnTooBig",err) }
+	for _,k := range []string{"k0","k4999"} {
+		if _,ok := tdb.has(k); ok { t.Errorf("%s has been written",k) }
+	}
+	if v := tdb.value(t,"before"); v!="v" { t.Errorf("earlier write lost: %q",v) }
+	
+	resp := tdb.do(t,func(r *kvtp.Request) { multiPut(r,100,"k") })
+	for i,e := range resp.Entries {
+		if e.Code!=kvtp.RESP_None { t.Fatalf("entry %d: %d %s",i,e.Code,e.Val) }
+	}
+}
+
+/*
+Entries, that don't fit on the disk, are written to another node. A redirect
+pointer is stored only, if that succeeded.
+*/
+func TestMultiPutSpill(t *testing.T) {
+	other := openDB(t,nil)
+	p := &peer{name:"other",cli:other.raw}
+	tdb := openDB(t,func(db *DB) {
+		db.DS = fullDisk{}
+		db.NS,db.NC,db.RR = p,p,p
+	})
+	resp := tdb.do(t,func(r *kvtp.Request) { multiPut(r,3,"a") })
+	for i,e := range resp.Entries {
+		if e.Code!=kvtp.RESP_None { t.Fatalf("entry %d: %d %s",i,e.Code,e.Val) }
+		k := fmt.Sprint("a",i)
+		if meta,_ := tdb.has(k); meta!=t_redirect { t.Errorf("%s: meta %d",k,meta) }
+		if v := tdb.value(t,k); v!="v" { t.Errorf("%s: %q",k,v) }
+	}
+	
+	// The other node is full too.
+	full := openDB(t,func(db *DB) { db.DS = fullDisk{} })
+	p.cli = full.raw
+	resp = tdb.do(t,func(r *kvtp.Request) { multiPut(r,3,"b") })
+	for i,e := range resp.Entries {
+		if e.Code!=kvtp.RESP_Error || e.Err!=kvtp.ERR_DiskFull { t.Errorf("entry %d: %d %d",i,e.Code,e.Err) }
+		if _,ok := tdb.has(fmt.Sprint("b",i)); ok { t.Errorf("b%d: redirect pointer stored",i) }
+	}
+	
+	// The other node can't be reached.
+	p.down = true
+	resp = tdb.do(t,func(r *kvtp.Request) { multiPut(r,3,"c") })
+	for i,e := range resp.Entries {
+		if e.Code!=kvtp.RESP_Error || e.Err!=kvtp.ERR_RedirectFailed { t.Errorf("entry %d: %d %d",i,e.Code,e.Err) }
+		if _,ok := tdb.has(fmt.Sprint("c",i)); ok { t.Errorf("c%d: redirect pointer stored",i) }
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lsm2
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Keys starting with this byte are internal.
+
+Keys of a namespace are stored as 0xFF 'n' <len(ns)> <ns> <key>. Keys of the
+default namespace are stored as they are.
+*/
+const keyReserved = 0xFF
+
+var errQuota = errors.New("Namespace quota exceeded")
+
+/*
+Configuration of a namespace.
+*/
+type Namespace struct{
+	DefaultTTL time.Duration // Applied to writes without ExpiresAt.
+	MaxKeys  int64 // Quota: Number of keys, 0 -> unlimited.
+	MaxBytes int64 // Quota: Size of keys (without namespace) and values (without timestamp), 0 -> unlimited.
+}
+
+func nsPrefix(ns string) []byte {
+	if ns=="" { return nil }
+	return append([]byte{keyReserved,'n',byte(len(ns))},ns...)
+}
+
+/*
+Returns the key, under which key of namespace ns is stored.
+*/
+func nsKey(ns string, key []byte) []byte {
+	if ns=="" { return key }
+	k := make([]byte,0,3+len(ns)+len(key))
+	k = append(k,keyReserved,'n',byte(len(ns)))
+	k = append(k,ns...)
+	return append(k,key...)
+}
+
+/*
+Returns the namespace of a stored key.
+*/
+func nsOf(key []byte) string {
+	if len(key)<3 || key[0]!=keyReserved || key[1]!='n' { return "" }
+	n := int(key[2])
+	if len(key)<3+n { return "" }
+	return string(key[3:3+n])
+}
+
+/*
+Reports, whether key is internal and not part of any namespace.
+*/
+func internal(key []byte) bool {
+	return len(key)!=0 && key[0]==keyReserved && (len(key)<2 || key[1]!='n')
+}
+
+/*
+Returns the size of a stored key without the namespace prefix.
+*/
+func keySize(key []byte) int64 {
+	if ns := nsOf(key); ns!="" { return int64(len(key)-3-len(ns)) }
+	return int64(len(key))
+}
+
+/*
+Validates the namespace and the keys of a request.
+*/
+func checkRequest(msg *kvtp.Request) (uint8,string) {
+	if len(msg.Namespace)>0xFF { return kvtp.ERR_InvalidKey,"Namespace too long" }
+	if msg.Namespace!="" { return kvtp.ERR_None,"" }
+	if len(msg.Key)!=0 && msg.Key[0]==keyReserved { return kvtp.ERR_InvalidKey,"Reserved key" }
+	
+	// The Entries of CMD_Merkle are hash ranges.
+	if msg.Cmd==kvtp.CMD_Merkle { return kvtp.ERR_None,"" }
+	for i := range msg.Entries {
+		k := msg.Entries[i].Key
+		if len(k)!=0 && k[0]==keyReserved { return kvtp.ERR_InvalidKey,"Reserved key" }
+	}
+	return kvtp.ERR_None,""
+}
+
+/*
+Returns the expiration time for a new value, applying the default TTL of the namespace.
+*/
+func (db *DB) expiresAt(ns string, expiresAt uint64) uint64 {
+	if expiresAt!=0 { return expiresAt }
+	cfg := db.Spaces[ns]
+	if cfg==nil || cfg.DefaultTTL<=0 { return 0 }
+	return uint64(time.Now().Add(cfg.DefaultTTL).Unix())
+}
+
+/*
+Returns the number of keys and bytes, an entry uses of the quota. Tombstones use
+nothing, and neither do redirect pointers: Their value is stored, and accounted
+for, on the node, they point to.
+*/
+func quotaUse(key []byte, meta byte, size int64) (keys, bytes int64) {
+	switch meta {
+	case t_data: return 1,keySize(key)+size
+	case t_stamped: return 1,keySize(key)+size-8
+	}
+	return 0,0
+}
+
+/*
+Usage of a namespace with quota.
+
+The namespace is counted in the background, on a snapshot, that is taken at the
+start of a batch. The writes since the snapshot are added to the count. Until the
+first count is done, keys and bytes only contain the writes since.
+*/
+type usage struct{
+	cfg *Namespace
+	keys, bytes int64
+	counted time.Time
+	stale bool // Counted at the start of the next batch.
+	gen   int // Of the latest count.
+	counting bool
+	dkeys, dbytes int64 // Writes since the snapshot of the count in progress.
+}
+func (u *usage) exceeds(dkeys, dbytes int64) bool {
+	if u.cfg.MaxKeys!=0 && dkeys>0 && u.keys+dkeys>u.cfg.MaxKeys { return true }
+	if u.cfg.MaxBytes!=0 && dbytes>0 && u.bytes+dbytes>u.cfg.MaxBytes { return true }
+	return false
+}
+func (u *usage) add(dkeys, dbytes int64) {
+	u.keys += dkeys
+	u.bytes += dbytes
+	if u.counting {
+		u.dkeys += dkeys
+		u.dbytes += dbytes
+	}
+}
+
+/*
+Returns the usage of a namespace, or nil, if it has no quota.
+*/
+func (w *writer) usage(ns string) *usage {
+	cfg := w.db.Spaces[ns]
+	if cfg==nil || (cfg.MaxKeys==0 && cfg.MaxBytes==0) { return nil }
+	if w.usages==nil { w.usages = make(map[string]*usage) }
+	u := w.usages[ns]
+	if u==nil {
+		u = &usage{cfg:cfg,stale:true}
+		w.usages[ns] = u
+	}
+	return u
+}
+
+/*
+Lets all namespaces be recounted, after writes, that have been accounted for,
+failed.
+*/
+func (w *writer) recount() {
+	for _,u := range w.usages { u.stale = true }
+}
+
+/*
+Starts counting the stale namespaces. Called at the start of a batch, so the
+snapshot contains all flushed batches and none of the writes to come.
+*/
+func (w *writer) count() {
+	if atomic.SwapInt32(&w.db.failed,0)!=0 { w.recount() }
+	for ns,u := range w.usages {
+		if !u.stale { continue }
+		u.stale = false
+		u.gen++
+		u.counting = true
+		u.dkeys,u.dbytes = 0,0
+		w.db.wg.Add(1)
+		go w.db.count(ns,u,u.gen,w.db.DB.NewTransaction(false))
+	}
+}
+
+/*
+Counts the keys and bytes of a namespace in snap and hands the result to the
+writer. Expired keys are not counted.
+*/
+func (db *DB) count(ns string, u *usage, gen int, snap *badger.Txn) {
+	defer db.wg.Done()
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = nsPrefix(ns)
+	var keys,bytes int64
+	it := snap.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if ns=="" && len(item.Key())!=0 && item.Key()[0]==keyReserved { break }
+		k,b := quotaUse(item.Key(),item.UserMeta(),item.ValueSize())
+		keys,bytes = keys+k,bytes+b
+	}
+	it.Close()
+	snap.Discard()
+	db.onWriter(func(w *writer) {
+		if u.gen!=gen { return } // Superseded by another count.
+		u.keys,u.bytes = keys+u.dkeys,bytes+u.dbytes
+		u.counting = false
+		u.counted = time.Now()
+	})
+}
+
+/*
+Checks the quota, before ent is written. Returns a function, that accounts for
+the write, once it succeeded.
+
+Keys, that expired, are still accounted for, until the namespace is recounted.
+This happens at most once a second, when the quota appears to be exceeded.
+The write is refused nonetheless, as the count runs in the background.
+*/
+func (w *writer) charge(ent *badger.Entry) (func(),error) {
+	if internal(ent.Key) { return func(){},nil }
+	u := w.usage(nsOf(ent.Key))
+	if u==nil { return func(){},nil }
+	dkeys,dbytes := quotaUse(ent.Key,ent.UserMeta,int64(len(ent.Value)))
+	if item,err := w.tx.Get(ent.Key); err==nil {
+		k,b := quotaUse(ent.Key,item.UserMeta(),item.ValueSize())
+		dkeys,dbytes = dkeys-k,dbytes-b
+	}
+	if u.exceeds(dkeys,dbytes) {
+		if !u.counting && time.Since(u.counted)>time.Second { u.stale = true }
+		return nil,errQuota
+	}
+	return func() { u.add(dkeys,dbytes) },nil
+}
+
+/*
+Returns a function, that accounts for the deletion of key, once it succeeded.
+*/
+func (w *writer) discharge(key []byte) func() {
+	if internal(key) { return func(){} }
+	u := w.usage(nsOf(key))
+	if u==nil { return func(){} }
+	item,err := w.tx.Get(key)
+	if err!=nil { return func(){} }
+	keys,bytes := quotaUse(key,item.UserMeta(),item.ValueSize())
+	return func() { u.add(-keys,-bytes) }
+}
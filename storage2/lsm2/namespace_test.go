@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+	"github.com/dgraph-io/badger"
+)
+
+func quotaDB(t *testing.T, maxKeys int64) (*testDB,*client.Client) {
+	tdb := openDB(t,func(db *DB) {
+		db.Spaces = map[string]*Namespace{"q":&Namespace{MaxKeys:maxKeys}}
+	})
+	cli := client.Over(tdb.raw,nil)
+	cli.Namespace = "q"
+	return tdb,cli
+}
+
+/*
+Returns the number of keys in namespace q, as reported by CMD_Stat, or -1.
+*/
+func (tdb *testDB) usedKeys(t *testing.T) int64 {
+	stats,err := tdb.cli.Stat(context.Background(),nil)
+	if err!=nil { t.Fatal(err) }
+	for _,s := range stats {
+		if s.Name!="namespace.q.keys" { continue }
+		var n int64
+		fmt.Sscan(s.Value,&n)
+		return n
+	}
+	return -1
+}
+
+/*
+Waits, until namespace q has been counted with n keys.
+*/
+func (tdb *testDB) waitKeys(t *testing.T, n int64) {
+	for i := 0 ; i<100 ; i++ {
+		if tdb.usedKeys(t)==n { return }
+		// The count starts with the next batch.
+		tdb.cli.Put(context.Background(),[]byte("tick"),nil)
+		time.Sleep(10*time.Millisecond)
+	}
+	t.Fatalf("%d keys, want %d",tdb.usedKeys(t),n)
+}
+
+func TestQuotaCountsExistingKeys(t *testing.T) {
+	tdb,cli := quotaDB(t,4)
+	ctx := context.Background()
+	err := tdb.DB.DB.Update(func(tx *badger.Txn) error {
+		for i := 0 ; i<4 ; i++ {
+			if err := tx.Set(nsKey("q",[]byte(fmt.Sprint("old",i))),nil); err!=nil { return err }
+		}
+		return nil
+	})
+	if err!=nil { t.Fatal(err) }
+	
+	// Until the count is done, only the writes since are checked.
+	if err := cli.Put(ctx,[]byte("new"),nil); err!=nil { t.Fatal(err) }
+	tdb.waitKeys(t,5)
+	err = cli.Put(ctx,[]byte("newer"),nil)
+	if e,ok := err.(*client.Error); !ok || e.Code!=kvtp.ERR_QuotaExceeded { t.Fatalf("got %v, want QuotaExceeded",err) }
+	if err := cli.Put(ctx,[]byte("new"),[]byte("overwrite")); err!=nil { t.Fatal(err) }
+	if _,err := cli.Delete(ctx,[]byte("old0")); err!=nil { t.Fatal(err) }
+	if _,err := cli.Delete(ctx,[]byte("old1")); err!=nil { t.Fatal(err) }
+	if err := cli.Put(ctx,[]byte("newer"),nil); err!=nil { t.Fatal(err) }
+}
+
+/*
+Writes, that have been accounted for, but failed to commit, must not use up the quota.
+*/
+func TestQuotaRecountAfterFailedBatch(t *testing.T) {
+	tdb,cli := quotaDB(t,2)
+	ctx := context.Background()
+	if err := cli.Put(ctx,[]byte("a"),nil); err!=nil { t.Fatal(err) }
+	tdb.waitKeys(t,1)
+	
+	// As if a batch with a write to a new key failed.
+	tdb.onWriter(func(w *writer) { w.usages["q"].add(1,1) })
+	atomic.StoreInt32(&tdb.failed,1)
+	err := cli.Put(ctx,[]byte("b"),nil)
+	if e,ok := err.(*client.Error); !ok || e.Code!=kvtp.ERR_QuotaExceeded { t.Fatalf("got %v, want QuotaExceeded",err) }
+	tdb.waitKeys(t,1)
+	if err := cli.Put(ctx,[]byte("b"),nil); err!=nil { t.Fatal(err) }
+}
+
+/*
+A recount must agree with the accounting of the writes: Tombstones use no quota.
+*/
+func TestQuotaRecountSkipsTombstones(t *testing.T) {
+	tdb,cli := quotaDB(t,2)
+	ctx := context.Background()
+	if err := cli.Put(ctx,[]byte("a"),nil); err!=nil { t.Fatal(err) }
+	if err := cli.Put(ctx,[]byte("b"),nil); err!=nil { t.Fatal(err) }
+	resp := tdb.do(t,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Delete
+		r.Namespace = "q"
+		r.Key = append(r.Key,"a"...)
+		r.Timestamp = uint64(time.Now().UnixNano())
+	})
+	if resp.Code!=kvtp.RESP_None { t.Fatalf("delete: %d",resp.Code) }
+	tdb.waitKeys(t,1)
+	
+	counted := func() (c time.Time) {
+		done := make(chan struct{})
+		tdb.onWriter(func(w *writer) { c = w.usages["q"].counted; close(done) })
+		<- done
+		return
+	}
+	before := counted()
+	atomic.StoreInt32(&tdb.failed,1)
+	for i := 0 ; counted()==before ; i++ {
+		if i==100 { t.Fatal("no recount") }
+		tdb.cli.Put(ctx,[]byte("tick"),nil)
+		time.Sleep(10*time.Millisecond)
+	}
+	if n := tdb.usedKeys(t); n!=1 { t.Fatalf("%d keys after recount, want 1",n) }
+	if err := cli.Put(ctx,[]byte("c"),nil); err!=nil { t.Fatal(err) }
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lsm2
+
+import (
+	"bytes"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Resolves the redirected entries of a scan and replies. Entries, that could not
+be fetched, keep their error.
+*/
+func (db *DB) scanMerge(req *rpcmux.Request, ns string, resp *kvtp.Response, redirs []redirect) {
+	defer req.Release()
+	db.fanOut(req,ns,resp,redirs)
+	
+	/* Remove the entries, that have been deleted on the other node meanwhile. */
+	j := 0
+	for i := range resp.Entries {
+		if resp.Entries[i].Code==kvtp.RESP_NotFound { continue }
+		if i!=j { resp.Entries[i],resp.Entries[j] = resp.Entries[j],resp.Entries[i] }
+		j++
+	}
+	resp.Entries = resp.Entries[:j]
+	req.Reply(resp)
+}
+
+func (db *DB) scan(tx *badger.Txn, req *rpcmux.Request, msg *kvtp.Request) {
+	keysOnly := msg.Flags&kvtp.FLAG_KeysOnly!=0
+	
+	// Keys are confined to the namespace.
+	base := nsPrefix(msg.Namespace)
+	prefix := base
+	if msg.Flags&kvtp.FLAG_Prefix!=0 { prefix = nsKey(msg.Namespace,msg.Key) }
+	var end []byte
+	if len(msg.End)!=0 && msg.Flags&kvtp.FLAG_Prefix==0 { end = nsKey(msg.Namespace,msg.End) }
+	
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = !keysOnly
+	opts.Prefix = prefix
+	if msg.Limit!=0 && int(msg.Limit)<opts.PrefetchSize { opts.PrefetchSize = int(msg.Limit) }
+	
+	resp := respNew(kvtp.RESP_Entries,db.Resps)
+	
+	var redirs []redirect
+	var err error
+	
+	it := tx.NewIterator(opts)
+	for it.Seek(nsKey(msg.Namespace,msg.Key)); it.Valid(); it.Next() {
+		if msg.Limit!=0 && len(resp.Entries)>=int(msg.Limit) { break }
+		item := it.Item()
+		key := item.Key()
+		if prefix!=nil && !bytes.HasPrefix(key,prefix) { break }
+		if end!=nil && bytes.Compare(key,end)>=0 { break }
+		
+		// Internal keys sort last.
+		if base==nil && len(key)!=0 && key[0]==keyReserved { break }
+		key = key[len(base):]
+		switch item.UserMeta() {
+		case t_data,t_stamped:
+			e := resp.AddEntry()
+			e.Code = kvtp.RESP_Value
+			e.Key = append(e.Key,key...)
+			e.ExpiresAt = item.ExpiresAt()
+			e.Version = item.Version()
+			if keysOnly { continue }
+			e.Val,err = valueCopy(item,e.Val)
+		case t_redirect:
+			e := resp.AddEntry()
+			e.Code = kvtp.RESP_Value
+			e.Key = append(e.Key,key...)
+			e.ExpiresAt = item.ExpiresAt()
+			if keysOnly { continue }
+			if db.NC==nil {
+				e.SetError(kvtp.ERR_RedirectFailed,"Redirection failed")
+				continue
+			}
+			redirs = append(redirs,redirect{len(resp.Entries)-1,getstr(item)})
+		}
+		if err!=nil { break }
+	}
+	it.Close()
+	
+	if err!=nil {
+		resp.SetError(errCode(err),err.Error())
+		resp.Entries = resp.Entries[:0]
+	} else if len(redirs)!=0 {
+		go db.scanMerge(req,msg.Namespace,resp,redirs)
+		return
+	}
+	req.Reply(resp)
+	req.Release()
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"testing"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/dgraph-io/badger"
+)
+
+func (tdb *testDB) scan(t *testing.T, build func(r *kvtp.Request)) *kvtp.Response {
+	resp := tdb.do(t,func(r *kvtp.Request) {
+		r.Cmd = kvtp.CMD_Scan
+		build(r)
+	})
+	if resp.Code!=kvtp.RESP_Entries { t.Fatalf("code %d: %s",resp.Code,resp.Val) }
+	return resp
+}
+
+func TestScanPrefixIgnoresEnd(t *testing.T) {
+	tdb := openDB(t,nil)
+	for _,k := range []string{"a1","a2","a3","b1"} {
+		if err := tdb.cli.Put(context.Background(),[]byte(k),[]byte(k)); err!=nil { t.Fatal(err) }
+	}
+	resp := tdb.scan(t,func(r *kvtp.Request) {
+		r.Flags = kvtp.FLAG_Prefix
+		r.Key = append(r.Key,"a"...)
+		r.End = append(r.End,"a2"...)
+	})
+	if len(resp.Entries)!=3 { t.Fatalf("%d entries, want 3",len(resp.Entries)) }
+}
+
+/*
+Without NodeClients, spilled entries can't be fetched. They must be reported,
+not dropped.
+*/
+func TestScanReportsUnresolvedRedirects(t *testing.T) {
+	tdb := openDB(t,nil)
+	if err := tdb.cli.Put(context.Background(),[]byte("local"),[]byte("x")); err!=nil { t.Fatal(err) }
+	err := tdb.DB.DB.Update(func(tx *badger.Txn) error {
+		return tx.SetEntry(&badger.Entry{Key:[]byte("spilled"),Value:[]byte("other"),UserMeta:t_redirect})
+	})
+	if err!=nil { t.Fatal(err) }
+	
+	resp := tdb.scan(t,func(r *kvtp.Request) {})
+	if len(resp.Entries)!=2 { t.Fatalf("%d entries, want 2",len(resp.Entries)) }
+	e := &resp.Entries[1]
+	if string(e.Key)!="spilled" || e.Code!=kvtp.RESP_Error || e.Err!=kvtp.ERR_RedirectFailed {
+		t.Fatalf("%q: code %d, error %d",e.Key,e.Code,e.Err)
+	}
+}
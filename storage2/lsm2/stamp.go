@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lsm2
+
+import (
+	"encoding/binary"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Tombstones of deletes with a timestamp are kept for this long, if DB.TombstoneTTL is 0.
+*/
+const DefaultTombstoneTTL = 24*time.Hour
+
+/*
+Values written with a timestamp (see kvtp.Request.Timestamp) are stored as
+t_stamped: The timestamp (8 bytes, big endian), followed by the value.
+
+Deletes with a timestamp leave a t_tombstone, that holds just the timestamp. It
+keeps older writes, that arrive late, from resurrecting the key.
+*/
+func stamp(ts uint64, val []byte) []byte {
+	buf := make([]byte,8,8+len(val))
+	binary.BigEndian.PutUint64(buf,ts)
+	return append(buf,val...)
+}
+
+/*
+Returns the value and the timestamp of a stored value.
+*/
+func unstamp(meta byte, val []byte) ([]byte,uint64) {
+	switch meta {
+	case t_stamped,t_tombstone:
+		if len(val)<8 { return val[:0],0 }
+		return val[8:],binary.BigEndian.Uint64(val)
+	}
+	return val,0
+}
+
+/*
+Copies the value of item into dst, without the timestamp.
+*/
+func valueCopy(item *badger.Item, dst []byte) ([]byte,error) {
+	val,err := item.ValueCopy(dst)
+	if err!=nil { return val,err }
+	if item.UserMeta()==t_stamped {
+		n := copy(val,val[8:])
+		val = val[:n]
+	}
+	return val,nil
+}
+
+/*
+Returns the timestamp of item, 0 -> none.
+*/
+func timestamp(item *badger.Item) (ts uint64) {
+	switch item.UserMeta() {
+	case t_stamped,t_tombstone:
+		item.Value(func(val []byte) error {
+			_,ts = unstamp(item.UserMeta(),val)
+			return nil
+		})
+	}
+	return
+}
+
+/*
+Returns the timestamp for a new value of key: ts, or the current time, if ts is 0.
+It is always newer than the timestamp of the current value, so a read repair never
+replaces the new value with the one, it has been derived from.
+*/
+func (w *writer) stampFor(key []byte, ts uint64) uint64 {
+	if ts==0 { ts = uint64(time.Now().UnixNano()) }
+	if item,err := w.tx.Get(key); err==nil {
+		if old := timestamp(item); old>=ts { ts = old+1 }
+	}
+	return ts
+}
+
+/*
+Reports, whether the write of msg is older than the current value of key.
+*/
+func (w *writer) superseded(key []byte, msg *kvtp.Request) bool {
+	if msg.Timestamp==0 { return false }
+	item,err := w.tx.Get(key)
+	if err!=nil { return false }
+	return timestamp(item)>msg.Timestamp
+}
+
+/*
+Performs CMD_ReadRepair and CMD_HintedHandoff: A put or delete with timestamp,
+that is not redirected.
+*/
+func (w *writer) readRepair(req *rpcmux.Request, msg *kvtp.Request) {
+	if msg.Timestamp==0 {
+		w.reply(req,respErr(kvtp.ERR_InvalidKey,"Write without timestamp",w.db.Resps))
+		return
+	}
+	if msg.Cmd==kvtp.CMD_HintedHandoff {
+		w.hints++
+	} else {
+		w.repairs++
+	}
+	msg.Flags |= kvtp.FLAG_NoRedirect
+	if msg.Flags&kvtp.FLAG_Tombstone!=0 {
+		w.removeStamped(req,msg)
+		return
+	}
+	msg.ExpiresAt = w.db.expiresAt(msg.Namespace,msg.ExpiresAt)
+	w.put(req,msg)
+}
+
+/*
+Performs CMD_Delete with a timestamp: Replaces the key with a tombstone. The
+tombstone is written, even if the key does not exist.
+*/
+func (w *writer) removeStamped(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	key := nsKey(msg.Namespace,msg.Key)
+	found := false
+	if item,err := w.tx.Get(key); err==nil {
+		found = item.UserMeta()!=t_tombstone
+	}
+	if w.superseded(key,msg) {
+		w.reply(req,respNew(kvtp.RESP_NotFound,db.Resps))
+		return
+	}
+	ttl := db.TombstoneTTL
+	if ttl==0 { ttl = DefaultTombstoneTTL }
+	ent := &badger.Entry{
+		Key: append([]byte{},key...),
+		Value: stamp(msg.Timestamp,nil),
+		UserMeta: t_tombstone,
+		ExpiresAt: uint64(time.Now().Add(ttl).Unix()),
+	}
+	if err := w.setEntry(ent); err!=nil {
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	if found {
+		w.bj.add(req)
+		return
+	}
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			w.reply(req,respFail(e,db.Resps))
+			return
+		}
+		w.reply(req,respNew(kvtp.RESP_NotFound,db.Resps))
+	})
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+)
+
+/*
+Performs CMD_Stat. The statistics are gathered by the writer, as it owns most of
+the state.
+*/
+func (w *writer) stat(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	resp := respNew(kvtp.RESP_Entries,db.Resps)
+	add := func(name string, val []byte) {
+		e := resp.AddEntry()
+		e.Key = append(e.Key,name...)
+		e.Val = append(e.Val,val...)
+	}
+	num := func(name string, n int64) { add(name,strconv.AppendInt(nil,n,10)) }
+	
+	lsm,vlog := db.DB.Size()
+	add("node",[]byte(db.Name))
+	num("lsm_bytes",lsm)
+	num("vlog_bytes",vlog)
+	num("watchers",int64(atomic.LoadInt32(&db.watch.n)))
+	num("txn_prepared",int64(len(w.prepared)))
+	num("txn_locked_keys",int64(len(w.locks)))
+	num("read_repairs",w.repairs)
+	num("hints_received",w.hints)
+	
+	spaces := make([]string,0,len(db.Spaces))
+	for ns := range db.Spaces { spaces = append(spaces,ns) }
+	sort.Strings(spaces)
+	for _,ns := range spaces {
+		u := w.usage(ns)
+		if u==nil || u.counted.IsZero() { continue } // Not counted yet.
+		num("namespace."+ns+".keys",u.keys)
+		num("namespace."+ns+".bytes",u.bytes)
+	}
+	w.reply(req,resp)
+}
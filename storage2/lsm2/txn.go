@@ -0,0 +1,396 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+	"github.com/vmihailenco/msgpack"
+)
+
+const DefaultTxnTimeout = 30*time.Second
+
+var errLocked = errors.New("Key is locked by a transaction")
+var errDiskFull = errors.New("Disk full")
+
+/*
+Prepared transactions are stored under 0xFF 't' <txid>, so they survive a restart.
+*/
+func txnKey(id []byte) []byte {
+	return append([]byte{keyReserved,'t'},id...)
+}
+
+/*
+Committed transactions are remembered under 0xFF 'c' <txid> for the TxnTimeout,
+so a coordinator, whose commit timed out, can retry it.
+*/
+func txnDoneKey(id []byte) []byte {
+	return append([]byte{keyReserved,'c'},id...)
+}
+
+func (db *DB) txnTimeout() time.Duration {
+	if db.TxnTimeout>0 { return db.TxnTimeout }
+	return DefaultTxnTimeout
+}
+
+/*
+A prepared transaction, see CMD_TxnPrepare.
+*/
+type prepared struct{
+	id      string
+	msg     *kvtp.Request
+	keys    []string
+	expires time.Time
+	
+	committing bool
+	waiters    []*rpcmux.Request // CMD_TxnCommit requests, answered once the commit is done.
+}
+
+func decodePrepared(id string, data []byte, expires time.Time) (*prepared,error) {
+	msg := new(kvtp.Request)
+	if err := msgpack.Unmarshal(data,msg); err!=nil { return nil,err }
+	p := &prepared{id:id,msg:msg,expires:expires}
+	for i := range msg.Entries {
+		p.keys = append(p.keys,string(nsKey(msg.Namespace,msg.Entries[i].Key)))
+	}
+	return p,nil
+}
+
+/*
+Loads the prepared transactions, that have not expired yet.
+*/
+func (w *writer) loadPrepared() {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = txnKey(nil)
+	it := w.tx.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		data,err := item.ValueCopy(nil)
+		if err!=nil { continue }
+		p,err := decodePrepared(string(item.Key()[2:]),data,time.Unix(int64(item.ExpiresAt()),0))
+		if err!=nil { continue }
+		w.lock(p)
+	}
+}
+
+func (w *writer) lock(p *prepared) {
+	if w.prepared==nil {
+		w.prepared = make(map[string]*prepared)
+		w.locks = make(map[string]string)
+	}
+	w.prepared[p.id] = p
+	for _,k := range p.keys { w.locks[k] = p.id }
+}
+func (w *writer) unlock(p *prepared) {
+	delete(w.prepared,p.id)
+	for _,k := range p.keys {
+		if w.locks[k]==p.id { delete(w.locks,k) }
+	}
+}
+
+/* Unlocks p and deletes its intent. */
+func (w *writer) discard(p *prepared) {
+	w.unlock(p)
+	// If this fails, the intent expires on its own.
+	w.del(txnKey([]byte(p.id)))
+}
+
+/*
+Reports, whether key is locked by a prepared transaction, other than the one,
+that is currently committed. Expired transactions are aborted here.
+*/
+func (w *writer) locked(key []byte) bool {
+	id,ok := w.locks[string(key)]
+	if !ok || id==w.owner { return false }
+	if p := w.prepared[id]; p!=nil && !p.committing && time.Now().After(p.expires) {
+		w.discard(p)
+		return false
+	}
+	return true
+}
+
+/*
+Checks the operations of a transaction and adds one entry per operation to resp.
+Returns false, if the transaction can't be performed.
+*/
+func (w *writer) txnCheck(msg *kvtp.Request, resp *kvtp.Response) bool {
+	db := w.db
+	ok := true
+	for i := range msg.Entries {
+		e,re := &msg.Entries[i],resp.AddEntry()
+		re.Code = kvtp.RESP_None
+		re.Key = append(re.Key,e.Key...)
+		key := nsKey(msg.Namespace,e.Key)
+		if w.locked(key) {
+			re.SetError(kvtp.ERR_Conflict,errLocked.Error())
+			ok = false
+			continue
+		}
+		var version uint64
+		item,err := w.tx.Get(key)
+		if err==nil {
+			switch item.UserMeta() {
+			case t_data,t_stamped: version = item.Version()
+			case t_redirect:
+				re.SetError(kvtp.ERR_NotOwner,"Key has been redirected to another node")
+				ok = false
+				continue
+			}
+		} else if err!=badger.ErrKeyNotFound {
+			re.SetError(errCode(err),err.Error())
+			ok = false
+			continue
+		}
+		switch e.Code {
+		case kvtp.TXN_Check:
+			if version!=e.Version {
+				re.Code = kvtp.RESP_Conflict
+				re.Version = version
+				ok = false
+			}
+		case kvtp.TXN_Put:
+			if !db.DS.HasEnoughDiskSpace(e.Key,e.Val) {
+				re.SetError(kvtp.ERR_DiskFull,"Disk full")
+				ok = false
+			}
+		case kvtp.TXN_Delete:
+		default:
+			re.SetError(kvtp.ERR_Unsupported,"Operation Unsupported")
+			ok = false
+		}
+	}
+	return ok
+}
+
+/*
+Applies the operations of a transaction, without flushing. On error, the caller
+must rollback. Returns a function, that accounts for the disk space of the
+writes, once they are committed.
+*/
+func (w *writer) txnApply(msg *kvtp.Request) (func(),error) {
+	db := w.db
+	for i := range msg.Entries {
+		e := &msg.Entries[i]
+		if e.Code==kvtp.TXN_Put && !db.DS.HasEnoughDiskSpace(e.Key,e.Val) { return nil,errDiskFull }
+	}
+	for i := range msg.Entries {
+		e := &msg.Entries[i]
+		key := nsKey(msg.Namespace,e.Key)
+		var err error
+		switch e.Code {
+		case kvtp.TXN_Put:
+			err = w.set(&badger.Entry{Key: key, Value: stamp(w.stampFor(key,msg.Timestamp),e.Val), UserMeta: t_stamped, ExpiresAt: db.expiresAt(msg.Namespace,e.ExpiresAt)})
+		case kvtp.TXN_Delete:
+			err = w.del(key)
+		}
+		if err!=nil { return nil,err }
+	}
+	return func() {
+		for i := range msg.Entries {
+			e := &msg.Entries[i]
+			if e.Code==kvtp.TXN_Put { db.DS.AccountForDiskSpace(e.Key,e.Val) }
+		}
+	},nil
+}
+
+/*
+Discards the uncommitted writes. The Txn must not contain writes of other requests.
+*/
+func (w *writer) rollback(events int) {
+	w.tx.Discard()
+	w.tx = w.db.DB.NewTransaction(true)
+	w.bj.events = w.bj.events[:events]
+	w.recount()
+	w.dirty = false
+	w.written = nil
+}
+
+/*
+Completes the commit of p, once its batch is done. If it failed, p stays
+prepared, so the commit can be retried.
+*/
+func (w *writer) txnDone(p *prepared, account func(), e error) {
+	p.committing = false
+	if e==nil {
+		w.unlock(p)
+		account()
+	}
+	p.reply(e,w.db.Resps)
+}
+
+func (p *prepared) reply(e error, pool *sync.Pool) {
+	for _,req := range p.waiters {
+		if e!=nil {
+			req.Reply(respFail(e,pool))
+		} else {
+			req.Reply(respOk(pool))
+		}
+		req.Release()
+	}
+	p.waiters = nil
+}
+
+/*
+Persists the intent of msg and locks its keys.
+*/
+func (w *writer) prepare(msg *kvtp.Request) error {
+	data,err := msgpack.Marshal(msg)
+	if err!=nil { return err }
+	exp := uint64(time.Now().Add(w.db.txnTimeout()).Unix())
+	err = w.set(&badger.Entry{Key: txnKey(msg.Val), Value: data, ExpiresAt: exp})
+	if err!=nil { return err }
+	p,err := decodePrepared(string(msg.Val),data,time.Unix(int64(exp),0))
+	if err!=nil { return err }
+	w.lock(p)
+	return nil
+}
+
+/*
+Performs CMD_Txn and CMD_TxnPrepare.
+*/
+func (w *writer) txn(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	prepare := msg.Cmd==kvtp.CMD_TxnPrepare
+	if prepare {
+		if len(msg.Val)==0 {
+			w.reply(req,respErr(kvtp.ERR_InvalidKey,"Missing transaction id",db.Resps))
+			return
+		}
+		if w.prepared[string(msg.Val)]!=nil {
+			w.reply(req,respOk(db.Resps))
+			return
+		}
+	}
+	
+	// The transaction must be the only one in the Txn, so it can be rolled back.
+	if w.dirty { w.flush() }
+	
+	resp := respNew(kvtp.RESP_Entries,db.Resps)
+	if !w.txnCheck(msg,resp) {
+		resp.SetTxnFailed()
+		w.reply(req,resp)
+		return
+	}
+	events := len(w.bj.events)
+	account := func(){}
+	var err error
+	if prepare {
+		err = w.prepare(msg)
+	} else {
+		account,err = w.txnApply(msg)
+	}
+	if err!=nil {
+		w.rollback(events)
+		resp.SetError(errCode(err),err.Error())
+		w.reply(req,resp)
+		return
+	}
+	resp.Code = kvtp.RESP_None
+	resp.Entries = resp.Entries[:0]
+	w.bj.addHook(func(e error) {
+		if e!=nil {
+			resp.SetError(errCode(e),e.Error())
+		} else {
+			account()
+		}
+		req.Reply(resp)
+		req.Release()
+	})
+}
+
+/*
+Performs CMD_TxnCommit and CMD_TxnAbort.
+*/
+func (w *writer) txnEnd(req *rpcmux.Request, msg *kvtp.Request) {
+	db := w.db
+	p := w.prepared[string(msg.Val)]
+	if p!=nil && !p.committing && time.Now().After(p.expires) {
+		w.discard(p)
+		p = nil
+	}
+	if p==nil {
+		switch {
+		case msg.Cmd==kvtp.CMD_TxnAbort:
+			w.reply(req,respOk(db.Resps))
+		case w.committed(msg.Val):
+			w.reply(req,respOk(db.Resps))
+		default:
+			w.reply(req,respNew(kvtp.RESP_NotFound,db.Resps))
+		}
+		return
+	}
+	if p.committing {
+		if msg.Cmd==kvtp.CMD_TxnAbort {
+			w.reply(req,respErr(kvtp.ERR_Conflict,"Transaction is being committed",db.Resps))
+		} else {
+			p.waiters = append(p.waiters,req)
+		}
+		return
+	}
+	if msg.Cmd==kvtp.CMD_TxnAbort {
+		w.discard(p)
+		w.bj.add(req)
+		return
+	}
+	if w.dirty { w.flush() }
+	
+	/*
+	The intent is replaced by the commit marker along with the writes. The
+	transaction stays prepared, until they are committed, so the coordinator can
+	retry, if they fail.
+	*/
+	events := len(w.bj.events)
+	w.owner = p.id
+	account,err := w.txnApply(p.msg)
+	if err==nil { err = w.del(txnKey([]byte(p.id))) }
+	if err==nil {
+		exp := uint64(time.Now().Add(db.txnTimeout()).Unix())
+		err = w.set(&badger.Entry{Key: txnDoneKey([]byte(p.id)), ExpiresAt: exp})
+	}
+	w.owner = ""
+	if err!=nil {
+		w.rollback(events)
+		w.reply(req,respFail(err,db.Resps))
+		return
+	}
+	p.committing = true
+	p.waiters = append(p.waiters,req)
+	w.bj.addHook(func(e error) {
+		// On shutdown, the writer doesn't handle p anymore.
+		if !db.onWriter(func(w *writer) { w.txnDone(p,account,e) }) { p.reply(e,db.Resps) }
+	})
+}
+
+/* Reports, whether the transaction id has been committed recently. */
+func (w *writer) committed(id []byte) bool {
+	_,err := w.tx.Get(txnDoneKey(id))
+	return err==nil
+}
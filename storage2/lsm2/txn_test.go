@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/kvtp/client"
+)
+
+/*
+A DiskSpace, that can be filled up.
+*/
+type switchDisk struct{ full int32 }
+func (d *switchDisk) HasEnoughDiskSpace(key, value []byte) bool { return atomic.LoadInt32(&d.full)==0 }
+func (d *switchDisk) AccountForDiskSpace(key, value []byte) {}
+
+func txnOp(r *kvtp.Request, code uint8, key, val string) {
+	e := r.AddEntry()
+	e.Code = code
+	e.Key = append(e.Key,key...)
+	e.Val = append(e.Val,val...)
+}
+
+/*
+Sends CMD_TxnPrepare (with the operations added by ops), CMD_TxnCommit or CMD_TxnAbort.
+*/
+func (tdb *testDB) txn(cmd uint8, id string, ops func(r *kvtp.Request)) (*kvtp.Response,error) {
+	var resp *kvtp.Response
+	err := tdb.cli.Do(context.Background(),func(r *kvtp.Request) {
+		r.Cmd = cmd
+		r.Val = append(r.Val,id...)
+		if ops!=nil { ops(r) }
+	},func(r *kvtp.Response) error {
+		resp = new(kvtp.Response)
+		resp.CopyFrom(r)
+		return nil
+	})
+	return resp,err
+}
+
+func (tdb *testDB) value(t *testing.T, key string) string {
+	item,err := tdb.cli.Get(context.Background(),[]byte(key))
+	if err==client.ErrNotFound { return "" }
+	if err!=nil { t.Fatal(err) }
+	return string(item.Value)
+}
+
+func errCodeOf(err error) uint8 {
+	if e,ok := err.(*client.Error); ok { return e.Code }
+	return kvtp.ERR_None
+}
+
+func TestTxnPrepareCommit(t *testing.T) {
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	if err := tdb.cli.Put(ctx,[]byte("b"),[]byte("old")); err!=nil { t.Fatal(err) }
+	
+	resp,err := tdb.txn(kvtp.CMD_TxnPrepare,"t1",func(r *kvtp.Request) {
+		txnOp(r,kvtp.TXN_Put,"a","new")
+		txnOp(r,kvtp.TXN_Delete,"b","")
+	})
+	if err!=nil || resp.Code!=kvtp.RESP_None { t.Fatalf("prepare: %v %v",resp,err) }
+	
+	// The keys are locked, until the transaction ends.
+	if err := tdb.cli.Put(ctx,[]byte("a"),[]byte("x")); errCodeOf(err)!=kvtp.ERR_Conflict { t.Errorf("put of a locked key: %v",err) }
+	resp,err = tdb.txn(kvtp.CMD_TxnPrepare,"t2",func(r *kvtp.Request) { txnOp(r,kvtp.TXN_Put,"b","x") })
+	if err==nil && resp.Code==kvtp.RESP_None { t.Errorf("conflicting prepare succeeded") }
+	if v := tdb.value(t,"a"); v!="" { t.Errorf("a before commit: %q",v) }
+	
+	if _,err := tdb.txn(kvtp.CMD_TxnCommit,"t1",nil); err!=nil { t.Fatal(err) }
+	if v := tdb.value(t,"a"); v!="new" { t.Errorf("a: %q",v) }
+	if v := tdb.value(t,"b"); v!="" { t.Errorf("b: %q",v) }
+	if err := tdb.cli.Put(ctx,[]byte("a"),[]byte("x")); err!=nil { t.Errorf("put after commit: %v",err) }
+	
+	// The transaction is gone, but a retried commit succeeds.
+	if resp,err = tdb.txn(kvtp.CMD_TxnCommit,"t1",nil); err!=nil || resp.Code!=kvtp.RESP_None { t.Errorf("second commit: %v %v",resp,err) }
+	if v := tdb.value(t,"a"); v!="x" { t.Errorf("a after second commit: %q",v) }
+	if _,err = tdb.txn(kvtp.CMD_TxnAbort,"t1",nil); err!=nil { t.Errorf("abort after commit: %v",err) }
+}
+
+func TestTxnAbort(t *testing.T) {
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	if err := tdb.cli.Put(ctx,[]byte("a"),[]byte("old")); err!=nil { t.Fatal(err) }
+	if _,err := tdb.txn(kvtp.CMD_TxnPrepare,"t",func(r *kvtp.Request) { txnOp(r,kvtp.TXN_Put,"a","new") }); err!=nil { t.Fatal(err) }
+	if _,err := tdb.txn(kvtp.CMD_TxnAbort,"t",nil); err!=nil { t.Fatal(err) }
+	if v := tdb.value(t,"a"); v!="old" { t.Errorf("a: %q",v) }
+	if err := tdb.cli.Put(ctx,[]byte("a"),[]byte("x")); err!=nil { t.Errorf("put after abort: %v",err) }
+	if resp,err := tdb.txn(kvtp.CMD_TxnCommit,"t",nil); err!=nil || resp.Code!=kvtp.RESP_NotFound { t.Errorf("commit after abort: %v %v",resp,err) }
+}
+
+/*
+A transaction, that timed out, can't be committed anymore.
+*/
+func TestTxnCommitExpired(t *testing.T) {
+	tdb := openDB(t,func(db *DB) { db.TxnTimeout = time.Second })
+	if _,err := tdb.txn(kvtp.CMD_TxnPrepare,"t",func(r *kvtp.Request) { txnOp(r,kvtp.TXN_Put,"a","new") }); err!=nil { t.Fatal(err) }
+	time.Sleep(1500*time.Millisecond)
+	if resp,err := tdb.txn(kvtp.CMD_TxnCommit,"t",nil); err!=nil || resp.Code!=kvtp.RESP_NotFound { t.Errorf("commit after timeout: %v %v",resp,err) }
+	if v := tdb.value(t,"a"); v!="" { t.Errorf("a: %q",v) }
+}
+
+func TestTxnCheckConflict(t *testing.T) {
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	if err := tdb.cli.Put(ctx,[]byte("a"),[]byte("1")); err!=nil { t.Fatal(err) }
+	tx := tdb.cli.Begin()
+	if _,err := tx.Get(ctx,[]byte("a")); err!=nil { t.Fatal(err) }
+	tx.Put([]byte("a"),[]byte("2"),0)
+	tx.Put([]byte("b"),[]byte("2"),0)
+	if err := tdb.cli.Put(ctx,[]byte("a"),[]byte("3")); err!=nil { t.Fatal(err) }
+	if err := tx.Commit(ctx); err!=client.ErrConflict { t.Fatalf("commit: %v",err) }
+	if v := tdb.value(t,"a"); v!="3" { t.Errorf("a: %q",v) }
+	if v := tdb.value(t,"b"); v!="" { t.Errorf("b: %q",v) }
+}
+
+/*
+A commit, that fails, keeps the transaction prepared, so it can be retried.
+*/
+func TestTxnCommitRetry(t *testing.T) {
+	disk := new(switchDisk)
+	tdb := openDB(t,func(db *DB) { db.DS = disk })
+	if _,err := tdb.txn(kvtp.CMD_TxnPrepare,"t",func(r *kvtp.Request) { txnOp(r,kvtp.TXN_Put,"a","new") }); err!=nil { t.Fatal(err) }
+	atomic.StoreInt32(&disk.full,1)
+	if _,err := tdb.txn(kvtp.CMD_TxnCommit,"t",nil); errCodeOf(err)!=kvtp.ERR_DiskFull { t.Fatalf("commit on a full disk: %v",err) }
+	if v := tdb.value(t,"a"); v!="" { t.Errorf("a after failed commit: %q",v) }
+	atomic.StoreInt32(&disk.full,0)
+	if resp,err := tdb.txn(kvtp.CMD_TxnCommit,"t",nil); err!=nil || resp.Code!=kvtp.RESP_None { t.Fatalf("retry: %v %v",resp,err) }
+	if v := tdb.value(t,"a"); v!="new" { t.Errorf("a: %q",v) }
+}
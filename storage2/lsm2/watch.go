@@ -0,0 +1,250 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lsm2
+
+import (
+	"bytes"
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+	"github.com/byte-mug/zrab2k/rpcmux"
+	"github.com/dgraph-io/badger"
+)
+
+/*
+Number of batches, a watcher may fall behind, before it is terminated with ERR_Lagging.
+*/
+const watchBacklog = 256
+
+type watcher struct{
+	ns     string
+	key    []byte // Stored key or prefix.
+	prefix bool
+	ch     chan []kvtp.Entry
+	lag    chan struct{}
+	lagged int32
+}
+func (wt *watcher) matches(key []byte) bool {
+	if wt.prefix {
+		if !bytes.HasPrefix(key,wt.key) { return false }
+		// Internal keys are not part of the default namespace.
+		return wt.ns!="" || len(key)==0 || key[0]!=keyReserved
+	}
+	return bytes.Equal(key,wt.key)
+}
+
+type watchHub struct{
+	mu   sync.Mutex
+	list map[*watcher]struct{}
+	n    int32
+}
+func (h *watchHub) watching() bool {
+	return atomic.LoadInt32(&h.n)!=0
+}
+func (h *watchHub) add(wt *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.list==nil { h.list = make(map[*watcher]struct{}) }
+	h.list[wt] = struct{}{}
+	atomic.StoreInt32(&h.n,int32(len(h.list)))
+}
+func (h *watchHub) remove(wt *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.list,wt)
+	atomic.StoreInt32(&h.n,int32(len(h.list)))
+}
+
+/*
+Distributes the events of a committed batch. Never blocks.
+*/
+func (h *watchHub) publish(events []kvtp.Entry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for wt := range h.list {
+		var evs []kvtp.Entry
+		for i := range events {
+			if wt.matches(events[i].Key) { evs = append(evs,events[i]) }
+		}
+		if len(evs)==0 { continue }
+		select {
+		case wt.ch <- evs:
+		default:
+			if atomic.CompareAndSwapInt32(&wt.lagged,0,1) { close(wt.lag) }
+		}
+	}
+}
+
+/*
+Records an event of the current batch, if someone is watching. Redirect pointers
+and locks are no values, they don't cause events.
+*/
+func (w *writer) event(code uint8, ent *badger.Entry) {
+	if w.quiet || ent.UserMeta==t_redirect || !w.db.watch.watching() { return }
+	e := kvtp.Entry{Code:code,Key:append([]byte(nil),ent.Key...),ExpiresAt:ent.ExpiresAt}
+	if code==kvtp.EVENT_Put && (ent.UserMeta==t_data || ent.UserMeta==t_stamped) {
+		val,_ := unstamp(ent.UserMeta,ent.Value)
+		e.Val = append([]byte(nil),val...)
+	}
+	w.bj.events = append(w.bj.events,e)
+}
+
+/*
+Keys, that will expire, ordered by expiration time.
+*/
+type expiry struct{
+	at  uint64
+	key string
+}
+type expiryHeap []expiry
+func (h expiryHeap) Len() int { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at<h[j].at }
+func (h expiryHeap) Swap(i, j int) { h[i],h[j] = h[j],h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h,x.(expiry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type expiries struct{
+	heap expiryHeap
+	at   map[string]uint64 // Current expiration time of every key.
+}
+func (e *expiries) set(key []byte, at uint64) {
+	if at==0 {
+		delete(e.at,string(key))
+		return
+	}
+	e.at[string(key)] = at
+	heap.Push(&e.heap,expiry{at,string(key)})
+}
+func (e *expiries) next() <- chan time.Time {
+	if len(e.heap)==0 { return nil }
+	return time.After(time.Until(time.Unix(int64(e.heap[0].at),0)))
+}
+
+/*
+Registers a watcher. Called by the writer, so no committed batch is missed.
+*/
+func (db *DB) watchStart(req *rpcmux.Request, msg *kvtp.Request) {
+	wt := &watcher{
+		ns:     msg.Namespace,
+		key:    append([]byte(nil),nsKey(msg.Namespace,msg.Key)...),
+		prefix: msg.Flags&kvtp.FLAG_Prefix!=0,
+		ch:     make(chan []kvtp.Entry,watchBacklog),
+		lag:    make(chan struct{}),
+	}
+	db.watch.add(wt)
+	go db.watchLoop(req,wt)
+}
+
+/*
+Collects the keys with expiration time, that are currently watched.
+*/
+func (db *DB) watchSeed(wt *watcher, exp *expiries) {
+	tx := db.DB.NewTransaction(false)
+	defer tx.Discard()
+	if !wt.prefix {
+		if item,err := tx.Get(wt.key); err==nil { exp.set(wt.key,item.ExpiresAt()) }
+		return
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = wt.key
+	it := tx.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !wt.matches(item.Key()) { continue }
+		if item.ExpiresAt()!=0 { exp.set(item.KeyCopy(nil),item.ExpiresAt()) }
+	}
+}
+
+/*
+Removes and returns the keys, that have expired.
+*/
+func (db *DB) watchExpired(exp *expiries) (keys [][]byte) {
+	now := uint64(time.Now().Unix())
+	tx := db.DB.NewTransaction(false)
+	defer tx.Discard()
+	for len(exp.heap)!=0 && exp.heap[0].at<=now {
+		x := heap.Pop(&exp.heap).(expiry)
+		if exp.at[x.key]!=x.at { continue } // Outdated.
+		delete(exp.at,x.key)
+		if _,err := tx.Get([]byte(x.key)); err==badger.ErrKeyNotFound {
+			keys = append(keys,[]byte(x.key))
+		}
+	}
+	return
+}
+
+func (db *DB) watchLoop(req *rpcmux.Request, wt *watcher) {
+	defer req.Release()
+	defer db.watch.remove(wt)
+	ctx := req.Context()
+	base := len(nsPrefix(wt.ns))
+	exp := &expiries{at:make(map[string]uint64)}
+	db.watchSeed(wt,exp)
+	for {
+		var resp *kvtp.Response
+		select {
+		case <- ctx.Done():
+			return
+		case <- db.Die:
+			req.Reply(respNew(kvtp.RESP_None,db.Resps))
+			return
+		case <- wt.lag:
+			req.Reply(respErr(kvtp.ERR_Lagging,"Watcher could not keep up",db.Resps))
+			return
+		case evs := <- wt.ch:
+			resp = respNew(kvtp.RESP_Event,db.Resps)
+			for i := range evs {
+				ev := &evs[i]
+				switch ev.Code {
+				case kvtp.EVENT_Put: exp.set(ev.Key,ev.ExpiresAt)
+				case kvtp.EVENT_Delete: exp.set(ev.Key,0)
+				}
+				e := resp.AddEntry()
+				e.Code = ev.Code
+				e.Key = append(e.Key,ev.Key[base:]...)
+				e.Val = append(e.Val,ev.Val...)
+				e.ExpiresAt = ev.ExpiresAt
+			}
+		case <- exp.next():
+			keys := db.watchExpired(exp)
+			if len(keys)==0 { continue }
+			resp = respNew(kvtp.RESP_Event,db.Resps)
+			for _,key := range keys {
+				e := resp.AddEntry()
+				e.Code = kvtp.EVENT_Expire
+				e.Key = append(e.Key,key[base:]...)
+			}
+		}
+		if !req.ReplyPartial(resp) { return }
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package lsm2
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"github.com/byte-mug/zrab2k/kvtp"
+)
+
+/*
+Events of each key arrive in the order of the writes, even though batches are
+committed concurrently.
+*/
+func TestWatchOrder(t *testing.T) {
+	const writers,writes = 8,100
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	wa,err := tdb.cli.Watch(ctx,[]byte("k"),true)
+	if err!=nil { t.Fatal(err) }
+	defer wa.Close()
+	time.Sleep(10*time.Millisecond) // The watch must be registered.
+	
+	var wg sync.WaitGroup
+	for g := 0 ; g<writers ; g++ {
+		wg.Add(1)
+		go func(key []byte) {
+			defer wg.Done()
+			for i := 0 ; i<writes ; i++ {
+				if err := tdb.cli.Put(ctx,key,[]byte(strconv.Itoa(i))); err!=nil { t.Error(err) }
+			}
+		}([]byte(fmt.Sprint("k",g)))
+	}
+	
+	last := make(map[string]int)
+	for n := 0 ; n<writers*writes ; {
+		evs,err := wa.Next()
+		if err!=nil { t.Fatal(err) }
+		for _,ev := range evs {
+			i,_ := strconv.Atoi(string(ev.Value))
+			if prev,ok := last[string(ev.Key)]; ok && i!=prev+1 { t.Fatalf("%s: %d after %d",ev.Key,i,prev) }
+			last[string(ev.Key)] = i
+			n++
+		}
+	}
+	wg.Wait()
+}
+
+func TestWatchSkipsLocks(t *testing.T) {
+	tdb := openDB(t,nil)
+	ctx := context.Background()
+	wa,err := tdb.cli.Watch(ctx,[]byte("k"),true)
+	if err!=nil { t.Fatal(err) }
+	defer wa.Close()
+	time.Sleep(10*time.Millisecond)
+	
+	if _,err := tdb.cli.Lock(ctx,[]byte("klock"),[]byte("me"),time.Minute); err!=nil { t.Fatal(err) }
+	if err := tdb.cli.Put(ctx,[]byte("kval"),[]byte("v")); err!=nil { t.Fatal(err) }
+	evs,err := wa.Next()
+	if err!=nil { t.Fatal(err) }
+	if len(evs)!=1 || evs[0].Kind!=kvtp.EVENT_Put || string(evs[0].Key)!="kval" || string(evs[0].Value)!="v" {
+		t.Fatalf("got %+v",evs)
+	}
+}
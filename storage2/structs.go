@@ -55,6 +55,8 @@ func InfiniteDiskSpace() DiskSpace { return infiniteDiskSpace{} }
 
 type RedirectReader routing.RedirectReader
 type RedirectWriter routing.RedirectWriter
+type NodeClients routing.NodeClients
+type NodeSelector routing.NodeSelector
 
 /*
 type RedirectReader interface{
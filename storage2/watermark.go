@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package storage2
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+A DiskSpace, that watches the file system at Path. Writes are refused, once the
+free space would drop below MinFree bytes, or the used fraction of the file
+system would rise above MaxUsed.
+
+The file system is checked at most once per Interval. In between, the written
+data is subtracted from the free space. If the file system can't be checked,
+writes are not refused.
+*/
+type Watermark struct{
+	Path     string
+	MinFree  uint64 // Bytes, 0 -> no limit.
+	MaxUsed  float64 // Fraction of the file system, 0 -> no limit.
+	Interval time.Duration // 0 -> 1 second.
+	
+	mu      sync.Mutex
+	free    uint64
+	total   uint64
+	err     error
+	checked time.Time
+}
+func (w *Watermark) check() {
+	iv := w.Interval
+	if iv<=0 { iv = time.Second }
+	if time.Since(w.checked)<iv { return }
+	w.free,w.total,w.err = statfs(w.Path)
+	w.checked = time.Now()
+}
+func (w *Watermark) HasEnoughDiskSpace(key, value []byte) bool {
+	n := uint64(len(key)+len(value))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.check()
+	if w.err!=nil { return true }
+	if n>w.free { return false }
+	free := w.free-n
+	if free<w.MinFree { return false }
+	if w.MaxUsed>0 && w.total>0 && float64(w.total-free)/float64(w.total)>w.MaxUsed { return false }
+	return true
+}
+func (w *Watermark) AccountForDiskSpace(key, value []byte) {
+	n := uint64(len(key)+len(value))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n>w.free { n = w.free }
+	w.free -= n
+}